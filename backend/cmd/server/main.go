@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"stocks-backend/internal/api"
 	"stocks-backend/internal/auth"
+	"stocks-backend/internal/bus"
 	"stocks-backend/internal/config"
+	"stocks-backend/internal/leader"
+	"stocks-backend/internal/market"
 	"stocks-backend/internal/simulation"
 	"stocks-backend/internal/storage"
 	"stocks-backend/internal/websocket"
@@ -21,46 +25,117 @@ func main() {
 	// Load configuration
 	cfg := config.Load()
 
-	// Connect to MongoDB
-	log.Println("Connecting to MongoDB...")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	clientOptions := options.Client().ApplyURI(cfg.MongoURI)
-	client, err := mongo.Connect(ctx, clientOptions)
+	// Initialize storage backend
+	store, closeStore, err := openStore(cfg)
 	if err != nil {
-		log.Fatal("Failed to connect to MongoDB:", err)
+		log.Fatal("Failed to initialize storage:", err)
 	}
-	defer func() {
-		if err := client.Disconnect(context.Background()); err != nil {
-			log.Println("Error disconnecting from MongoDB:", err)
-		}
-	}()
+	defer closeStore()
+	log.Printf("Storage initialized successfully (backend=%s)", cfg.StorageBackend)
 
-	// Ping MongoDB to verify connection
-	if err := client.Ping(ctx, nil); err != nil {
-		log.Fatal("Failed to ping MongoDB:", err)
+	// Check the accounts against the ledger
+	if reconciliation, err := store.Reconcile(); err != nil {
+		log.Printf("Failed to reconcile ledger: %v", err)
+	} else {
+		api.LogReconciliation(reconciliation)
 	}
-	log.Println("Successfully connected to MongoDB!")
 
-	// Initialize storage with MongoDB
-	store, err := storage.NewStorage(client, cfg.DatabaseName)
+	hours := market.Hours{
+		PreMarketOpen:   cfg.PreMarketOpen,
+		Open:            cfg.SessionOpen,
+		Close:           cfg.SessionClose,
+		AfterHoursClose: cfg.AfterHoursClose,
+	}
+	calendar, err := market.NewCalendar(cfg.MarketTimezone, hours, cfg.ClosedDays, cfg.Holidays)
 	if err != nil {
-		log.Fatal("Failed to initialize storage:", err)
+		log.Fatal("Failed to initialize market calendar:", err)
 	}
-	log.Println("Storage initialized successfully")
 
 	// Initialize WebSocket hub
-	hub := websocket.NewHub()
+	hub := websocket.NewHub(cfg.WSSendBuffer)
 	go hub.Run()
 
+	// Fan prices and order and account changes out to the hub through the
+	// bus, so every replica's clients see them
+	eventBus, err := openBus(cfg, store)
+	if err != nil {
+		log.Fatal("Failed to initialize event bus:", err)
+	}
+	hubEvents := api.NewHubEvents(hub)
+	hubEvents.Seed(store.GetAllPrices())
+	eventBus.Subscribe(hubEvents)
+	if err := eventBus.Start(); err != nil {
+		log.Fatal("Failed to start event bus:", err)
+	}
+	defer eventBus.Stop()
+	store.SetListener(eventBus)
+
+	// Replicas elect one leader to run the price simulator and match
+	// orders; the others forward order requests to it
+	lease, err := openLease(cfg, store)
+	if err != nil {
+		log.Fatal("Failed to initialize leader lease:", err)
+	}
+
+	// A replica running alone leads even if it doesn't simulate
+	_, standalone := lease.(leader.Standalone)
+	var elector *leader.Elector
+	if cfg.RunSimulator || standalone {
+		elector = leader.NewElector(lease, time.Duration(cfg.LeaderLeaseTTL)*time.Second)
+		// Orders were matched on the last leader meanwhile
+		elector.OnElected(store.ReloadBooks)
+		elector.Start()
+		defer elector.Stop()
+	}
+
 	// Initialize price simulator
-	simulator := simulation.NewSimulator(store, hub)
-	simulator.Start()
-	defer simulator.Stop()
+	models, err := simulation.LoadModelConfig(cfg.PriceModels)
+	if err != nil {
+		log.Fatal("Failed to load price models:", err)
+	}
+	var simulator *simulation.Simulator
+	if cfg.RunSimulator {
+		simulator = simulation.NewSimulator(store, eventBus, elector, models, int64(cfg.SimSeed))
+		simulator.UseCalendar(calendar)
+		if cfg.ReplayPath != "" {
+			replay, err := simulation.LoadReplay(cfg.ReplayPath, cfg.ReplaySpeed, cfg.ReplayLoop)
+			if err != nil {
+				log.Fatal("Failed to load price replay:", err)
+			}
+			simulator.UseReplay(replay)
+			log.Printf("Replaying prices from %s at %gx", cfg.ReplayPath, cfg.ReplaySpeed)
+		}
+		switch cfg.SimClock {
+		case "ticker":
+			simulator.Start()
+			defer simulator.Stop()
+		case "manual":
+			log.Println("Price simulation on a manual clock, advance it with POST /admin/simulator/advance")
+		default:
+			log.Fatalf("Unknown simulator clock %q", cfg.SimClock)
+		}
+	}
+
+	var forwarder *api.LeaderForwarder
+	if !standalone {
+		forwarder = api.NewLeaderForwarder(lease, elector, cfg.AdvertiseURL)
+		log.Printf("Forwarding order requests to the leader; this replica is reachable at %s", cfg.AdvertiseURL)
+	}
+
+	// The leader expires DAY and GTD orders as they come due
+	sweeper := simulation.NewSweeper(store, elector)
+	sweeper.Start()
+	defer sweeper.Stop()
+
+	// The leader starts each trading day and releases queued orders as
+	// sessions open, on the replay's days while replaying
+	sessions := simulation.NewSessionWatcher(store, calendar, elector)
+	sessions.FollowReplay(simulator)
+	sessions.Start()
+	defer sessions.Stop()
 
 	// Initialize handlers
-	handlers := api.NewHandlers(store, hub)
+	handlers := api.NewHandlers(store, hub, eventBus, calendar, models, simulator, cfg.PriceBand)
 
 	// Create router
 	router := mux.NewRouter()
@@ -73,15 +148,38 @@ func main() {
 	router.HandleFunc("/login", handlers.Login).Methods("POST", "OPTIONS")
 	router.HandleFunc("/prices", handlers.GetPrices).Methods("GET", "OPTIONS")
 	router.HandleFunc("/stocks/{symbol}", handlers.GetStockDetail).Methods("GET", "OPTIONS")
+	router.HandleFunc("/stocks/{symbol}/book", forwarder.Forward(handlers.GetOrderBook)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/stats/correlations", handlers.GetCorrelations).Methods("GET", "OPTIONS")
+	router.HandleFunc("/market/status", handlers.GetMarketStatus).Methods("GET", "OPTIONS")
+	router.HandleFunc("/instruments", handlers.GetInstruments).Methods("GET", "OPTIONS")
 	router.HandleFunc("/ws", handlers.HandleWebSocket)
 
 	// Protected routes
 	protectedRouter := router.PathPrefix("/api").Subrouter()
 	protectedRouter.Use(corsMiddleware) // Apply CORS to protected routes too
 	protectedRouter.Use(auth.JWTMiddleware)
-	protectedRouter.HandleFunc("/orders", handlers.CreateOrder).Methods("POST", "OPTIONS")
+	protectedRouter.HandleFunc("/orders", forwarder.Forward(handlers.CreateOrder)).Methods("POST", "OPTIONS")
 	protectedRouter.HandleFunc("/orders", handlers.GetOrders).Methods("GET", "OPTIONS")
+	protectedRouter.HandleFunc("/orders/{id}", forwarder.Forward(handlers.CancelOrder)).Methods("DELETE", "OPTIONS")
+	protectedRouter.HandleFunc("/orders/{id}", forwarder.Forward(handlers.AmendOrder)).Methods("PATCH", "OPTIONS")
 	protectedRouter.HandleFunc("/account", handlers.GetAccount).Methods("GET", "OPTIONS")
+	protectedRouter.HandleFunc("/ledger", handlers.GetLedger).Methods("GET", "OPTIONS")
+
+	// Admin routes
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(corsMiddleware)
+	adminRouter.Use(auth.AdminMiddleware(cfg.AdminToken))
+	adminRouter.HandleFunc("/simulator/advance", forwarder.Forward(handlers.AdvanceSimulator)).Methods("POST", "OPTIONS")
+	adminRouter.HandleFunc("/symbols/{symbol}/halt", forwarder.Forward(handlers.HaltSymbol)).Methods("POST", "OPTIONS")
+	adminRouter.HandleFunc("/symbols/{symbol}/resume", forwarder.Forward(handlers.ResumeSymbol)).Methods("POST", "OPTIONS")
+	adminRouter.HandleFunc("/instruments", handlers.GetInstruments).Methods("GET", "OPTIONS")
+	adminRouter.HandleFunc("/instruments", handlers.CreateInstrument).Methods("POST", "OPTIONS")
+	adminRouter.HandleFunc("/instruments/{symbol}", handlers.UpdateInstrument).Methods("PATCH", "OPTIONS")
+	adminRouter.HandleFunc("/instruments/{symbol}/delist", forwarder.Forward(handlers.DelistInstrument)).Methods("POST", "OPTIONS")
+	adminRouter.HandleFunc("/instruments/{symbol}/relist", forwarder.Forward(handlers.RelistInstrument)).Methods("POST", "OPTIONS")
+	adminRouter.HandleFunc("/ledger", handlers.GetFullLedger).Methods("GET", "OPTIONS")
+	adminRouter.HandleFunc("/ledger/reconcile", handlers.Reconcile).Methods("GET", "OPTIONS")
+	adminRouter.HandleFunc("/accounts/{username}/ledger", handlers.AdjustAccount).Methods("POST", "OPTIONS")
 
 	// Start server
 	log.Printf("Server starting on :%s\n", cfg.ServerPort)
@@ -90,6 +188,99 @@ func main() {
 	}
 }
 
+// openStore creates the storage backend selected by cfg.StorageBackend and
+// returns a function that releases its resources
+func openStore(cfg *config.Config) (storage.Store, func(), error) {
+	costBasis, err := storage.ParseCostBasisMethod(cfg.CostBasis)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch cfg.StorageBackend {
+	case "memory":
+		return storage.NewMemoryStorage(costBasis), func() {}, nil
+	case "mongo", "":
+	default:
+		return nil, nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+
+	// Connect to MongoDB
+	log.Println("Connecting to MongoDB...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clientOptions := options.Client().ApplyURI(cfg.MongoURI)
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+	disconnect := func() {
+		if err := client.Disconnect(context.Background()); err != nil {
+			log.Println("Error disconnecting from MongoDB:", err)
+		}
+	}
+
+	// Ping MongoDB to verify connection
+	if err := client.Ping(ctx, nil); err != nil {
+		disconnect()
+		return nil, nil, fmt.Errorf("failed to ping MongoDB: %w", err)
+	}
+	log.Println("Successfully connected to MongoDB!")
+
+	store, err := storage.NewMongoStorage(client, cfg.DatabaseName, costBasis)
+	if err != nil {
+		disconnect()
+		return nil, nil, err
+	}
+
+	return store, disconnect, nil
+}
+
+// openBus creates the event bus selected by cfg.BusBackend. The mongo bus
+// needs the mongo storage backend.
+func openBus(cfg *config.Config, store storage.Store) (bus.Bus, error) {
+	switch cfg.BusBackend {
+	case "local", "":
+		return bus.NewLocal(), nil
+	case "mongo":
+		mongoStore, ok := store.(*storage.MongoStorage)
+		if !ok {
+			return nil, fmt.Errorf("bus backend %q needs the mongo storage backend", cfg.BusBackend)
+		}
+		return bus.NewMongo(mongoStore), nil
+	default:
+		return nil, fmt.Errorf("unknown bus backend %q", cfg.BusBackend)
+	}
+}
+
+// openLease creates the leader lease selected by cfg.LeaderLease. By default
+// replicas sharing a MongoDB database elect their leader there, and a replica
+// with in-memory storage leads alone. Replicas only share orders, and so
+// can forward them to a leader, through MongoDB.
+func openLease(cfg *config.Config, store storage.Store) (leader.Lease, error) {
+	mongoStore, isMongo := store.(*storage.MongoStorage)
+	switch cfg.LeaderLease {
+	case "":
+		if !isMongo {
+			return leader.Standalone{}, nil
+		}
+	case "mongo", "file":
+		if !isMongo {
+			return nil, fmt.Errorf("leader lease %q needs the mongo storage backend", cfg.LeaderLease)
+		}
+		if cfg.LeaderLease == "file" {
+			return leader.NewFileLease(cfg.LeaderLockFile, cfg.AdvertiseURL), nil
+		}
+	case "none":
+		return leader.Standalone{}, nil
+	default:
+		return nil, fmt.Errorf("unknown leader lease %q", cfg.LeaderLease)
+	}
+
+	leases := mongoStore.Database().Collection("leases")
+	return leader.NewMongoLease(leases, "simulator", leader.ReplicaID(), cfg.AdvertiseURL, time.Duration(cfg.LeaderLeaseTTL)*time.Second), nil
+}
+
 // corsMiddleware adds CORS headers - fully permissive for development
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
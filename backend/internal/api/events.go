@@ -0,0 +1,90 @@
+package api
+
+import (
+	"log"
+	"stocks-backend/internal/storage"
+	"stocks-backend/internal/websocket"
+	"sync"
+)
+
+// HubEvents fans the events from the bus out to this replica's websocket
+// clients: prices to their subscribers, order and account changes to the
+// user they belong to. It keeps the latest prices to value the positions
+// in account updates.
+type HubEvents struct {
+	hub    *websocket.Hub
+	prices map[string]storage.StockPrice
+	mutex  sync.RWMutex
+}
+
+// NewHubEvents creates a bus handler that sends through hub
+func NewHubEvents(hub *websocket.Hub) *HubEvents {
+	return &HubEvents{hub: hub, prices: make(map[string]storage.StockPrice)}
+}
+
+// Seed gives the hub the current prices, so clients that subscribe before
+// the first tick get a snapshot
+func (e *HubEvents) Seed(prices []storage.StockPrice) {
+	e.keepPrices(prices)
+	if err := e.hub.SeedPrices(priceUpdates(prices)); err != nil {
+		log.Printf("Error seeding prices: %v", err)
+	}
+}
+
+// keepPrices remembers the latest prices
+func (e *HubEvents) keepPrices(prices []storage.StockPrice) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, price := range prices {
+		e.prices[price.Symbol] = price
+	}
+}
+
+// PricesChanged streams new prices to their subscribers
+func (e *HubEvents) PricesChanged(prices []storage.StockPrice) {
+	e.keepPrices(prices)
+	if err := e.hub.PublishPrices(priceUpdates(prices)); err != nil {
+		log.Printf("Error publishing prices: %v", err)
+	}
+}
+
+// OrderChanged sends an orderUpdate message to the order's owner
+func (e *HubEvents) OrderChanged(order storage.Order) {
+	if err := e.hub.SendToUser(order.Username, map[string]interface{}{
+		"type":  "orderUpdate",
+		"order": order,
+	}); err != nil {
+		log.Printf("Error sending order update: %v", err)
+	}
+}
+
+// AccountChanged sends an accountUpdate message to the account's owner
+func (e *HubEvents) AccountChanged(account storage.UserAccount) {
+	e.mutex.RLock()
+	response := accountResponse(&account, e.prices)
+	e.mutex.RUnlock()
+	if err := e.hub.SendToUser(account.Username, map[string]interface{}{
+		"type":    "accountUpdate",
+		"account": response,
+	}); err != nil {
+		log.Printf("Error sending account update: %v", err)
+	}
+}
+
+// priceUpdates converts stock prices to the snapshots and deltas the hub
+// streams
+func priceUpdates(prices []storage.StockPrice) []websocket.PriceUpdate {
+	updates := make([]websocket.PriceUpdate, len(prices))
+	for i, price := range prices {
+		updates[i] = websocket.PriceUpdate{
+			Snapshot: price,
+			Delta: websocket.PriceDelta{
+				Symbol: price.Symbol,
+				Price:  price.Price,
+				Change: price.Change,
+				Volume: price.Volume,
+			},
+		}
+	}
+	return updates
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"stocks-backend/internal/leader"
+	"strings"
+)
+
+// Only the leader replica matches orders, so only its order books, stop
+// lists and queues are current. Other replicas forward the requests that
+// place, amend or cancel orders, or read or change what the books hold, to
+// the leader at the address it advertised with its lease.
+
+// forwardedHeader marks a request forwarded by another replica
+const forwardedHeader = "X-Forwarded-By-Replica"
+
+// LeaderForwarder forwards requests to the leader replica
+type LeaderForwarder struct {
+	lease   leader.Lease
+	elector *leader.Elector // nil if this replica doesn't campaign
+	self    string          // address this replica advertises
+}
+
+// NewLeaderForwarder creates a forwarder to the holder of lease, for a
+// replica reachable at self that campaigns with elector, if it isn't nil
+func NewLeaderForwarder(lease leader.Lease, elector *leader.Elector, self string) *LeaderForwarder {
+	return &LeaderForwarder{lease: lease, elector: elector, self: self}
+}
+
+// Forward serves a request with next on the leader and forwards it to the
+// leader on any other replica. Without a leader to forward to it fails with
+// 503. A nil forwarder, for a replica that runs alone, always serves it.
+func (f *LeaderForwarder) Forward(next http.HandlerFunc) http.HandlerFunc {
+	if f == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f.elector != nil && f.elector.IsLeader() {
+			next(w, r)
+			return
+		}
+		if r.Header.Get(forwardedHeader) != "" {
+			writeUnavailable(w, "This replica is no longer the leader, try again")
+			return
+		}
+
+		address, err := f.lease.Holder(r.Context())
+		if err != nil {
+			log.Printf("Error looking up the leader replica: %v", err)
+		}
+		target, parseErr := url.Parse(address)
+		if err != nil || parseErr != nil || address == "" || address == f.self {
+			writeUnavailable(w, "No leader replica is available, try again")
+			return
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			// This replica's CORS middleware has set them already
+			for key := range resp.Header {
+				if strings.HasPrefix(key, "Access-Control-") {
+					resp.Header.Del(key)
+				}
+			}
+			return nil
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Error forwarding %s %s to leader %s: %v", r.Method, r.URL.Path, address, err)
+			writeUnavailable(w, "The leader replica is unavailable, try again")
+		}
+		r.Header.Set(forwardedHeader, f.self)
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// writeUnavailable answers 503 with an error the client can retry after
+func writeUnavailable(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
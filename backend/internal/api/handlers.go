@@ -2,12 +2,18 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"math"
 	"net/http"
 	"stocks-backend/internal/auth"
+	"stocks-backend/internal/bus"
+	"stocks-backend/internal/market"
+	"stocks-backend/internal/money"
+	"stocks-backend/internal/simulation"
 	"stocks-backend/internal/storage"
 	"stocks-backend/internal/websocket"
+	"strconv"
 	"time"
 
 	"strings"
@@ -20,6 +26,7 @@ import (
 var upgrader = ws.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    websocket.Subprotocols,
 	CheckOrigin: func(r *http.Request) bool {
 		// Allow all origins for development
 		// In production, you should check the origin
@@ -29,15 +36,25 @@ var upgrader = ws.Upgrader{
 
 // Handlers contains all HTTP handlers
 type Handlers struct {
-	storage *storage.Storage
-	hub     *websocket.Hub
+	storage   storage.Store
+	hub       *websocket.Hub
+	bus       bus.Bus
+	calendar  *market.Calendar
+	models    *simulation.ModelConfig
+	simulator *simulation.Simulator // nil if this replica doesn't simulate
+	priceBand float64               // percent around the last price, 0 for none
 }
 
 // NewHandlers creates a new Handlers instance
-func NewHandlers(store *storage.Storage, hub *websocket.Hub) *Handlers {
+func NewHandlers(store storage.Store, hub *websocket.Hub, b bus.Bus, calendar *market.Calendar, models *simulation.ModelConfig, simulator *simulation.Simulator, priceBand float64) *Handlers {
 	return &Handlers{
-		storage: store,
-		hub:     hub,
+		storage:   store,
+		hub:       hub,
+		bus:       b,
+		calendar:  calendar,
+		models:    models,
+		simulator: simulator,
+		priceBand: priceBand,
 	}
 }
 
@@ -55,18 +72,279 @@ type SignupRequest struct {
 
 // LoginResponse represents the login response
 type LoginResponse struct {
-	Token   string  `json:"token"`
-	User    string  `json:"user"`
-	Credits float64 `json:"credits"`
+	Token   string       `json:"token"`
+	User    string       `json:"user"`
+	Credits money.Amount `json:"credits"`
 }
 
 // OrderRequest represents the order creation request
 type OrderRequest struct {
-	Symbol    string  `json:"symbol"`
-	Side      string  `json:"side"`
-	OrderType string  `json:"orderType"` // "market" or "limit"
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+	Symbol    string       `json:"symbol"`
+	Side      string       `json:"side"`
+	OrderType string       `json:"orderType"` // "market", "limit", "stop", "stop_limit" or "trailing_stop"
+	Quantity  int          `json:"quantity"`
+	Price     money.Amount `json:"price"`
+
+	StopPrice    money.Amount `json:"stopPrice"`    // stop and stop_limit
+	TrailAmount  money.Amount `json:"trailAmount"`  // trailing_stop, or TrailPercent
+	TrailPercent float64      `json:"trailPercent"` // trailing_stop, or TrailAmount
+
+	TimeInForce string     `json:"timeInForce"` // "GTC" (default), "IOC", "FOK", "DAY" or "GTD"
+	ExpiresAt   *time.Time `json:"expiresAt"`   // GTD only
+
+	// Bracket exits, activated once a market or limit entry fills
+	TakeProfit *ExitRequest `json:"takeProfit"`
+	StopLoss   *ExitRequest `json:"stopLoss"`
+}
+
+// ExitRequest describes a bracket exit. A take-profit is a limit order at
+// Price; a stop-loss is a stop order at StopPrice, or a stop-limit order if
+// Price is also set.
+type ExitRequest struct {
+	Price     money.Amount `json:"price"`
+	StopPrice money.Amount `json:"stopPrice"`
+}
+
+// reject builds the error refusing an order request
+func reject(code, message string) *storage.OrderError {
+	return &storage.OrderError{Code: code, Message: message}
+}
+
+// writeRejection writes a refused order request's message and reason code
+func writeRejection(w http.ResponseWriter, status int, err *storage.OrderError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Message, "code": err.Code})
+}
+
+// validateStop checks the stop fields of an order request, returning an
+// error or nil if they are valid
+func validateStop(req OrderRequest) *storage.OrderError {
+	switch req.OrderType {
+	case "stop", "stop_limit":
+		if req.StopPrice <= 0 {
+			return reject(storage.ReasonInvalidStop, "StopPrice must be greater than 0 for stop orders")
+		}
+	case "trailing_stop":
+		if req.TrailAmount < 0 || req.TrailPercent < 0 || (req.TrailAmount > 0) == (req.TrailPercent > 0) {
+			return reject(storage.ReasonInvalidStop, "Exactly one of trailAmount or trailPercent must be greater than 0 for trailing stop orders")
+		}
+		if req.TrailPercent >= 100 {
+			return reject(storage.ReasonInvalidStop, "TrailPercent must be less than 100")
+		}
+	}
+	return nil
+}
+
+// validateBracket checks the exits of an order request, returning an error
+// or nil if they are valid
+func validateBracket(req OrderRequest) *storage.OrderError {
+	if req.TakeProfit == nil && req.StopLoss == nil {
+		return nil
+	}
+	if req.OrderType != "market" && req.OrderType != "limit" {
+		return reject(storage.ReasonInvalidBracket, "Only market and limit orders can have a takeProfit or stopLoss")
+	}
+	if req.TakeProfit != nil && (req.TakeProfit.Price <= 0 || req.TakeProfit.StopPrice != 0) {
+		return reject(storage.ReasonInvalidBracket, "TakeProfit needs a price greater than 0 and no stopPrice")
+	}
+	if req.StopLoss != nil && (req.StopLoss.StopPrice <= 0 || req.StopLoss.Price < 0) {
+		return reject(storage.ReasonInvalidBracket, "StopLoss needs a stopPrice greater than 0")
+	}
+	if req.TakeProfit != nil && req.StopLoss != nil {
+		if req.Side == "buy" && req.TakeProfit.Price <= req.StopLoss.StopPrice ||
+			req.Side == "sell" && req.TakeProfit.Price >= req.StopLoss.StopPrice {
+			return reject(storage.ReasonInvalidBracket, "TakeProfit price must be on the profitable side of the StopLoss stopPrice")
+		}
+	}
+	return nil
+}
+
+// bracketExits builds the exit orders of a bracket entry: the take-profit
+// first, then the stop-loss
+func bracketExits(req OrderRequest, entry *storage.Order) []*storage.Order {
+	side := "sell"
+	if entry.Side == "sell" {
+		side = "buy"
+	}
+	newExit := func(orderType string, price, stopPrice money.Amount) *storage.Order {
+		return &storage.Order{
+			ID:          uuid.New().String(),
+			Username:    entry.Username,
+			Symbol:      entry.Symbol,
+			Side:        side,
+			OrderType:   orderType,
+			Price:       price,
+			StopPrice:   stopPrice,
+			TimeInForce: storage.TimeInForceGTC,
+			CreatedAt:   entry.CreatedAt,
+		}
+	}
+
+	var exits []*storage.Order
+	if tp := req.TakeProfit; tp != nil {
+		exits = append(exits, newExit("limit", tp.Price, 0))
+	}
+	if sl := req.StopLoss; sl != nil {
+		orderType := "stop"
+		if sl.Price > 0 {
+			orderType = "stop_limit"
+		}
+		exits = append(exits, newExit(orderType, sl.Price, sl.StopPrice))
+	}
+	return exits
+}
+
+// validateTimeInForce checks the time in force of an order request,
+// returning an error or nil if it is valid
+func validateTimeInForce(req OrderRequest, now time.Time) *storage.OrderError {
+	switch req.TimeInForce {
+	case storage.TimeInForceGTC:
+	case storage.TimeInForceIOC, storage.TimeInForceFOK:
+		if req.OrderType != "market" && req.OrderType != "limit" {
+			return reject(storage.ReasonInvalidTimeInForce, "IOC and FOK are only supported for market and limit orders")
+		}
+	case storage.TimeInForceDAY, storage.TimeInForceGTD:
+		if req.OrderType == "market" {
+			return reject(storage.ReasonInvalidTimeInForce, "Market orders can't be DAY or GTD")
+		}
+	default:
+		return reject(storage.ReasonInvalidTimeInForce, "TimeInForce must be 'GTC', 'IOC', 'FOK', 'DAY' or 'GTD'")
+	}
+
+	if req.TimeInForce != storage.TimeInForceGTD {
+		if req.ExpiresAt != nil {
+			return reject(storage.ReasonInvalidTimeInForce, "ExpiresAt is only allowed for GTD orders")
+		}
+	} else if req.ExpiresAt == nil || !req.ExpiresAt.After(now) {
+		return reject(storage.ReasonInvalidTimeInForce, "ExpiresAt must be in the future for GTD orders")
+	}
+	return nil
+}
+
+// sessionRule decides what happens to an order request given the market
+// session and whether its symbol is halted. While the symbol can't trade,
+// market and limit orders are queued until it can, except market orders
+// for a halted symbol, and IOC and FOK orders are rejected; outside the
+// regular session market orders are queued for the open. Stop orders are
+// accepted as usual, since prices don't move while the symbol can't trade.
+// It returns whether to queue the order, or the error refusing it.
+func sessionRule(req OrderRequest, symbol string, session market.Session, halted bool) (bool, *storage.OrderError) {
+	if halted || session == market.Closed {
+		code, reason := storage.ReasonMarketClosed, "the market is closed"
+		if halted {
+			code, reason = storage.ReasonHalted, "trading in "+symbol+" is halted"
+		}
+		switch {
+		case req.TimeInForce == storage.TimeInForceIOC || req.TimeInForce == storage.TimeInForceFOK:
+			return false, reject(code, "IOC and FOK orders can't be placed while "+reason)
+		case req.OrderType == "market" && halted:
+			return false, reject(code, "Market orders can't be placed while "+reason)
+		case req.OrderType == "market" || req.OrderType == "limit":
+			return true, nil
+		}
+		return false, nil
+	}
+
+	if session != market.Regular && req.OrderType == "market" {
+		if req.TimeInForce != storage.TimeInForceGTC {
+			return false, reject(storage.ReasonOutsideRegular, "IOC and FOK market orders are only accepted in the regular session")
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// checkQuantity checks an order quantity against an instrument's lot size
+// and quantity limits, returning an error or nil if it is valid
+func checkQuantity(quantity int, instrument *storage.Instrument) *storage.OrderError {
+	switch {
+	case instrument.LotSize > 1 && quantity%instrument.LotSize != 0:
+		return reject(storage.ReasonQuantityOffLot, fmt.Sprintf("Quantity must be a multiple of the lot size, %d", instrument.LotSize))
+	case instrument.MinQuantity > 0 && quantity < instrument.MinQuantity:
+		return reject(storage.ReasonQuantityBelowMin, fmt.Sprintf("Quantity must be at least %d", instrument.MinQuantity))
+	case instrument.MaxQuantity > 0 && quantity > instrument.MaxQuantity:
+		return reject(storage.ReasonQuantityAboveMax, fmt.Sprintf("Quantity must be at most %d", instrument.MaxQuantity))
+	}
+	return nil
+}
+
+// checkTick checks that a price is a whole number of an instrument's ticks,
+// returning an error or nil if it is
+func checkTick(name string, price money.Amount, instrument *storage.Instrument) *storage.OrderError {
+	if !price.IsMultipleOf(instrument.TickSize) {
+		return reject(storage.ReasonPriceOffTick, fmt.Sprintf("%s must be a multiple of the tick size, %s", name, instrument.TickSize))
+	}
+	return nil
+}
+
+// checkBand checks that a limit price is within band percent of the last
+// price, returning an error or nil if it is. A band of 0 allows any price.
+func checkBand(name string, price, lastPrice money.Amount, band float64) *storage.OrderError {
+	low, high := lastPrice-lastPrice.Percent(band), lastPrice+lastPrice.Percent(band)
+	if band > 0 && (price < low || price > high) {
+		return reject(storage.ReasonPriceOutsideBand, fmt.Sprintf("%s must be within %g%% of the last price, %s to %s", name, band, low, high))
+	}
+	return nil
+}
+
+// validateInstrumentRules checks an order request against its instrument:
+// the quantity against its lot size and limits, every price against its
+// tick size, and every limit price the order or its exits could rest at
+// against the price band around the last price. It returns an error or nil
+// if the request is valid.
+func validateInstrumentRules(req OrderRequest, instrument *storage.Instrument, lastPrice money.Amount, band float64) *storage.OrderError {
+	if err := checkQuantity(req.Quantity, instrument); err != nil {
+		return err
+	}
+
+	type namedPrice struct {
+		name  string
+		price money.Amount
+		limit bool // rests on the book at this price
+	}
+	var prices []namedPrice
+	switch req.OrderType {
+	case "limit":
+		prices = append(prices, namedPrice{"Price", req.Price, true})
+	case "stop":
+		prices = append(prices, namedPrice{"StopPrice", req.StopPrice, false})
+	case "stop_limit":
+		prices = append(prices, namedPrice{"Price", req.Price, true}, namedPrice{"StopPrice", req.StopPrice, false})
+	case "trailing_stop":
+		if req.TrailAmount > 0 {
+			prices = append(prices, namedPrice{"TrailAmount", req.TrailAmount, false})
+		}
+	}
+	if tp := req.TakeProfit; tp != nil {
+		prices = append(prices, namedPrice{"TakeProfit price", tp.Price, true})
+	}
+	if sl := req.StopLoss; sl != nil {
+		prices = append(prices, namedPrice{"StopLoss stopPrice", sl.StopPrice, false})
+		if sl.Price > 0 {
+			prices = append(prices, namedPrice{"StopLoss price", sl.Price, true})
+		}
+	}
+	for _, p := range prices {
+		if err := checkTick(p.name, p.price, instrument); err != nil {
+			return err
+		}
+	}
+	for _, p := range prices {
+		if p.limit {
+			if err := checkBand(p.name, p.price, lastPrice, band); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AmendOrderRequest represents the order amendment request. Omitted fields
+// are left unchanged.
+type AmendOrderRequest struct {
+	Price    money.Amount `json:"price"`
+	Quantity int          `json:"quantity"`
 }
 
 // Signup handles user registration
@@ -161,7 +439,7 @@ func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 	// Get account (we know it exists because ValidatePassword returned true)
 	account := h.storage.GetAccount(req.Username)
 
-	log.Printf("Login: Found account for %s with %.2f credits", req.Username, account.Credits)
+	log.Printf("Login: Found account for %s with %s credits", req.Username, account.Credits)
 
 	// Generate JWT token
 	token, err := auth.GenerateToken(req.Username)
@@ -215,6 +493,143 @@ func (h *Handlers) GetStockDetail(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(price)
 }
 
+// GetOrderBook returns the aggregated bid and ask levels for a stock.
+// The optional depth query parameter limits the levels per side (default 10).
+func (h *Handlers) GetOrderBook(w http.ResponseWriter, r *http.Request) {
+	symbol := strings.ToUpper(mux.Vars(r)["symbol"])
+	if _, exists := h.storage.GetPrice(symbol); !exists {
+		http.Error(w, "Stock not found", http.StatusNotFound)
+		return
+	}
+
+	depth := 10
+	if d, err := strconv.Atoi(r.URL.Query().Get("depth")); err == nil && d > 0 {
+		depth = d
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.storage.GetOrderBook(symbol, depth))
+}
+
+// GetCorrelations returns how the simulated stocks are configured to move
+// together and how they have recently moved
+func (h *Handlers) GetCorrelations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	models, err := h.models.WithInstruments(h.storage.GetInstruments())
+	if err != nil {
+		log.Printf("Error applying instrument price models: %v", err)
+		models = h.models
+	}
+	json.NewEncoder(w).Encode(models.Stats(h.storage.GetAllPrices()))
+}
+
+// AdvanceRequest represents the request body for advancing the simulator
+type AdvanceRequest struct {
+	Ticks int `json:"ticks"`
+}
+
+// AdvanceSimulator runs simulator ticks on demand (admin), for a simulator
+// on a manual clock
+func (h *Handlers) AdvanceSimulator(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.simulator == nil {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "This replica doesn't run the simulator"})
+		return
+	}
+
+	req := AdvanceRequest{Ticks: 1}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	prices, err := h.simulator.Advance(req.Ticks)
+	if errors.Is(err, simulation.ErrNotLeader) || errors.Is(err, simulation.ErrReplayFinished) {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticks":  req.Ticks,
+		"prices": prices,
+	})
+}
+
+// GetMarketStatus returns the market session, when the regular session
+// next opens and closes, and the halted symbols
+func (h *Handlers) GetMarketStatus(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	halted := []string{}
+	for _, price := range h.storage.GetAllPrices() {
+		if price.Halted {
+			halted = append(halted, price.Symbol)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session":   h.calendar.SessionAt(now),
+		"time":      now.In(h.calendar.Location()),
+		"nextOpen":  h.calendar.NextOpen(now),
+		"nextClose": h.calendar.NextClose(now),
+		"halted":    halted,
+	})
+}
+
+// HaltSymbol halts trading in a stock (admin). New orders are queued or
+// rejected and its price stops moving until it resumes.
+func (h *Handlers) HaltSymbol(w http.ResponseWriter, r *http.Request) {
+	h.setHalted(w, strings.ToUpper(mux.Vars(r)["symbol"]), true)
+}
+
+// ResumeSymbol resumes trading in a halted stock (admin), releasing the
+// orders queued for it if the market session allows
+func (h *Handlers) ResumeSymbol(w http.ResponseWriter, r *http.Request) {
+	h.setHalted(w, strings.ToUpper(mux.Vars(r)["symbol"]), false)
+}
+
+// setHalted halts or resumes symbol and sends its new state to the clients
+func (h *Handlers) setHalted(w http.ResponseWriter, symbol string, halted bool) {
+	if err := h.storage.SetHalted(symbol, halted); err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	log.Printf("Trading in %s halted=%t", symbol, halted)
+
+	if !halted {
+		var err error
+		switch h.calendar.SessionAt(time.Now()) {
+		case market.Regular:
+			err = h.storage.ReleaseQueued(symbol, true)
+		case market.PreMarket, market.AfterHours:
+			err = h.storage.ReleaseQueued(symbol, false)
+		}
+		if err != nil {
+			log.Printf("Error releasing queued %s orders: %v", symbol, err)
+		}
+	}
+
+	stock, exists := h.storage.GetPrice(symbol)
+	if !exists {
+		http.Error(w, "Stock not found", http.StatusNotFound)
+		return
+	}
+	h.bus.PublishPrices([]storage.StockPrice{*stock})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stock)
+}
+
 // CreateOrder handles order creation (protected)
 func (h *Handlers) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	// Get username from context (set by auth middleware)
@@ -228,18 +643,14 @@ func (h *Handlers) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	// Ensure account exists
 	if acc := h.storage.GetAccount(username); acc == nil {
 		log.Printf("CreateOrder: Account not found for user=%s", username)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Account not found. Please sign up first."})
+		writeRejection(w, http.StatusNotFound, reject(storage.ReasonAccountNotFound, "Account not found. Please sign up first."))
 		return
 	}
 
 	var req OrderRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Printf("CreateOrder: Failed to decode request body: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		writeRejection(w, http.StatusBadRequest, reject(storage.ReasonInvalidBody, "Invalid request body"))
 		return
 	}
 
@@ -247,90 +658,115 @@ func (h *Handlers) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	req.Symbol = strings.ToUpper(strings.TrimSpace(req.Symbol))
 	req.Side = strings.ToLower(strings.TrimSpace(req.Side))
 	req.OrderType = strings.ToLower(strings.TrimSpace(req.OrderType))
+	req.TimeInForce = strings.ToUpper(strings.TrimSpace(req.TimeInForce))
+	if req.TimeInForce == "" {
+		req.TimeInForce = storage.TimeInForceGTC
+	}
 
 	log.Printf("CreateOrder: User=%s, Request(normalized)=%+v", username, req)
 
 	// Validate input
 	if req.Symbol == "" {
 		log.Println("CreateOrder: Symbol is required")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Symbol is required"})
+		writeRejection(w, http.StatusBadRequest, reject(storage.ReasonInvalidSymbol, "Symbol is required"))
 		return
 	}
 	if req.Side != "buy" && req.Side != "sell" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Side must be 'buy' or 'sell'"})
+		writeRejection(w, http.StatusBadRequest, reject(storage.ReasonInvalidSide, "Side must be 'buy' or 'sell'"))
 		return
 	}
-	if req.OrderType != "market" && req.OrderType != "limit" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "OrderType must be 'market' or 'limit'"})
+	switch req.OrderType {
+	case "market", "limit", "stop", "stop_limit", "trailing_stop":
+	default:
+		writeRejection(w, http.StatusBadRequest, reject(storage.ReasonInvalidOrderType, "OrderType must be 'market', 'limit', 'stop', 'stop_limit' or 'trailing_stop'"))
 		return
 	}
 	if req.Quantity <= 0 {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Quantity must be greater than 0"})
+		writeRejection(w, http.StatusBadRequest, reject(storage.ReasonInvalidQuantity, "Quantity must be greater than 0"))
 		return
 	}
-	if req.OrderType == "limit" && req.Price <= 0 {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Price must be greater than 0 for limit orders"})
+	if (req.OrderType == "limit" || req.OrderType == "stop_limit") && req.Price <= 0 {
+		writeRejection(w, http.StatusBadRequest, reject(storage.ReasonInvalidPrice, "Price must be greater than 0 for limit orders"))
 		return
 	}
-
-	// For market orders, get current price
-	actualPrice := req.Price
-	if req.OrderType == "market" {
-		stockPrice, exists := h.storage.GetPrice(req.Symbol)
-		if !exists {
-			http.Error(w, "Stock not found", http.StatusNotFound)
-			return
-		}
-		// Round to 2 decimal places to avoid precision issues
-		actualPrice = math.Round(stockPrice.Price*100) / 100
+	if err := validateStop(req); err != nil {
+		writeRejection(w, http.StatusBadRequest, err)
+		return
 	}
-
-	// Execute order with validation
-	var err error
-	if req.Side == "buy" {
-		err = h.storage.ExecuteBuyOrder(username, req.Symbol, req.Quantity, actualPrice, req.OrderType)
-	} else {
-		err = h.storage.ExecuteSellOrder(username, req.Symbol, req.Quantity, actualPrice, req.OrderType)
+	if err := validateBracket(req); err != nil {
+		writeRejection(w, http.StatusBadRequest, err)
+		return
 	}
-
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	now := time.Now()
+	if err := validateTimeInForce(req, now); err != nil {
+		writeRejection(w, http.StatusBadRequest, err)
 		return
 	}
 
-	// Determine order status
-	orderStatus := "done" // Market orders are executed immediately
-	if req.OrderType == "limit" {
-		orderStatus = "pending" // Limit orders wait for price condition
+	instrument, exists := h.storage.GetInstrument(req.Symbol)
+	stock, priced := h.storage.GetPrice(req.Symbol)
+	if !exists || !priced {
+		writeRejection(w, http.StatusNotFound, storage.ErrStockNotFound)
+		return
+	}
+	if !instrument.Tradable {
+		writeRejection(w, http.StatusConflict, reject(storage.ReasonDelisted, req.Symbol+" is delisted and can't be traded"))
+		return
+	}
+	if err := validateInstrumentRules(req, instrument, stock.Price, h.priceBand); err != nil {
+		writeRejection(w, http.StatusBadRequest, err)
+		return
+	}
+	queued, rejection := sessionRule(req, req.Symbol, h.calendar.SessionAt(now), stock.Halted)
+	if rejection != nil {
+		writeRejection(w, http.StatusConflict, rejection)
+		return
 	}
 
-	// Create new order
+	// Create new order. Market orders are priced and filled by storage,
+	// limit orders stay open until their price condition is met and stop
+	// orders until the market reaches their stop price. Queued orders wait
+	// off the book until the symbol can trade. DAY orders expire at the
+	// next session close.
+	expiresAt := req.ExpiresAt
+	if req.TimeInForce == storage.TimeInForceDAY {
+		sessionClose := h.calendar.NextClose(now)
+		expiresAt = &sessionClose
+	}
 	order := storage.Order{
-		ID:        uuid.New().String(),
-		Username:  username,
-		Symbol:    req.Symbol,
-		Side:      req.Side,
-		OrderType: req.OrderType,
-		Quantity:  req.Quantity,
-		Price:     actualPrice,
-		Status:    orderStatus,
-		CreatedAt: time.Now(),
+		ID:           uuid.New().String(),
+		Username:     username,
+		Symbol:       req.Symbol,
+		Side:         req.Side,
+		OrderType:    req.OrderType,
+		Quantity:     req.Quantity,
+		Price:        req.Price,
+		StopPrice:    req.StopPrice,
+		TrailAmount:  req.TrailAmount,
+		TrailPercent: req.TrailPercent,
+		TimeInForce:  req.TimeInForce,
+		ExpiresAt:    expiresAt,
+		Queued:       queued,
+		CreatedAt:    now,
+	}
+
+	// Validate, reserve funds and store the order atomically. Bracket exits
+	// are stored with it and activate once it fills. An error filling the
+	// stored order is only logged: it was placed, and failing the request
+	// would make the client place it again.
+	var err error
+	if exits := bracketExits(req, &order); len(exits) > 0 {
+		err = h.storage.PlaceBracket(&order, exits)
+	} else {
+		err = h.storage.PlaceOrder(&order)
+	}
+	var followUp *storage.FollowUpError
+	if errors.As(err, &followUp) {
+		log.Printf("CreateOrder: order %s placed with errors: %v", order.ID, followUp.Err)
+	} else if err != nil {
+		writeOrderError(w, err)
+		return
 	}
-
-	// Store the order
-	h.storage.AddOrder(order)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -351,6 +787,128 @@ func (h *Handlers) GetOrders(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(orders)
 }
 
+// CancelOrder cancels one of the user's pending orders (protected)
+func (h *Handlers) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	orderID := mux.Vars(r)["id"]
+	order, err := h.storage.CancelOrder(username, orderID)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+
+	log.Printf("CancelOrder: User=%s cancelled order %s", username, orderID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// AmendOrder changes the price or quantity of one of the user's pending
+// orders (protected)
+func (h *Handlers) AmendOrder(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req AmendOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRejection(w, http.StatusBadRequest, reject(storage.ReasonInvalidBody, "Invalid request body"))
+		return
+	}
+	if req.Price < 0 || req.Quantity < 0 || (req.Price == 0 && req.Quantity == 0) {
+		code := storage.ReasonInvalidQuantity
+		if req.Price < 0 {
+			code = storage.ReasonInvalidPrice
+		}
+		writeRejection(w, http.StatusBadRequest, reject(code, "Provide a positive price and/or quantity"))
+		return
+	}
+
+	orderID := mux.Vars(r)["id"]
+	if err := h.validateAmendment(username, orderID, req); err != nil {
+		writeRejection(w, http.StatusBadRequest, err)
+		return
+	}
+	order, err := h.storage.AmendOrder(username, orderID, req.Price, req.Quantity)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+
+	log.Printf("AmendOrder: User=%s amended order %s to %d @ %s", username, orderID, order.Quantity, order.Price)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// validateAmendment checks an amendment of one of the user's orders against
+// the order's instrument, returning an error or nil if it is valid. Orders
+// the storage won't amend are left for it to refuse.
+func (h *Handlers) validateAmendment(username, orderID string, req AmendOrderRequest) *storage.OrderError {
+	var order *storage.Order
+	for _, o := range h.storage.GetOrders(username) {
+		if o.ID == orderID {
+			order = &o
+			break
+		}
+	}
+	if order == nil {
+		return nil
+	}
+	instrument, exists := h.storage.GetInstrument(order.Symbol)
+	if !exists {
+		return nil
+	}
+
+	if req.Quantity > 0 {
+		if err := checkQuantity(req.Quantity, instrument); err != nil {
+			return err
+		}
+	}
+	if req.Price > 0 {
+		if err := checkTick("Price", req.Price, instrument); err != nil {
+			return err
+		}
+		if stock, exists := h.storage.GetPrice(order.Symbol); exists && hasLimitPrice(order.OrderType) {
+			return checkBand("Price", req.Price, stock.Price, h.priceBand)
+		}
+	}
+	return nil
+}
+
+// hasLimitPrice reports whether orders of orderType rest at their price
+func hasLimitPrice(orderType string) bool {
+	return orderType == "limit" || orderType == "stop_limit"
+}
+
+// writeOrderError maps storage errors to HTTP status codes. Validation
+// failures are reported as-is with their reason code, anything else is an
+// internal error.
+func writeOrderError(w http.ResponseWriter, err error) {
+	var orderErr *storage.OrderError
+	isOrderErr := errors.As(err, &orderErr)
+	status := http.StatusInternalServerError
+	switch {
+	case err == storage.ErrOrderNotFound, err == storage.ErrStockNotFound:
+		status = http.StatusNotFound
+	case err == storage.ErrOrderNotOpen:
+		status = http.StatusConflict
+	case isOrderErr:
+		status = http.StatusBadRequest
+	default:
+		log.Printf("Order error: %v", err)
+		orderErr = reject(storage.ReasonInternal, "Internal server error")
+	}
+	writeRejection(w, status, orderErr)
+}
+
 // GetAccount returns the user's account information
 func (h *Handlers) GetAccount(w http.ResponseWriter, r *http.Request) {
 	// Get username from context (set by auth middleware)
@@ -366,31 +924,60 @@ func (h *Handlers) GetAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Return account info
-	response := map[string]interface{}{
-		"username":  account.Username,
-		"credits":   account.Credits,
-		"portfolio": account.Portfolio,
+	prices := make(map[string]storage.StockPrice)
+	for _, price := range h.storage.GetAllPrices() {
+		prices[price.Symbol] = price
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(accountResponse(account, prices))
+}
+
+// accountResponse returns the account info sent to its owner. credits and
+// portfolio are the available balances, held amounts are reserved by
+// pending orders. Positions are valued at prices.
+func accountResponse(account *storage.UserAccount, prices map[string]storage.StockPrice) map[string]interface{} {
+	valuation := account.Value(prices)
+	return map[string]interface{}{
+		"username":      account.Username,
+		"credits":       account.Credits,
+		"heldCredits":   account.HeldCredits,
+		"totalCredits":  account.TotalCredits(),
+		"portfolio":     account.Portfolio,
+		"heldShares":    account.HeldShares,
+		"totalShares":   account.TotalShares(),
+		"positions":     valuation.Positions,
+		"marketValue":   valuation.MarketValue,
+		"costBasis":     valuation.CostBasis,
+		"unrealizedPnl": valuation.UnrealizedPnL,
+		"realizedPnl":   valuation.RealizedPnL,
+		"dayChange":     valuation.DayChange,
+	}
 }
 
-// HandleWebSocket handles WebSocket connections
+// HandleWebSocket handles WebSocket connections. Clients that pass a JWT in
+// the token query parameter, or send {"type":"auth","token":...} as their
+// first message, also receive their own order and account updates.
 func (h *Handlers) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	var username string
+	if token := r.URL.Query().Get("token"); token != "" {
+		claims, err := auth.ValidateToken(token)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "Invalid or expired token"})
+			return
+		}
+		username = claims.Username
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
 
-	client := &websocket.Client{
-		Hub:  h.hub,
-		Conn: conn,
-		Send: make(chan []byte, 256),
-	}
-
+	client := h.hub.NewClient(conn, username, conn.Subprotocol() == websocket.ProtocolMsgpack)
 	client.Hub.Register <- client
 
 	// Start reading and writing goroutines
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"stocks-backend/internal/money"
+	"stocks-backend/internal/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAmendTriggeredStopLimitOutsideBand(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.CostAverage)
+	store.CreateAccount("alice", "secret")
+	if _, err := store.AdjustAccount(storage.Adjustment{Username: "alice", Kind: storage.EntryAdjustment, Symbol: "AAPL", Shares: 10}); err != nil {
+		t.Fatalf("AdjustAccount: %v", err)
+	}
+	stop := storage.Order{ID: "stop", Username: "alice", Symbol: "AAPL", Side: "sell", OrderType: "stop_limit",
+		Quantity: 5, StopPrice: money.FromInt(149), Price: money.FromInt(155)}
+	if err := store.PlaceOrder(&stop); err != nil {
+		t.Fatalf("PlaceOrder: %v", err)
+	}
+	// Trigger it; its limit is above the market, so it rests
+	if err := store.UpdatePrice("AAPL", money.FromInt(149), 0); err != nil {
+		t.Fatalf("UpdatePrice: %v", err)
+	}
+	if orders := store.GetOrders("alice"); len(orders) != 1 || !orders[0].Triggered || !orders[0].IsOpen() {
+		t.Fatalf("orders = %+v, want the stop limit triggered and resting", orders)
+	}
+
+	h := NewHandlers(store, nil, nil, nil, nil, nil, 20)
+	if err := h.validateAmendment("alice", "stop", AmendOrderRequest{Price: money.FromInt(160)}); err != nil {
+		t.Errorf("amending to 160 = %v, want it within the band", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPatch, "/api/orders/stop", strings.NewReader(`{"price": 300}`))
+	r = mux.SetURLVars(r.WithContext(context.WithValue(r.Context(), "username", "alice")), map[string]string{"id": "stop"})
+	w := httptest.NewRecorder()
+	h.AmendOrder(w, r)
+
+	var body map[string]string
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusBadRequest || body["code"] != storage.ReasonPriceOutsideBand {
+		t.Errorf("amending to 300 = %d %v, want 400 %s", w.Code, body, storage.ReasonPriceOutsideBand)
+	}
+	if orders := store.GetOrders("alice"); orders[0].Price != money.FromInt(155) {
+		t.Errorf("price = %s, want it left at 155", orders[0].Price)
+	}
+}
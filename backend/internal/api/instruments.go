@@ -0,0 +1,207 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"stocks-backend/internal/money"
+	"stocks-backend/internal/storage"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// symbolPattern is what an instrument's symbol may look like
+var symbolPattern = regexp.MustCompile(`^[A-Z][A-Z0-9.]{0,9}$`)
+
+// InstrumentRequest represents the body of an instrument create or update.
+// Fields omitted from an update are left unchanged; an empty model clears
+// the instrument's price model params.
+type InstrumentRequest struct {
+	Symbol        string                  `json:"symbol"` // create only
+	Name          *string                 `json:"name"`
+	Logo          *string                 `json:"logo"`
+	TickSize      *money.Amount           `json:"tickSize"`      // default 0.01
+	LotSize       *int                    `json:"lotSize"`       // default 1
+	MinQuantity   *int                    `json:"minQuantity"`   // default 0, no minimum
+	MaxQuantity   *int                    `json:"maxQuantity"`   // default 0, no maximum
+	StartingPrice *money.Amount           `json:"startingPrice"` // required to create
+	Model         *map[string]interface{} `json:"model"`
+	Tradable      *bool                   `json:"tradable"` // create only, default true
+}
+
+// apply copies the request's fields onto an instrument
+func (req InstrumentRequest) apply(instrument *storage.Instrument) {
+	if req.Name != nil {
+		instrument.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Logo != nil {
+		instrument.Logo = strings.TrimSpace(*req.Logo)
+	}
+	if req.TickSize != nil {
+		instrument.TickSize = *req.TickSize
+	}
+	if req.LotSize != nil {
+		instrument.LotSize = *req.LotSize
+	}
+	if req.MinQuantity != nil {
+		instrument.MinQuantity = *req.MinQuantity
+	}
+	if req.MaxQuantity != nil {
+		instrument.MaxQuantity = *req.MaxQuantity
+	}
+	if req.StartingPrice != nil {
+		instrument.StartingPrice = *req.StartingPrice
+	}
+	if req.Model != nil {
+		instrument.Model = *req.Model
+		if len(instrument.Model) == 0 {
+			instrument.Model = nil
+		}
+	}
+}
+
+// validateInstrument checks an instrument before it is stored, returning an
+// error message or "" if it is valid
+func (h *Handlers) validateInstrument(instrument *storage.Instrument) string {
+	switch {
+	case !symbolPattern.MatchString(instrument.Symbol):
+		return "Symbol must be 1-10 capital letters, digits or dots, starting with a letter"
+	case instrument.Name == "":
+		return "Name is required"
+	case instrument.TickSize <= 0:
+		return "TickSize must be greater than 0"
+	case instrument.LotSize < 1:
+		return "LotSize must be at least 1"
+	case instrument.MinQuantity < 0, instrument.MaxQuantity < 0:
+		return "MinQuantity and maxQuantity can't be negative"
+	case instrument.MaxQuantity > 0 && instrument.MaxQuantity < instrument.MinQuantity:
+		return "MaxQuantity must be at least minQuantity"
+	case instrument.StartingPrice <= 0:
+		return "StartingPrice must be greater than 0"
+	}
+	if _, err := h.models.WithInstruments([]storage.Instrument{*instrument}); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// GetInstruments returns the instrument catalog, delisted instruments
+// included
+func (h *Handlers) GetInstruments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.storage.GetInstruments())
+}
+
+// CreateInstrument adds an instrument to the catalog (admin). Its price
+// starts at its starting price and is simulated from the next tick.
+func (h *Handlers) CreateInstrument(w http.ResponseWriter, r *http.Request) {
+	var req InstrumentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	instrument := storage.Instrument{
+		Symbol:   strings.ToUpper(strings.TrimSpace(req.Symbol)),
+		TickSize: money.Cent,
+		LotSize:  1,
+		Tradable: req.Tradable == nil || *req.Tradable,
+	}
+	req.apply(&instrument)
+	if msg := h.validateInstrument(&instrument); msg != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+
+	if err := h.storage.CreateInstrument(&instrument); err != nil {
+		if err == storage.ErrInstrumentExists {
+			writeRejection(w, http.StatusConflict, storage.ErrInstrumentExists)
+			return
+		}
+		writeOrderError(w, err)
+		return
+	}
+	log.Printf("Instrument %s added at %s", instrument.Symbol, instrument.StartingPrice)
+
+	if price, exists := h.storage.GetPrice(instrument.Symbol); exists {
+		h.bus.PublishPrices([]storage.StockPrice{*price})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(instrument)
+}
+
+// UpdateInstrument changes an instrument's details (admin). Its price is
+// unaffected, except for its name and logo.
+func (h *Handlers) UpdateInstrument(w http.ResponseWriter, r *http.Request) {
+	instrument, exists := h.storage.GetInstrument(strings.ToUpper(mux.Vars(r)["symbol"]))
+	if !exists {
+		http.Error(w, "Stock not found", http.StatusNotFound)
+		return
+	}
+
+	var req InstrumentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if req.Symbol != "" || req.Tradable != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Symbol and tradable can't be updated, delist or relist the instrument instead"})
+		return
+	}
+	req.apply(instrument)
+	if msg := h.validateInstrument(instrument); msg != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+
+	if err := h.storage.UpdateInstrument(instrument); err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	log.Printf("Instrument %s updated", instrument.Symbol)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instrument)
+}
+
+// DelistInstrument stops trading in an instrument (admin), cancelling its
+// open orders. Positions in it are kept.
+func (h *Handlers) DelistInstrument(w http.ResponseWriter, r *http.Request) {
+	h.setTradable(w, strings.ToUpper(mux.Vars(r)["symbol"]), false)
+}
+
+// RelistInstrument resumes trading in a delisted instrument (admin)
+func (h *Handlers) RelistInstrument(w http.ResponseWriter, r *http.Request) {
+	h.setTradable(w, strings.ToUpper(mux.Vars(r)["symbol"]), true)
+}
+
+// setTradable lists or delists symbol
+func (h *Handlers) setTradable(w http.ResponseWriter, symbol string, tradable bool) {
+	if err := h.storage.SetTradable(symbol, tradable); err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	log.Printf("Instrument %s tradable=%t", symbol, tradable)
+
+	instrument, exists := h.storage.GetInstrument(symbol)
+	if !exists {
+		http.Error(w, "Stock not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instrument)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"stocks-backend/internal/money"
+	"stocks-backend/internal/storage"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// AdjustmentRequest represents the body of an admin deposit, withdrawal,
+// fee or adjustment. Deposits, withdrawals and fees take a positive
+// credits amount; adjustments take signed credits and/or shares of symbol.
+type AdjustmentRequest struct {
+	Kind    string       `json:"kind"`
+	Credits money.Amount `json:"credits"`
+	Symbol  string       `json:"symbol"`
+	Shares  int          `json:"shares"`
+	Memo    string       `json:"memo"`
+}
+
+// GetLedger returns the user's ledger entries, oldest first
+func (h *Handlers) GetLedger(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.storage.GetLedger(username))
+}
+
+// GetFullLedger returns every ledger entry, or one user's with ?username=
+// (admin)
+func (h *Handlers) GetFullLedger(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.storage.GetLedger(r.URL.Query().Get("username")))
+}
+
+// AdjustAccount posts a deposit, withdrawal, fee or adjustment to an
+// account (admin) and returns its ledger entry
+func (h *Handlers) AdjustAccount(w http.ResponseWriter, r *http.Request) {
+	var req AdjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRejection(w, http.StatusBadRequest, reject(storage.ReasonInvalidBody, "Invalid request body"))
+		return
+	}
+
+	adjustment := storage.Adjustment{
+		Username: mux.Vars(r)["username"],
+		Kind:     strings.ToLower(strings.TrimSpace(req.Kind)),
+		Credits:  req.Credits,
+		Symbol:   strings.ToUpper(strings.TrimSpace(req.Symbol)),
+		Shares:   req.Shares,
+		Memo:     strings.TrimSpace(req.Memo),
+	}
+	if adjustment.Symbol != "" {
+		if _, exists := h.storage.GetInstrument(adjustment.Symbol); !exists {
+			writeRejection(w, http.StatusBadRequest, reject(storage.ReasonUnknownSymbol, "Unknown symbol"))
+			return
+		}
+	}
+
+	entry, err := h.storage.AdjustAccount(adjustment)
+	if err != nil {
+		var orderErr *storage.OrderError
+		if errors.As(err, &orderErr) && orderErr.Code == storage.ReasonAccountNotFound {
+			writeRejection(w, http.StatusNotFound, orderErr)
+			return
+		}
+		writeOrderError(w, err)
+		return
+	}
+	log.Printf("Ledger %s %s posted for %s", entry.Kind, entry.ID, entry.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// Reconcile checks every account's balances against the ledger (admin)
+func (h *Handlers) Reconcile(w http.ResponseWriter, r *http.Request) {
+	result, err := h.storage.Reconcile()
+	if err != nil {
+		log.Printf("Error reconciling ledger: %v", err)
+		http.Error(w, "Failed to reconcile ledger", http.StatusInternalServerError)
+		return
+	}
+	LogReconciliation(result)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// LogReconciliation logs the mismatches and unbalanced entries a
+// reconciliation found
+func LogReconciliation(result *storage.Reconciliation) {
+	for _, id := range result.Unbalanced {
+		log.Printf("Ledger entry %s is unbalanced", id)
+	}
+	for _, m := range result.Mismatches {
+		if m.Symbol != "" {
+			log.Printf("Ledger mismatch for %s: %s shares %s in ledger, %s in account", m.Username, m.Symbol, m.Ledger, m.Account)
+		} else {
+			log.Printf("Ledger mismatch for %s: credits %s in ledger, %s in account", m.Username, m.Ledger, m.Account)
+		}
+	}
+	log.Printf("Reconciled %d accounts against %d ledger entries: %d mismatches, %d unbalanced entries",
+		result.Accounts, result.Entries, len(result.Mismatches), len(result.Unbalanced))
+}
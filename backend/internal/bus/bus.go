@@ -0,0 +1,92 @@
+package bus
+
+import (
+	"stocks-backend/internal/storage"
+	"sync"
+)
+
+// Handler receives the events carried by a bus: price ticks, and changes to
+// orders and account balances
+type Handler interface {
+	PricesChanged(prices []storage.StockPrice)
+	storage.Listener
+}
+
+// Bus carries events from the replica that makes them to the handlers on
+// every replica subscribed to it. A store publishes order and account
+// changes through the storage.Listener methods; the simulator publishes
+// price ticks.
+type Bus interface {
+	PublishPrices(prices []storage.StockPrice)
+	storage.Listener
+	Subscribe(handler Handler)
+	Start() error
+	Stop()
+}
+
+// Compile-time checks that both implementations satisfy Bus
+var (
+	_ Bus = (*Local)(nil)
+	_ Bus = (*Mongo)(nil)
+)
+
+// handlers is a set of subscribed handlers, safe for concurrent use
+type handlers struct {
+	list  []Handler
+	mutex sync.RWMutex
+}
+
+// add subscribes a handler
+func (h *handlers) add(handler Handler) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.list = append(h.list, handler)
+}
+
+// each calls fn with every subscribed handler
+func (h *handlers) each(fn func(Handler)) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, handler := range h.list {
+		fn(handler)
+	}
+}
+
+// Local is an in-process bus for a single replica. Events are delivered
+// synchronously to the subscribed handlers.
+type Local struct {
+	handlers handlers
+}
+
+// NewLocal creates an in-process bus
+func NewLocal() *Local {
+	return &Local{}
+}
+
+// PublishPrices delivers a price tick
+func (b *Local) PublishPrices(prices []storage.StockPrice) {
+	b.handlers.each(func(h Handler) { h.PricesChanged(prices) })
+}
+
+// OrderChanged delivers an order change
+func (b *Local) OrderChanged(order storage.Order) {
+	b.handlers.each(func(h Handler) { h.OrderChanged(order) })
+}
+
+// AccountChanged delivers an account change
+func (b *Local) AccountChanged(account storage.UserAccount) {
+	b.handlers.each(func(h Handler) { h.AccountChanged(account) })
+}
+
+// Subscribe adds a handler for every event published from now on
+func (b *Local) Subscribe(handler Handler) {
+	b.handlers.add(handler)
+}
+
+// Start does nothing; a local bus delivers as events are published
+func (b *Local) Start() error {
+	return nil
+}
+
+// Stop does nothing
+func (b *Local) Stop() {}
@@ -0,0 +1,166 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"stocks-backend/internal/storage"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// retryDelay is how long to wait before reopening a broken change stream
+const retryDelay = 5 * time.Second
+
+// Mongo is a bus for several replicas sharing one MongoDB database. The
+// database itself carries the events: every write a store makes to the
+// prices, orders and users collections is read back by each replica through
+// change streams, so publishing does nothing. Change streams need a replica
+// set (MongoDB Atlas clusters are).
+type Mongo struct {
+	prices   *mongo.Collection
+	orders   *mongo.Collection
+	users    *mongo.Collection
+	handlers handlers
+	cancel   context.CancelFunc
+	done     sync.WaitGroup
+}
+
+// NewMongo creates a bus on the collections of store
+func NewMongo(store *storage.MongoStorage) *Mongo {
+	prices, orders, users := store.Collections()
+	return &Mongo{prices: prices, orders: orders, users: users}
+}
+
+// PublishPrices does nothing; the store's price writes are the events
+func (b *Mongo) PublishPrices(prices []storage.StockPrice) {}
+
+// OrderChanged does nothing; the store's order writes are the events
+func (b *Mongo) OrderChanged(order storage.Order) {}
+
+// AccountChanged does nothing; the store's account writes are the events
+func (b *Mongo) AccountChanged(account storage.UserAccount) {}
+
+// Subscribe adds a handler for every change seen from now on
+func (b *Mongo) Subscribe(handler Handler) {
+	b.handlers.add(handler)
+}
+
+// Start opens the change streams, failing if the database doesn't support
+// them, and delivers their events until Stop is called
+func (b *Mongo) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+
+	err := b.watch(ctx, b.prices, func(doc bson.Raw) error {
+		var price storage.StockPrice
+		if err := bson.Unmarshal(doc, &price); err != nil {
+			return err
+		}
+		b.handlers.each(func(h Handler) { h.PricesChanged([]storage.StockPrice{price}) })
+		return nil
+	})
+	if err == nil {
+		err = b.watch(ctx, b.orders, func(doc bson.Raw) error {
+			var order storage.Order
+			if err := bson.Unmarshal(doc, &order); err != nil {
+				return err
+			}
+			b.handlers.each(func(h Handler) { h.OrderChanged(order) })
+			return nil
+		})
+	}
+	if err == nil {
+		err = b.watch(ctx, b.users, func(doc bson.Raw) error {
+			var account storage.UserAccount
+			if err := bson.Unmarshal(doc, &account); err != nil {
+				return err
+			}
+			b.handlers.each(func(h Handler) { h.AccountChanged(account) })
+			return nil
+		})
+	}
+	if err != nil {
+		b.Stop()
+		return err
+	}
+
+	log.Println("MongoDB change stream bus started")
+	return nil
+}
+
+// Stop closes the change streams and waits for their deliveries to finish
+func (b *Mongo) Stop() {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.done.Wait()
+}
+
+// watch opens a change stream on col, then passes the full document of
+// every insert, update and replace to deliver until ctx is cancelled. A
+// stream that breaks is reopened after the last event it delivered.
+func (b *Mongo) watch(ctx context.Context, col *mongo.Collection, deliver func(bson.Raw) error) error {
+	stream, err := openStream(ctx, col, nil)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", col.Name(), err)
+	}
+
+	b.done.Add(1)
+	go func() {
+		defer b.done.Done()
+		for {
+			for stream.Next(ctx) {
+				var event struct {
+					FullDocument bson.Raw `bson:"fullDocument"`
+				}
+				if err := stream.Decode(&event); err != nil {
+					log.Printf("Error decoding %s change: %v", col.Name(), err)
+					continue
+				}
+				if event.FullDocument == nil {
+					continue // deleted before it could be looked up
+				}
+				if err := deliver(event.FullDocument); err != nil {
+					log.Printf("Error delivering %s change: %v", col.Name(), err)
+				}
+			}
+
+			token := stream.ResumeToken()
+			streamErr := stream.Err()
+			stream.Close(context.Background())
+			for {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Change stream on %s broke, reopening: %v", col.Name(), streamErr)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retryDelay):
+				}
+				if stream, streamErr = openStream(ctx, col, token); streamErr == nil {
+					break
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// openStream opens a change stream on col that looks up the full document
+// of each change, resuming after token if it is set
+func openStream(ctx context.Context, col *mongo.Collection, token bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": bson.M{"$in": []string{"insert", "update", "replace"}},
+	}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+	return col.Watch(ctx, pipeline, opts)
+}
@@ -3,15 +3,41 @@ package config
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	MongoURI     string
-	DatabaseName string
-	JWTSecret    string
-	ServerPort   string
+	MongoURI        string
+	DatabaseName    string
+	JWTSecret       string
+	ServerPort      string
+	StorageBackend  string // "mongo" or "memory"
+	MarketTimezone  string // IANA timezone of the simulated market
+	PreMarketOpen   string // "HH:MM" in MarketTimezone, see internal/market
+	SessionOpen     string // "HH:MM" in MarketTimezone when the regular session opens
+	SessionClose    string // "HH:MM" in MarketTimezone when DAY orders expire
+	AfterHoursClose string
+	ClosedDays      string // weekdays the market is closed, "Sat,Sun" or "none"
+	Holidays        string // "YYYY-MM-DD,..." dates the market is closed
+	WSSendBuffer    int    // messages buffered per websocket client
+	BusBackend      string // "local" or "mongo", see internal/bus
+	RunSimulator    bool   // whether this replica may simulate prices
+	LeaderLease     string // "mongo", "file" or "none", see internal/leader
+	LeaderLeaseTTL  int    // seconds a leader lease lasts without renewal
+	LeaderLockFile  string // file locked by the "file" leader lease
+	AdvertiseURL    string // URL other replicas forward requests for the leader to
+	PriceModels     string // JSON file of per-symbol price models, see internal/simulation
+	SimSeed         int    // seeds the simulator's random numbers; 0 seeds from the time
+	SimClock        string // "ticker" to tick on a timer, "manual" to tick on admin request
+	AdminToken      string // Bearer token for the admin API; empty disables it
+	ReplayPath      string // CSV file or directory of bars to replay instead of simulating
+	ReplaySpeed     float64
+	ReplayLoop      bool
+	PriceBand       float64 // percent a limit price may be from the last price; 0 for any
+	CostBasis       string  // "average", "fifo" or "lifo"
 }
 
 func Load() *Config {
@@ -21,16 +47,86 @@ func Load() *Config {
 	}
 
 	return &Config{
-		MongoURI:     getEnv("MONGO_URI", "mongodb://localhost:27017"),
-		DatabaseName: getEnv("DATABASE_NAME", "stocks_trading"),
-		JWTSecret:    getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
-		ServerPort:   getEnv("PORT", "8080"),
+		MongoURI:        getEnv("MONGO_URI", "mongodb://localhost:27017"),
+		DatabaseName:    getEnv("DATABASE_NAME", "stocks_trading"),
+		JWTSecret:       getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
+		ServerPort:      getEnv("PORT", "8080"),
+		StorageBackend:  getEnv("STORAGE_BACKEND", "mongo"),
+		MarketTimezone:  getEnv("MARKET_TIMEZONE", "America/New_York"),
+		PreMarketOpen:   getEnv("PREMARKET_OPEN", "04:00"),
+		SessionOpen:     getEnv("SESSION_OPEN", "09:30"),
+		SessionClose:    getEnv("SESSION_CLOSE", "16:00"),
+		AfterHoursClose: getEnv("AFTERHOURS_CLOSE", "20:00"),
+		ClosedDays:      getEnv("MARKET_CLOSED_DAYS", "Sat,Sun"),
+		Holidays:        getEnv("MARKET_HOLIDAYS", ""),
+		WSSendBuffer:    getEnvInt("WS_SEND_BUFFER", 256),
+		BusBackend:      getEnv("BUS_BACKEND", "local"),
+		RunSimulator:    getEnv("RUN_SIMULATOR", "true") == "true",
+		LeaderLease:     getEnv("LEADER_LEASE", ""),
+		LeaderLeaseTTL:  getEnvInt("LEADER_LEASE_TTL", 15),
+		LeaderLockFile:  getEnv("LEADER_LOCK_FILE", filepath.Join(os.TempDir(), "stocks-simulator.lock")),
+		AdvertiseURL:    getAdvertiseURL(),
+		PriceModels:     getEnv("PRICE_MODELS", ""),
+		SimSeed:         getEnvInt("SIM_SEED", 0),
+		SimClock:        getEnv("SIM_CLOCK", "ticker"),
+		AdminToken:      getEnv("ADMIN_TOKEN", ""),
+		ReplayPath:      getEnv("REPLAY_PATH", ""),
+		ReplaySpeed:     getEnvFloat("REPLAY_SPEED", 1),
+		ReplayLoop:      getEnv("REPLAY_LOOP", "false") == "true",
+		PriceBand:       getPriceBand(),
+		CostBasis:       getEnv("COST_BASIS_METHOD", "average"),
 	}
 }
 
+// getAdvertiseURL reads ADVERTISE_URL, defaulting to this host on PORT
+func getAdvertiseURL() string {
+	if url := os.Getenv("ADVERTISE_URL"); url != "" {
+		return url
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return "http://" + host + ":" + getEnv("PORT", "8080")
+}
+
+// getPriceBand reads PRICE_BAND_PERCENT, where "none" turns the band off
+func getPriceBand() float64 {
+	if os.Getenv("PRICE_BAND_PERCENT") == "none" {
+		return 0
+	}
+	return getEnvFloat("PRICE_BAND_PERCENT", 20)
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		log.Printf("Invalid %s %q, using %g", key, value, defaultValue)
+		return defaultValue
+	}
+	return f
+}
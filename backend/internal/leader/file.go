@@ -0,0 +1,102 @@
+//go:build unix
+
+package leader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// FileLease is a lease for replicas on one host: an exclusive lock on a
+// file, which holds the address of the replica that locked it. The kernel
+// releases the lock when its holder exits, so a follower takes over as soon
+// as it next tries to acquire the lease.
+type FileLease struct {
+	path    string
+	address string
+	mutex   sync.Mutex
+	file    *os.File // open while the lock is held
+}
+
+// NewFileLease creates a lease that locks the file at path, creating it if
+// needed, for a replica reachable at address
+func NewFileLease(path, address string) *FileLease {
+	return &FileLease{path: path, address: address}
+}
+
+// Acquire takes the lock if no other process holds it
+func (l *FileLease) Acquire(ctx context.Context) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(l.address), 0)
+	}
+	if err != nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+		return false, err
+	}
+	l.file = file
+	return true, nil
+}
+
+// Holder returns the address written to the file if another process holds
+// the lock, or this process's if it does
+func (l *FileLease) Holder(ctx context.Context) (string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		return l.address, nil
+	}
+
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	// A shared lock is only refused while another process holds the lease
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return "", nil
+	} else if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return "", err
+	}
+	address, err := io.ReadAll(file)
+	return string(address), err
+}
+
+// Release unlocks the file if this process holds the lock
+func (l *FileLease) Release(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+	l.file = nil
+	return err
+}
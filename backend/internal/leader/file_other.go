@@ -0,0 +1,31 @@
+//go:build !unix
+
+package leader
+
+import (
+	"context"
+	"errors"
+)
+
+// FileLease is unavailable on this platform: Acquire always fails
+type FileLease struct{}
+
+// NewFileLease creates a lease that can't be acquired on this platform
+func NewFileLease(path, address string) *FileLease {
+	return &FileLease{}
+}
+
+// Acquire fails; file locks need a Unix platform
+func (l *FileLease) Acquire(ctx context.Context) (bool, error) {
+	return false, errors.New("file leases are only supported on Unix platforms")
+}
+
+// Release does nothing
+func (l *FileLease) Release(ctx context.Context) error {
+	return nil
+}
+
+// Holder returns no address; nobody can hold the lease
+func (l *FileLease) Holder(ctx context.Context) (string, error) {
+	return "", nil
+}
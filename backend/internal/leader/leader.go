@@ -0,0 +1,171 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lease is a lock at most one replica holds at a time. A replica keeps it by
+// acquiring it again before it expires; if it stops, another replica can
+// acquire it once it has.
+type Lease interface {
+	// Acquire takes the lease, or extends it if this replica already holds
+	// it, and reports whether this replica holds it
+	Acquire(ctx context.Context) (bool, error)
+
+	// Release gives the lease up if this replica holds it
+	Release(ctx context.Context) error
+
+	// Holder returns the address the replica holding the lease advertised,
+	// or "" if no replica holds it
+	Holder(ctx context.Context) (string, error)
+}
+
+// Elector keeps trying to acquire a lease, renewing it every third of its
+// ttl while held. A replica is the leader while its last renewal is less
+// than ttl old, counted from when the renewal was sent, so it stops leading
+// before any other replica can acquire the lease. A follower takes over at
+// most ttl plus a third of it after the leader last renewed.
+type Elector struct {
+	lease     Lease
+	ttl       time.Duration
+	onElected func() error // run before this replica starts leading
+	mutex     sync.Mutex
+	until     time.Time // end of this replica's leadership, zero if a follower
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewElector creates an elector for a lease that lasts ttl
+func NewElector(lease Lease, ttl time.Duration) *Elector {
+	return &Elector{
+		lease: lease,
+		ttl:   ttl,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// OnElected sets a function run each time this replica acquires the lease,
+// before it starts leading. If it fails the replica stays a follower and
+// runs it again at its next renewal. Call it before Start.
+func (e *Elector) OnElected(fn func() error) {
+	e.onElected = fn
+}
+
+// Start campaigns for the lease until Stop is called
+func (e *Elector) Start() {
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			e.campaign()
+			select {
+			case <-ticker.C:
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops campaigning and releases the lease if held, so a follower can
+// take over at once
+func (e *Elector) Stop() {
+	close(e.stop)
+	<-e.done
+
+	wasLeader := e.IsLeader()
+	e.mutex.Lock()
+	e.until = time.Time{}
+	e.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+	defer cancel()
+	if err := e.lease.Release(ctx); err != nil {
+		log.Printf("Error releasing leader lease: %v", err)
+	} else if wasLeader {
+		log.Println("Released leader lease")
+	}
+}
+
+// IsLeader reports whether this replica holds the lease. A nil elector, on
+// a replica that doesn't campaign, never does.
+func (e *Elector) IsLeader() bool {
+	if e == nil {
+		return false
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return time.Now().Before(e.until)
+}
+
+// campaign acquires or renews the lease once
+func (e *Elector) campaign() {
+	wasLeader := e.IsLeader()
+	sent := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+	defer cancel()
+
+	held, err := e.lease.Acquire(ctx)
+	if err != nil {
+		log.Printf("Error acquiring leader lease: %v", err)
+	}
+	if held && !wasLeader && e.onElected != nil {
+		if electedErr := e.onElected(); electedErr != nil {
+			log.Printf("Error taking over as leader, staying a follower: %v", electedErr)
+			return
+		}
+	}
+
+	e.mutex.Lock()
+	if held {
+		e.until = sent.Add(e.ttl)
+	} else if err == nil {
+		e.until = time.Time{}
+	}
+	// On an error the lease may still be held, so leadership lasts until
+	// the last renewal runs out
+	e.mutex.Unlock()
+
+	isLeader := e.IsLeader()
+	switch {
+	case isLeader && !wasLeader:
+		log.Println("Acquired leader lease, this replica is the leader")
+	case !isLeader && wasLeader:
+		log.Println("Lost leader lease, this replica is a follower")
+	}
+}
+
+// Standalone is a lease for a replica that runs alone: it always holds it
+type Standalone struct{}
+
+// Acquire always succeeds
+func (Standalone) Acquire(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+// Release does nothing
+func (Standalone) Release(ctx context.Context) error {
+	return nil
+}
+
+// Holder returns no address: a standalone replica never forwards to another
+func (Standalone) Holder(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+// ReplicaID names this process in the leases it holds
+func ReplicaID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}
@@ -0,0 +1,83 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoLease is a lease kept in a MongoDB document:
+//
+//	{"_id": <name>, "holder": <replica id>, "address": <url>, "expiresAt": <date>}
+//
+// Expiry is computed and checked on the database server's clock, so the
+// replicas' clocks don't have to agree. Needs MongoDB 4.2 or later.
+type MongoLease struct {
+	collection *mongo.Collection
+	name       string
+	holder     string
+	address    string
+	ttl        time.Duration
+}
+
+// NewMongoLease creates the lease called name in collection, held as holder
+// reachable at address for ttl at a time
+func NewMongoLease(collection *mongo.Collection, name, holder, address string, ttl time.Duration) *MongoLease {
+	return &MongoLease{collection: collection, name: name, holder: holder, address: address, ttl: ttl}
+}
+
+// Acquire takes the lease if it is free or expired, or extends it if this
+// replica holds it. If another replica holds it, the upsert collides with
+// the existing document and the lease isn't acquired.
+func (l *MongoLease) Acquire(ctx context.Context) (bool, error) {
+	filter := bson.M{
+		"_id": l.name,
+		"$expr": bson.M{"$or": bson.A{
+			bson.M{"$eq": bson.A{"$holder", l.holder}},
+			bson.M{"$lt": bson.A{"$expiresAt", "$$NOW"}},
+		}},
+	}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"holder":    l.holder,
+			"address":   l.address,
+			"expiresAt": bson.M{"$add": bson.A{"$$NOW", l.ttl.Milliseconds()}},
+		}}},
+	}
+
+	_, err := l.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Holder returns the address of the replica holding the lease, if it hasn't
+// expired
+func (l *MongoLease) Holder(ctx context.Context) (string, error) {
+	filter := bson.M{
+		"_id":   l.name,
+		"$expr": bson.M{"$gte": bson.A{"$expiresAt", "$$NOW"}},
+	}
+	var lease struct {
+		Address string `bson:"address"`
+	}
+	err := l.collection.FindOne(ctx, filter).Decode(&lease)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", nil
+	}
+	return lease.Address, err
+}
+
+// Release deletes the lease if this replica holds it
+func (l *MongoLease) Release(ctx context.Context) error {
+	_, err := l.collection.DeleteOne(ctx, bson.M{"_id": l.name, "holder": l.holder})
+	return err
+}
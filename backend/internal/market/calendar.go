@@ -0,0 +1,198 @@
+package market
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // so MARKET_TIMEZONE works on hosts without a zoneinfo database
+)
+
+// Session is a part of the trading day
+type Session string
+
+// Sessions of a trading day, in order. The market is closed outside them
+// and all day on closed days.
+const (
+	Closed     Session = "closed"
+	PreMarket  Session = "pre_market"
+	Regular    Session = "regular"
+	AfterHours Session = "after_hours"
+)
+
+// Hours are the clock times, "HH:MM" in the market timezone, at which a
+// trading day's sessions start and end. "24:00" is the end of the day.
+type Hours struct {
+	PreMarketOpen   string
+	Open            string // regular session
+	Close           string // regular session
+	AfterHoursClose string
+}
+
+// clock is a time of day
+type clock struct {
+	hour, minute int
+}
+
+// parseClock parses "HH:MM", allowing "24:00"
+func parseClock(value string) (clock, error) {
+	hour, minute, found := strings.Cut(value, ":")
+	h, hourErr := strconv.Atoi(hour)
+	m, minuteErr := strconv.Atoi(minute)
+	if !found || hourErr != nil || minuteErr != nil || h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && m != 0 {
+		return clock{}, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return clock{h, m}, nil
+}
+
+// before reports whether c is earlier in the day than other
+func (c clock) before(other clock) bool {
+	return c.hour < other.hour || c.hour == other.hour && c.minute < other.minute
+}
+
+// Calendar knows the market's trading days and the sessions in each
+type Calendar struct {
+	location   *time.Location
+	preOpen    clock
+	open       clock
+	close      clock
+	afterClose clock
+	closedDays map[time.Weekday]bool
+	holidays   map[string]bool // "YYYY-MM-DD"
+}
+
+// NewCalendar creates a calendar for the IANA timezone with the given
+// session hours on every day except the closedDays of the week
+// ("Sat,Sun", or "none") and the holidays ("YYYY-MM-DD,...")
+func NewCalendar(timezone string, hours Hours, closedDays, holidays string) (*Calendar, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid market timezone %q: %w", timezone, err)
+	}
+	c := &Calendar{
+		location:   location,
+		closedDays: make(map[time.Weekday]bool),
+		holidays:   make(map[string]bool),
+	}
+
+	clocks := []struct {
+		name  string
+		value string
+		clock *clock
+	}{
+		{"pre-market open", hours.PreMarketOpen, &c.preOpen},
+		{"session open", hours.Open, &c.open},
+		{"session close", hours.Close, &c.close},
+		{"after-hours close", hours.AfterHoursClose, &c.afterClose},
+	}
+	for _, clk := range clocks {
+		if *clk.clock, err = parseClock(clk.value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", clk.name, err)
+		}
+	}
+	if c.open.before(c.preOpen) || !c.open.before(c.close) || c.afterClose.before(c.close) {
+		return nil, fmt.Errorf("sessions must be in order: pre-market open <= open < close <= after-hours close")
+	}
+
+	if closedDays != "none" {
+		for _, name := range strings.Split(closedDays, ",") {
+			weekday, err := parseWeekday(strings.TrimSpace(name))
+			if err != nil {
+				return nil, err
+			}
+			c.closedDays[weekday] = true
+		}
+		if len(c.closedDays) == 7 {
+			return nil, fmt.Errorf("the market must open on some day of the week")
+		}
+	}
+	for _, date := range strings.Split(holidays, ",") {
+		date = strings.TrimSpace(date)
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("invalid holiday %q, expected YYYY-MM-DD", date)
+		}
+		c.holidays[date] = true
+	}
+	return c, nil
+}
+
+// parseWeekday parses a weekday's name or its first three letters
+func parseWeekday(name string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(name, day.String()) || strings.EqualFold(name, day.String()[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid closed day %q", name)
+}
+
+// at returns the clock time on the given day in the market timezone
+func (c *Calendar) at(year int, month time.Month, day int, clk clock) time.Time {
+	return time.Date(year, month, day, clk.hour, clk.minute, 0, 0, c.location)
+}
+
+// Location returns the market timezone
+func (c *Calendar) Location() *time.Location {
+	return c.location
+}
+
+// Day returns the market's date at t, "YYYY-MM-DD"
+func (c *Calendar) Day(t time.Time) string {
+	return t.In(c.location).Format("2006-01-02")
+}
+
+// IsTradingDay reports whether the market opens on the day of t
+func (c *Calendar) IsTradingDay(t time.Time) bool {
+	local := t.In(c.location)
+	return !c.closedDays[local.Weekday()] && !c.holidays[local.Format("2006-01-02")]
+}
+
+// SessionAt returns the session the market is in at t
+func (c *Calendar) SessionAt(t time.Time) Session {
+	if !c.IsTradingDay(t) {
+		return Closed
+	}
+	local := t.In(c.location)
+	year, month, day := local.Date()
+	switch {
+	case local.Before(c.at(year, month, day, c.preOpen)):
+		return Closed
+	case local.Before(c.at(year, month, day, c.open)):
+		return PreMarket
+	case local.Before(c.at(year, month, day, c.close)):
+		return Regular
+	case local.Before(c.at(year, month, day, c.afterClose)):
+		return AfterHours
+	default:
+		return Closed
+	}
+}
+
+// NextOpen returns the first regular session open after t, or the zero
+// time if the market never opens
+func (c *Calendar) NextOpen(t time.Time) time.Time {
+	return c.next(t, c.open)
+}
+
+// NextClose returns the first regular session close after t, or the zero
+// time if the market never opens
+func (c *Calendar) NextClose(t time.Time) time.Time {
+	return c.next(t, c.close)
+}
+
+// next returns the first time after t that the clock reads clk on a
+// trading day
+func (c *Calendar) next(t time.Time, clk clock) time.Time {
+	local := t.In(c.location)
+	year, month, day := local.Date()
+	for i := 0; i <= 366; i++ {
+		next := c.at(year, month, day+i, clk)
+		if next.After(local) && c.IsTradingDay(c.at(year, month, day+i, clock{})) {
+			return next
+		}
+	}
+	return time.Time{}
+}
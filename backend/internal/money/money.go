@@ -0,0 +1,215 @@
+// Package money holds monetary amounts, prices and cash balances, as fixed
+// point decimals so they add up exactly.
+//
+// Rounding rules:
+//   - Amounts have 4 decimal places. Sums, differences and an amount times a
+//     quantity are exact, except that products beyond Max saturate at Max
+//     (or -Max) rather than wrap around.
+//   - Everything else rounds half away from zero to the nearest 0.0001:
+//     parsing a more precise decimal, dividing (average prices), and
+//     converting from float64 (percentages of a price, model outputs).
+//   - Simulated prices, and the prices market orders execute at, are then
+//     rounded to the cent with Round(Cent).
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Amount is a decimal with Places decimal places, counted in units of
+// 10^-Places. The zero value is 0.
+type Amount int64
+
+// Places is the number of decimal places of an Amount
+const Places = 4
+
+// Common amounts
+const (
+	Unit Amount = 1                  // the smallest amount, 0.0001
+	Cent Amount = 100                // 0.01
+	One  Amount = 10000              // 1
+	Max  Amount = math.MaxInt64 / 10 // bound on parsed amounts and products, so sums stay in range
+)
+
+// ErrRange is returned when parsing an amount too large to represent
+var ErrRange = errors.New("money: amount out of range")
+
+// FromInt returns n whole units
+func FromInt(n int64) Amount {
+	return Amount(n) * One
+}
+
+// FromFloat converts f, rounding half away from zero. It is meant for
+// values computed in float64, not for parsing input; use Parse for that.
+func FromFloat(f float64) Amount {
+	return Amount(math.Round(f * float64(One)))
+}
+
+// Parse reads a decimal number such as "150", "-0.25" or "1e2", rounding
+// it half away from zero to Places decimal places
+func Parse(s string) (Amount, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return 0, fmt.Errorf("money: invalid amount %q", s)
+	}
+	r.Mul(r, new(big.Rat).SetInt64(int64(One)))
+	units := roundDiv(r.Num(), r.Denom())
+	if units > int64(Max) || units < -int64(Max) {
+		return 0, ErrRange
+	}
+	return Amount(units), nil
+}
+
+// roundDiv returns num / denom rounded half away from zero
+func roundDiv(num, denom *big.Int) int64 {
+	q, m := new(big.Int).QuoRem(num, denom, new(big.Int))
+	if m.Sign() != 0 && new(big.Int).Mul(new(big.Int).Abs(m), big.NewInt(2)).CmpAbs(denom) >= 0 {
+		q.Add(q, big.NewInt(int64(num.Sign()*denom.Sign())))
+	}
+	if !q.IsInt64() {
+		if q.Sign() < 0 {
+			return math.MinInt64
+		}
+		return math.MaxInt64
+	}
+	return q.Int64()
+}
+
+// Float64 returns the amount as a float64, for statistics and price models
+func (a Amount) Float64() float64 {
+	return float64(a) / float64(One)
+}
+
+// Mul returns the amount times quantity, exactly, or Max (or -Max) if that
+// is out of range
+func (a Amount) Mul(quantity int) Amount {
+	product := a * Amount(quantity)
+	if a != 0 && (product/a != Amount(quantity) || product > Max || product < -Max) {
+		if (a < 0) != (quantity < 0) {
+			return -Max
+		}
+		return Max
+	}
+	return product
+}
+
+// Div returns the amount divided by n, rounded half away from zero
+func (a Amount) Div(n int) Amount {
+	return Amount(roundDiv(big.NewInt(int64(a)), big.NewInt(int64(n))))
+}
+
+// MulDiv returns the amount times n divided by d, rounded half away from
+// zero, or Max (or -Max) if that is out of range. The product is computed
+// exactly, so it can't overflow, which makes it the way to take a share of
+// an amount.
+func (a Amount) MulDiv(n, d int) Amount {
+	product := new(big.Int).Mul(big.NewInt(int64(a)), big.NewInt(int64(n)))
+	return clamp(roundDiv(product, big.NewInt(int64(d))))
+}
+
+// clamp returns units as an amount within -Max to Max
+func clamp(units int64) Amount {
+	return Amount(max(min(units, int64(Max)), -int64(Max)))
+}
+
+// Percent returns pct percent of the amount, rounded half away from zero
+func (a Amount) Percent(pct float64) Amount {
+	return FromFloat(a.Float64() * pct / 100)
+}
+
+// Round rounds the amount half away from zero to a multiple of step
+func (a Amount) Round(step Amount) Amount {
+	if step <= Unit {
+		return a
+	}
+	return Amount(roundDiv(big.NewInt(int64(a)), big.NewInt(int64(step)))) * step
+}
+
+// IsMultipleOf reports whether the amount is a whole number of steps
+func (a Amount) IsMultipleOf(step Amount) bool {
+	return step > 0 && a%step == 0
+}
+
+// String formats the amount with as few decimal places as it needs, for
+// example "150", "150.5" or "-0.0001"
+func (a Amount) String() string {
+	sign := ""
+	units := uint64(a)
+	if a < 0 {
+		sign, units = "-", uint64(-a)
+	}
+	whole, frac := units/uint64(One), units%uint64(One)
+	if frac == 0 {
+		return sign + strconv.FormatUint(whole, 10)
+	}
+	digits := fmt.Sprintf("%0*d", Places, frac)
+	return sign + strconv.FormatUint(whole, 10) + "." + strings.TrimRight(digits, "0")
+}
+
+// MarshalJSON writes the amount as a JSON number, the way a float64 with
+// the same value would be written
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON reads a JSON number, or a string holding one
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("money: invalid amount %s", data)
+	}
+	parsed, err := Parse(number.String())
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// MarshalBSONValue stores the amount as a Decimal128
+func (a Amount) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	d, err := primitive.ParseDecimal128(a.String())
+	if err != nil {
+		return 0, nil, err
+	}
+	return bson.MarshalValue(d)
+}
+
+// UnmarshalBSONValue reads a Decimal128, or a double or integer stored
+// before amounts were decimals
+func (a *Amount) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bsoncore.Value{Type: t, Data: data}
+	switch t {
+	case bsontype.Decimal128:
+		parsed, err := Parse(value.Decimal128().String())
+		if err != nil {
+			return err
+		}
+		*a = parsed
+	case bsontype.Double:
+		*a = FromFloat(value.Double())
+	case bsontype.Int32:
+		*a = FromInt(int64(value.Int32()))
+	case bsontype.Int64:
+		*a = FromInt(value.Int64())
+	case bsontype.Null, bsontype.Undefined:
+		*a = 0
+	default:
+		return fmt.Errorf("money: can't decode BSON %s as an amount", t)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+		out  string
+	}{
+		{"150", FromInt(150), "150"},
+		{"150.50", 1505000, "150.5"},
+		{"-0.25", -2500, "-0.25"},
+		{"0.0001", Unit, "0.0001"},
+		{"-0.0001", -Unit, "-0.0001"},
+		{"1e2", FromInt(100), "100"},
+		{" 42 ", FromInt(42), "42"},
+		{"0", 0, "0"},
+		// more than 4 decimal places round half away from zero
+		{"0.00005", Unit, "0.0001"},
+		{"0.00004999", 0, "0"},
+		{"-0.00005", -Unit, "-0.0001"},
+		{"1.23456", 12346, "1.2346"},
+		{"-1.23455", -12346, "-1.2346"},
+		{"1.23454", 12345, "1.2345"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+			if s := got.String(); s != tt.out {
+				t.Errorf("String() = %q, want %q", s, tt.out)
+			}
+			if again, err := Parse(got.String()); err != nil || again != got {
+				t.Errorf("Parse(%q) = %d, %v, want %d back", got.String(), again, err, got)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{"", "abc", "1.2.3", "$5"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) succeeded", in)
+		}
+	}
+	for _, in := range []string{"1e30", "-1e30", "922337203685477.5808"} {
+		if _, err := Parse(in); err != ErrRange {
+			t.Errorf("Parse(%q) = %v, want ErrRange", in, err)
+		}
+	}
+}
+
+func TestRounding(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Amount
+		want Amount
+	}{
+		{"Div rounds half up", Amount(5).Div(2), 3},
+		{"Div rounds half away from zero", Amount(-5).Div(2), -3},
+		{"Div rounds down below half", Amount(10).Div(3), 3},
+		{"MulDiv takes an exact share", FromInt(100).MulDiv(1, 4), FromInt(25)},
+		{"MulDiv rounds half away from zero", Amount(1).MulDiv(1, 2), 1},
+		{"MulDiv rounds negative shares", Amount(-1).MulDiv(1, 2), -1},
+		{"Percent", FromInt(150).Percent(20), FromInt(30)},
+		{"Percent rounds", Amount(1).Percent(50), 1},
+		{"FromFloat rounds half away from zero", FromFloat(-0.00005), -Unit},
+		{"Round to the cent", Amount(1234550).Round(Cent), 1234600},
+		{"Round to the cent, negative", Amount(-1234550).Round(Cent), -1234600},
+		{"Round below a unit is a no-op", Amount(1234567).Round(0), 1234567},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Amount
+		want Amount
+	}{
+		{"Mul in range is exact", FromInt(150).Mul(1000), FromInt(150000)},
+		{"Mul of a negative in range", FromInt(-150).Mul(3), FromInt(-450)},
+		{"Mul past Max", FromInt(1_000_000).Mul(1_000_000_000), Max},
+		{"Mul past -Max", FromInt(-1_000_000).Mul(1_000_000_000), -Max},
+		{"Mul by a negative quantity past -Max", FromInt(1_000_000).Mul(-1_000_000_000), -Max},
+		{"Mul that wraps int64", Max.Mul(math.MaxInt64), Max},
+		{"Mul that wraps to the same sign", Amount(-1).Mul(math.MinInt64), Max},
+		{"Mul just past Max", Max.Mul(2), Max},
+		{"Mul of Max by one", Max.Mul(1), Max},
+		{"MulDiv past Max", Max.MulDiv(3, 2), Max},
+		{"MulDiv past -Max", Max.MulDiv(-3, 2), -Max},
+		{"MulDiv past int64", Max.MulDiv(math.MaxInt64, 1), Max},
+		{"MulDiv through an overflowing product", Max.MulDiv(1000, 1000), Max},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	type doc struct {
+		Price Amount `json:"price"`
+	}
+
+	data, err := json.Marshal(doc{Price: 1505000})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if string(data) != `{"price":150.5}` {
+		t.Errorf("Marshal = %s, want a JSON number", data)
+	}
+
+	tests := []struct {
+		in   string
+		want Amount
+	}{
+		{`{"price":150.5}`, 1505000},
+		{`{"price":"150.5"}`, 1505000},
+		{`{"price":1e2}`, FromInt(100)},
+		{`{"price":0.00005}`, Unit},
+		{`{"price":null}`, 0},
+		{`{}`, 0},
+	}
+	for _, tt := range tests {
+		var got doc
+		if err := json.Unmarshal([]byte(tt.in), &got); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tt.in, err)
+			continue
+		}
+		if got.Price != tt.want {
+			t.Errorf("Unmarshal(%s) = %s, want %s", tt.in, got.Price, tt.want)
+		}
+	}
+
+	for _, in := range []string{`{"price":"abc"}`, `{"price":true}`, `{"price":1e30}`} {
+		var got doc
+		if err := json.Unmarshal([]byte(in), &got); err == nil {
+			t.Errorf("Unmarshal(%s) = %s, want an error", in, got.Price)
+		}
+	}
+}
+
+func TestBSON(t *testing.T) {
+	type doc struct {
+		Price Amount `bson:"price"`
+	}
+
+	for _, price := range []Amount{0, Unit, -2500, 1505000, Max, -Max} {
+		data, err := bson.Marshal(doc{Price: price})
+		if err != nil {
+			t.Fatalf("Marshal(%s): %v", price, err)
+		}
+		if kind := bson.Raw(data).Lookup("price").Type; kind != bsontype.Decimal128 {
+			t.Errorf("Marshal(%s) stored a %s, want a Decimal128", price, kind)
+		}
+		var got doc
+		if err := bson.Unmarshal(data, &got); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", price, err)
+		}
+		if got.Price != price {
+			t.Errorf("round trip of %s = %s", price, got.Price)
+		}
+	}
+
+	// Amounts stored before they were decimals
+	tests := []struct {
+		name  string
+		value interface{}
+		want  Amount
+	}{
+		{"double", 150.5, 1505000},
+		{"int32", int32(150), FromInt(150)},
+		{"int64", int64(150), FromInt(150)},
+		{"null", nil, 0},
+		{"precise decimal", mustDecimal(t, "12.34555"), 123456},
+	}
+	for _, tt := range tests {
+		data, err := bson.Marshal(bson.M{"price": tt.value})
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", tt.name, err)
+		}
+		got := doc{Price: One}
+		if err := bson.Unmarshal(data, &got); err != nil {
+			t.Errorf("%s: Unmarshal: %v", tt.name, err)
+			continue
+		}
+		if got.Price != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got.Price, tt.want)
+		}
+	}
+
+	data, _ := bson.Marshal(bson.M{"price": "150"})
+	var got doc
+	if err := bson.Unmarshal(data, &got); err == nil {
+		t.Errorf("Unmarshal of a string = %s, want an error", got.Price)
+	}
+}
+
+func mustDecimal(t *testing.T, s string) primitive.Decimal128 {
+	d, err := primitive.ParseDecimal128(s)
+	if err != nil {
+		t.Fatalf("ParseDecimal128(%q): %v", s, err)
+	}
+	return d
+}
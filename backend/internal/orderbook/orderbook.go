@@ -0,0 +1,357 @@
+package orderbook
+
+import (
+	"sort"
+	"stocks-backend/internal/money"
+	"sync"
+)
+
+// Order is an order resting in, or being matched against, a book
+type Order struct {
+	ID       string
+	Username string
+	Side     string       // "buy" or "sell"
+	Price    money.Amount // limit price; for market orders the worst price to take from the book
+	Quantity int          // remaining quantity
+	Market   bool         // fill any remainder against the market instead of resting
+
+	// ImmediateOnly orders never rest: a remainder the book can't fill fills
+	// against the market if the limit crosses the market price, and is
+	// otherwise dropped. AllOrNone orders also only trade if they can fill
+	// in full.
+	ImmediateOnly bool
+	AllOrNone     bool
+}
+
+// MarketOrderID identifies the simulated market on one side of a fill
+const MarketOrderID = ""
+
+// Fill is a single execution between a buyer and a seller. Either order ID
+// may be MarketOrderID when the simulated market took the other side.
+type Fill struct {
+	Symbol      string
+	BuyOrderID  string
+	SellOrderID string
+	Quantity    int
+	Price       money.Amount
+}
+
+// Level is the aggregated quantity at one price
+type Level struct {
+	Price    money.Amount `json:"price"`
+	Quantity int          `json:"quantity"`
+	Orders   int          `json:"orders"`
+}
+
+// Depth is a snapshot of the best levels on each side of a book
+type Depth struct {
+	Symbol string  `json:"symbol"`
+	Bids   []Level `json:"bids"`
+	Asks   []Level `json:"asks"`
+}
+
+// level is a FIFO queue of orders at one price
+type level struct {
+	price  money.Amount
+	orders []*Order
+}
+
+// Book is a price-time priority order book for one symbol. Bids are kept
+// best (highest) first, asks best (lowest) first, and orders within a level
+// fill in arrival order. Book is not safe for concurrent use; Engine
+// serializes access.
+type Book struct {
+	symbol string
+	bids   []*level
+	asks   []*level
+	index  map[string]*Order
+}
+
+// NewBook creates an empty book
+func NewBook(symbol string) *Book {
+	return &Book{
+		symbol: symbol,
+		index:  make(map[string]*Order),
+	}
+}
+
+// crosses reports whether an incoming order at price can trade against a
+// resting level at levelPrice
+func crosses(side string, price, levelPrice money.Amount) bool {
+	if side == "buy" {
+		return price >= levelPrice
+	}
+	return price <= levelPrice
+}
+
+// opposite returns the levels an order on side matches against
+func (b *Book) opposite(side string) *[]*level {
+	if side == "buy" {
+		return &b.asks
+	}
+	return &b.bids
+}
+
+// Submit matches an incoming order against the book at the resting orders'
+// prices. Whatever is left of a market order is filled against the market
+// at marketPrice; whatever is left of a limit order rests in the book unless
+// the order is ImmediateOnly.
+func (b *Book) Submit(order Order, marketPrice money.Amount) []Fill {
+	if order.AllOrNone && b.fillable(order, marketPrice) < order.Quantity {
+		return nil
+	}
+
+	var fills []Fill
+	levels := b.opposite(order.Side)
+
+	for order.Quantity > 0 && len(*levels) > 0 {
+		best := (*levels)[0]
+		if !crosses(order.Side, order.Price, best.price) {
+			break
+		}
+
+		for order.Quantity > 0 && len(best.orders) > 0 {
+			resting := best.orders[0]
+			qty := min(order.Quantity, resting.Quantity)
+			fills = append(fills, b.newFill(&order, resting.ID, qty, best.price))
+
+			order.Quantity -= qty
+			resting.Quantity -= qty
+			if resting.Quantity == 0 {
+				best.orders = best.orders[1:]
+				delete(b.index, resting.ID)
+			}
+		}
+
+		if len(best.orders) == 0 {
+			*levels = (*levels)[1:]
+		}
+	}
+
+	if order.Quantity == 0 {
+		return fills
+	}
+
+	if order.Market || (order.ImmediateOnly && crosses(order.Side, order.Price, marketPrice)) {
+		return append(fills, b.newFill(&order, MarketOrderID, order.Quantity, marketPrice))
+	}
+	if order.ImmediateOnly {
+		return fills
+	}
+
+	b.Add(order)
+	return fills
+}
+
+// fillable returns how much of an incoming order could fill right now, up to
+// its quantity. The market takes any quantity the order's limit allows.
+func (b *Book) fillable(order Order, marketPrice money.Amount) int {
+	if order.Market || crosses(order.Side, order.Price, marketPrice) {
+		return order.Quantity
+	}
+	available := 0
+	for _, lvl := range *b.opposite(order.Side) {
+		if available >= order.Quantity || !crosses(order.Side, order.Price, lvl.price) {
+			break
+		}
+		for _, o := range lvl.orders {
+			available += o.Quantity
+		}
+	}
+	return min(available, order.Quantity)
+}
+
+// newFill builds a fill between an incoming order and a counterparty
+func (b *Book) newFill(incoming *Order, counterpartyID string, qty int, price money.Amount) Fill {
+	fill := Fill{Symbol: b.symbol, Quantity: qty, Price: price}
+	if incoming.Side == "buy" {
+		fill.BuyOrderID, fill.SellOrderID = incoming.ID, counterpartyID
+	} else {
+		fill.BuyOrderID, fill.SellOrderID = counterpartyID, incoming.ID
+	}
+	return fill
+}
+
+// Add rests an order in the book without matching it, at the back of its
+// price level
+func (b *Book) Add(order Order) {
+	resting := order
+	b.index[order.ID] = &resting
+
+	levels := &b.bids
+	better := func(a, c money.Amount) bool { return a > c }
+	if order.Side == "sell" {
+		levels = &b.asks
+		better = func(a, c money.Amount) bool { return a < c }
+	}
+
+	i := sort.Search(len(*levels), func(i int) bool {
+		return !better((*levels)[i].price, order.Price)
+	})
+	if i < len(*levels) && (*levels)[i].price == order.Price {
+		(*levels)[i].orders = append((*levels)[i].orders, &resting)
+		return
+	}
+
+	*levels = append(*levels, nil)
+	copy((*levels)[i+1:], (*levels)[i:])
+	(*levels)[i] = &level{price: order.Price, orders: []*Order{&resting}}
+}
+
+// Cancel removes a resting order, returning it and whether it was found
+func (b *Book) Cancel(orderID string) (Order, bool) {
+	resting, exists := b.index[orderID]
+	if !exists {
+		return Order{}, false
+	}
+	delete(b.index, orderID)
+
+	levels := &b.bids
+	if resting.Side == "sell" {
+		levels = &b.asks
+	}
+	for i, lvl := range *levels {
+		if lvl.price != resting.Price {
+			continue
+		}
+		for j, o := range lvl.orders {
+			if o == resting {
+				lvl.orders = append(lvl.orders[:j], lvl.orders[j+1:]...)
+				break
+			}
+		}
+		if len(lvl.orders) == 0 {
+			*levels = append((*levels)[:i], (*levels)[i+1:]...)
+		}
+		break
+	}
+
+	return *resting, true
+}
+
+// Restore sets a resting order's quantity back to order.Quantity, undoing
+// fills that could not be settled. An order still in the book keeps its
+// place; one the fills took out rests again at the back of its level. A
+// zero quantity takes the order out of the book.
+func (b *Book) Restore(order Order) {
+	if resting, exists := b.index[order.ID]; exists && resting.Price == order.Price && order.Quantity > 0 {
+		resting.Quantity = order.Quantity
+		return
+	}
+	b.Cancel(order.ID)
+	if order.Quantity > 0 {
+		b.Add(order)
+	}
+}
+
+// MarketTick lets the simulated market take the other side of every resting
+// order its new price crosses: bids at or above the price and asks at or
+// below it fill in full at the market price, in priority order.
+func (b *Book) MarketTick(marketPrice money.Amount) []Fill {
+	var fills []Fill
+	for _, side := range []string{"buy", "sell"} {
+		levels := &b.bids
+		if side == "sell" {
+			levels = &b.asks
+		}
+		for len(*levels) > 0 && crosses(side, (*levels)[0].price, marketPrice) {
+			for _, resting := range (*levels)[0].orders {
+				incoming := Order{ID: resting.ID, Side: side}
+				fills = append(fills, b.newFill(&incoming, MarketOrderID, resting.Quantity, marketPrice))
+				delete(b.index, resting.ID)
+			}
+			*levels = (*levels)[1:]
+		}
+	}
+	return fills
+}
+
+// Depth returns up to n aggregated levels per side
+func (b *Book) Depth(n int) Depth {
+	aggregate := func(levels []*level) []Level {
+		out := []Level{}
+		for _, lvl := range levels {
+			if len(out) == n {
+				break
+			}
+			agg := Level{Price: lvl.price, Orders: len(lvl.orders)}
+			for _, o := range lvl.orders {
+				agg.Quantity += o.Quantity
+			}
+			out = append(out, agg)
+		}
+		return out
+	}
+	return Depth{Symbol: b.symbol, Bids: aggregate(b.bids), Asks: aggregate(b.asks)}
+}
+
+// Engine holds one Book per symbol and serializes access to them
+type Engine struct {
+	books map[string]*Book
+	mutex sync.Mutex
+}
+
+// NewEngine creates an engine with no books; books are created on first use
+func NewEngine() *Engine {
+	return &Engine{books: make(map[string]*Book)}
+}
+
+// book returns the book for symbol, creating it if needed. The caller must
+// hold e.mutex.
+func (e *Engine) book(symbol string) *Book {
+	b, exists := e.books[symbol]
+	if !exists {
+		b = NewBook(symbol)
+		e.books[symbol] = b
+	}
+	return b
+}
+
+// Reset empties every book
+func (e *Engine) Reset() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.books = make(map[string]*Book)
+}
+
+// Submit matches an order in symbol's book
+func (e *Engine) Submit(symbol string, order Order, marketPrice money.Amount) []Fill {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.book(symbol).Submit(order, marketPrice)
+}
+
+// Add rests an order without matching it, used to rebuild books on startup
+func (e *Engine) Add(symbol string, order Order) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.book(symbol).Add(order)
+}
+
+// Cancel removes a resting order from symbol's book
+func (e *Engine) Cancel(symbol, orderID string) (Order, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.book(symbol).Cancel(orderID)
+}
+
+// Restore sets a resting order in symbol's book back to order.Quantity
+func (e *Engine) Restore(symbol string, order Order) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.book(symbol).Restore(order)
+}
+
+// MarketTick applies a new market price to symbol's book
+func (e *Engine) MarketTick(symbol string, marketPrice money.Amount) []Fill {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.book(symbol).MarketTick(marketPrice)
+}
+
+// Depth returns up to n aggregated levels per side of symbol's book
+func (e *Engine) Depth(symbol string, n int) Depth {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.book(symbol).Depth(n)
+}
@@ -0,0 +1,263 @@
+package orderbook
+
+import (
+	"reflect"
+	"testing"
+
+	"stocks-backend/internal/money"
+)
+
+func price(p int64) money.Amount {
+	return money.FromInt(p)
+}
+
+func limit(id, side string, p int64, quantity int) Order {
+	return Order{ID: id, Side: side, Price: price(p), Quantity: quantity}
+}
+
+func TestSubmit(t *testing.T) {
+	tests := []struct {
+		name      string
+		resting   []Order
+		incoming  Order
+		market    int64
+		wantFills []Fill
+		wantBids  []Level
+		wantAsks  []Level
+	}{
+		{
+			name:     "rests when nothing crosses",
+			resting:  []Order{limit("a1", "sell", 101, 5)},
+			incoming: limit("b1", "buy", 100, 5),
+			market:   105,
+			wantBids: []Level{{Price: price(100), Quantity: 5, Orders: 1}},
+			wantAsks: []Level{{Price: price(101), Quantity: 5, Orders: 1}},
+		},
+		{
+			name:     "best price first, at the resting price",
+			resting:  []Order{limit("a1", "sell", 102, 5), limit("a2", "sell", 101, 5)},
+			incoming: limit("b1", "buy", 102, 7),
+			market:   105,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: "a2", Quantity: 5, Price: price(101)},
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: "a1", Quantity: 2, Price: price(102)},
+			},
+			wantBids: []Level{},
+			wantAsks: []Level{{Price: price(102), Quantity: 3, Orders: 1}},
+		},
+		{
+			name:     "arrival order within a level",
+			resting:  []Order{limit("b1", "buy", 100, 3), limit("b2", "buy", 100, 3)},
+			incoming: limit("a1", "sell", 100, 4),
+			market:   95,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: "a1", Quantity: 3, Price: price(100)},
+				{Symbol: "T", BuyOrderID: "b2", SellOrderID: "a1", Quantity: 1, Price: price(100)},
+			},
+			wantBids: []Level{{Price: price(100), Quantity: 2, Orders: 1}},
+			wantAsks: []Level{},
+		},
+		{
+			name:     "partial fill rests the remainder",
+			resting:  []Order{limit("a1", "sell", 100, 2)},
+			incoming: limit("b1", "buy", 100, 5),
+			market:   105,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: "a1", Quantity: 2, Price: price(100)},
+			},
+			wantBids: []Level{{Price: price(100), Quantity: 3, Orders: 1}},
+			wantAsks: []Level{},
+		},
+		{
+			name:     "market order fills its remainder at the market",
+			resting:  []Order{limit("a1", "sell", 100, 2)},
+			incoming: Order{ID: "b1", Side: "buy", Price: price(110), Quantity: 5, Market: true},
+			market:   105,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: "a1", Quantity: 2, Price: price(100)},
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: MarketOrderID, Quantity: 3, Price: price(105)},
+			},
+			wantBids: []Level{},
+			wantAsks: []Level{},
+		},
+		{
+			name:     "immediate order drops a remainder the market doesn't cross",
+			resting:  []Order{limit("a1", "sell", 100, 2)},
+			incoming: Order{ID: "b1", Side: "buy", Price: price(100), Quantity: 5, ImmediateOnly: true},
+			market:   105,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: "a1", Quantity: 2, Price: price(100)},
+			},
+			wantBids: []Level{},
+			wantAsks: []Level{},
+		},
+		{
+			name:     "immediate order fills its remainder at a market it crosses",
+			resting:  []Order{limit("a1", "sell", 100, 2)},
+			incoming: Order{ID: "b1", Side: "buy", Price: price(100), Quantity: 5, ImmediateOnly: true},
+			market:   99,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: "a1", Quantity: 2, Price: price(100)},
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: MarketOrderID, Quantity: 3, Price: price(99)},
+			},
+			wantBids: []Level{},
+			wantAsks: []Level{},
+		},
+		{
+			name:     "all or none trades nothing unless it fills in full",
+			resting:  []Order{limit("a1", "sell", 100, 2), limit("a2", "sell", 101, 2)},
+			incoming: Order{ID: "b1", Side: "buy", Price: price(101), Quantity: 5, ImmediateOnly: true, AllOrNone: true},
+			market:   105,
+			wantBids: []Level{},
+			wantAsks: []Level{{Price: price(100), Quantity: 2, Orders: 1}, {Price: price(101), Quantity: 2, Orders: 1}},
+		},
+		{
+			name:     "all or none fills in full from the book",
+			resting:  []Order{limit("a1", "sell", 100, 2), limit("a2", "sell", 101, 3)},
+			incoming: Order{ID: "b1", Side: "buy", Price: price(101), Quantity: 5, ImmediateOnly: true, AllOrNone: true},
+			market:   105,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: "a1", Quantity: 2, Price: price(100)},
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: "a2", Quantity: 3, Price: price(101)},
+			},
+			wantBids: []Level{},
+			wantAsks: []Level{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBook("T")
+			for _, o := range tt.resting {
+				b.Add(o)
+			}
+			fills := b.Submit(tt.incoming, price(tt.market))
+			if !reflect.DeepEqual(fills, tt.wantFills) {
+				t.Errorf("fills = %+v, want %+v", fills, tt.wantFills)
+			}
+			depth := b.Depth(10)
+			if !reflect.DeepEqual(depth.Bids, tt.wantBids) {
+				t.Errorf("bids = %+v, want %+v", depth.Bids, tt.wantBids)
+			}
+			if !reflect.DeepEqual(depth.Asks, tt.wantAsks) {
+				t.Errorf("asks = %+v, want %+v", depth.Asks, tt.wantAsks)
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	b := NewBook("T")
+	b.Add(limit("b1", "buy", 100, 3))
+	b.Add(limit("b2", "buy", 100, 4))
+	b.Add(limit("b3", "buy", 99, 5))
+
+	cancelled, found := b.Cancel("b1")
+	if !found || cancelled.Quantity != 3 {
+		t.Fatalf("Cancel(b1) = %+v, %v", cancelled, found)
+	}
+	if _, found := b.Cancel("b1"); found {
+		t.Error("Cancel(b1) found it twice")
+	}
+	if _, found := b.Cancel("b3"); !found {
+		t.Error("Cancel(b3) didn't find it")
+	}
+
+	want := []Level{{Price: price(100), Quantity: 4, Orders: 1}}
+	if bids := b.Depth(10).Bids; !reflect.DeepEqual(bids, want) {
+		t.Errorf("bids = %+v, want %+v", bids, want)
+	}
+	fills := b.Submit(limit("a1", "sell", 100, 10), price(90))
+	if len(fills) != 1 || fills[0].BuyOrderID != "b2" {
+		t.Errorf("fills = %+v, want one against b2", fills)
+	}
+}
+
+func TestMarketTick(t *testing.T) {
+	tests := []struct {
+		name      string
+		market    int64
+		wantFills []Fill
+		wantBids  []Level
+		wantAsks  []Level
+	}{
+		{
+			name:     "price between the spread fills nothing",
+			market:   100,
+			wantBids: []Level{{Price: price(99), Quantity: 3, Orders: 1}, {Price: price(98), Quantity: 4, Orders: 1}},
+			wantAsks: []Level{{Price: price(101), Quantity: 5, Orders: 2}},
+		},
+		{
+			name:   "price at a bid fills it at the market",
+			market: 99,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: MarketOrderID, Quantity: 3, Price: price(99)},
+			},
+			wantBids: []Level{{Price: price(98), Quantity: 4, Orders: 1}},
+			wantAsks: []Level{{Price: price(101), Quantity: 5, Orders: 2}},
+		},
+		{
+			name:   "price below every bid fills them in priority order",
+			market: 97,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: "b1", SellOrderID: MarketOrderID, Quantity: 3, Price: price(97)},
+				{Symbol: "T", BuyOrderID: "b2", SellOrderID: MarketOrderID, Quantity: 4, Price: price(97)},
+			},
+			wantBids: []Level{},
+			wantAsks: []Level{{Price: price(101), Quantity: 5, Orders: 2}},
+		},
+		{
+			name:   "price above the asks fills the whole level",
+			market: 102,
+			wantFills: []Fill{
+				{Symbol: "T", BuyOrderID: MarketOrderID, SellOrderID: "a1", Quantity: 2, Price: price(102)},
+				{Symbol: "T", BuyOrderID: MarketOrderID, SellOrderID: "a2", Quantity: 3, Price: price(102)},
+			},
+			wantBids: []Level{{Price: price(99), Quantity: 3, Orders: 1}, {Price: price(98), Quantity: 4, Orders: 1}},
+			wantAsks: []Level{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBook("T")
+			b.Add(limit("b1", "buy", 99, 3))
+			b.Add(limit("b2", "buy", 98, 4))
+			b.Add(limit("a1", "sell", 101, 2))
+			b.Add(limit("a2", "sell", 101, 3))
+
+			fills := b.MarketTick(price(tt.market))
+			if !reflect.DeepEqual(fills, tt.wantFills) {
+				t.Errorf("fills = %+v, want %+v", fills, tt.wantFills)
+			}
+			depth := b.Depth(10)
+			if !reflect.DeepEqual(depth.Bids, tt.wantBids) {
+				t.Errorf("bids = %+v, want %+v", depth.Bids, tt.wantBids)
+			}
+			if !reflect.DeepEqual(depth.Asks, tt.wantAsks) {
+				t.Errorf("asks = %+v, want %+v", depth.Asks, tt.wantAsks)
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	b := NewBook("T")
+	b.Add(limit("a1", "sell", 100, 5))
+	b.Add(limit("a2", "sell", 100, 5))
+	b.Submit(limit("b1", "buy", 100, 7), price(90))
+
+	// a1 was taken out and a2 cut to 3; put both back
+	b.Restore(limit("a2", "sell", 100, 5))
+	b.Restore(limit("a1", "sell", 100, 5))
+	fills := b.Submit(limit("b2", "buy", 100, 5), price(90))
+	want := []Fill{{Symbol: "T", BuyOrderID: "b2", SellOrderID: "a2", Quantity: 5, Price: price(100)}}
+	if !reflect.DeepEqual(fills, want) {
+		t.Errorf("fills = %+v, want a2 to keep its place: %+v", fills, want)
+	}
+
+	b.Restore(Order{ID: "a1"})
+	if asks := b.Depth(10).Asks; len(asks) != 0 {
+		t.Errorf("asks = %+v, want a zero quantity to take a1 out", asks)
+	}
+}
@@ -0,0 +1,167 @@
+package simulation
+
+import (
+	"math"
+	"math/rand"
+	"stocks-backend/internal/money"
+	"stocks-backend/internal/storage"
+)
+
+// Shocks are correlated through a factor model. Each tick draws one market
+// factor, one factor per sector and one idiosyncratic draw per symbol, all
+// independent standard normals, and a symbol's shock is
+//
+//	marketBeta*market + sectorBeta*sector + sqrt(1 - marketBeta² - sectorBeta²)*own
+//
+// so it is itself standard normal, and two symbols' shocks have correlation
+//
+//	marketBeta₁*marketBeta₂ + sectorBeta₁*sectorBeta₂ (if in the same sector)
+
+// sectorOf returns the sector symbol is in, or "" if none
+func (c *ModelConfig) sectorOf(symbol string) string {
+	for sector, symbols := range c.Sectors {
+		for _, s := range symbols {
+			if s == symbol {
+				return sector
+			}
+		}
+	}
+	return ""
+}
+
+// Shocks draws one tick's shock for each of symbols
+func (c *ModelConfig) Shocks(symbols []string, rng *rand.Rand) []float64 {
+	market := rng.NormFloat64()
+	sectors := make(map[string]float64)
+
+	shocks := make([]float64, len(symbols))
+	for i, symbol := range symbols {
+		params := c.params(symbol)
+		shock := params.MarketBeta * market
+		sectorBeta := params.SectorBeta
+		if sector := c.sectorOf(symbol); sector != "" {
+			if _, drawn := sectors[sector]; !drawn {
+				sectors[sector] = rng.NormFloat64()
+			}
+			shock += sectorBeta * sectors[sector]
+		} else {
+			sectorBeta = 0
+		}
+		own := 1 - params.MarketBeta*params.MarketBeta - sectorBeta*sectorBeta
+		shocks[i] = shock + math.Sqrt(math.Max(own, 0))*rng.NormFloat64()
+	}
+	return shocks
+}
+
+// Correlation returns the correlation between two symbols' shocks
+func (c *ModelConfig) Correlation(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	pa, pb := c.params(a), c.params(b)
+	correlation := pa.MarketBeta * pb.MarketBeta
+	if sector := c.sectorOf(a); sector != "" && sector == c.sectorOf(b) {
+		correlation += pa.SectorBeta * pb.SectorBeta
+	}
+	return correlation
+}
+
+// CorrelationStats describes how symbols move together
+type CorrelationStats struct {
+	Symbols    []string             `json:"symbols"`
+	Factors    map[string]FactorMix `json:"factors"`
+	Configured [][]float64          `json:"configured"` // shock correlations implied by the factors
+	Realized   [][]float64          `json:"realized"`   // correlations of recent log returns
+	Samples    int                  `json:"samples"`    // returns each realized correlation is over
+}
+
+// FactorMix is how much of a symbol's shock comes from each factor
+type FactorMix struct {
+	MarketBeta float64 `json:"marketBeta"`
+	Sector     string  `json:"sector,omitempty"`
+	SectorBeta float64 `json:"sectorBeta"`
+}
+
+// Stats returns the configured correlations between the symbols of prices,
+// and the correlations realized over their price histories. Histories are
+// aligned on their latest prices; pairs without enough history to tell, or
+// where either symbol's price didn't move, are given a correlation of 0.
+func (c *ModelConfig) Stats(prices []storage.StockPrice) CorrelationStats {
+	stats := CorrelationStats{
+		Symbols:    make([]string, len(prices)),
+		Factors:    make(map[string]FactorMix, len(prices)),
+		Configured: make([][]float64, len(prices)),
+		Realized:   make([][]float64, len(prices)),
+	}
+
+	for i, price := range prices {
+		stats.Symbols[i] = price.Symbol
+		params := c.params(price.Symbol)
+		mix := FactorMix{MarketBeta: params.MarketBeta, Sector: c.sectorOf(price.Symbol)}
+		if mix.Sector != "" {
+			mix.SectorBeta = params.SectorBeta
+		}
+		stats.Factors[price.Symbol] = mix
+
+		if n := max(len(price.PriceHistory)-1, 0); i == 0 || n < stats.Samples {
+			stats.Samples = n
+		}
+	}
+
+	returns := make([][]float64, len(prices))
+	for i, price := range prices {
+		returns[i] = logReturns(price.PriceHistory, stats.Samples)
+	}
+	for i := range prices {
+		stats.Configured[i] = make([]float64, len(prices))
+		stats.Realized[i] = make([]float64, len(prices))
+		for j := range prices {
+			stats.Configured[i][j] = c.Correlation(prices[i].Symbol, prices[j].Symbol)
+			stats.Realized[i][j] = sampleCorrelation(returns[i], returns[j])
+		}
+	}
+	return stats
+}
+
+// logReturns returns the last n log returns of a price history. A return
+// from or to a zero price counts as no move.
+func logReturns(history []money.Amount, n int) []float64 {
+	returns := make([]float64, n)
+	start := len(history) - n - 1
+	for i := range returns {
+		from, to := history[start+i], history[start+i+1]
+		if from > 0 && to > 0 {
+			returns[i] = math.Log(to.Float64() / from.Float64())
+		}
+	}
+	return returns
+}
+
+// sampleCorrelation returns the Pearson correlation of two equally long
+// samples, or 0 if either doesn't vary. A correlation that rounding makes
+// undefined is 0 too, as JSON can't carry NaN.
+func sampleCorrelation(x, y []float64) float64 {
+	n := float64(len(x))
+	if n < 2 {
+		return 0
+	}
+	var sumX, sumY float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var cov, varX, varY float64
+	for i := range x {
+		dx, dy := x[i]-meanX, y[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	correlation := cov / math.Sqrt(varX*varY)
+	if math.IsNaN(correlation) || math.IsInf(correlation, 0) {
+		return 0
+	}
+	return math.Max(-1, math.Min(1, correlation))
+}
@@ -0,0 +1,313 @@
+package simulation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"stocks-backend/internal/storage"
+)
+
+// PriceModel generates a symbol's prices, one step at a time. Models may
+// keep state between steps, so each symbol has its own. The step's random
+// move is driven by shock, a standard normal draw that the simulator
+// correlates across symbols, see factors.go; rng is for any other
+// randomness the model needs.
+type PriceModel interface {
+	// Next returns the price dt years after price
+	Next(price, dt, shock float64, rng *rand.Rand) float64
+}
+
+// ModelParams selects a price model and its parameters. Drift and
+// volatilities are annualized; log returns are used throughout.
+type ModelParams struct {
+	Model      string  `json:"model"` // "gbm", "ou", "jump" or "garch"
+	Drift      float64 `json:"drift"`
+	Volatility float64 `json:"volatility"`
+
+	// ou: how fast the price reverts to Mean, per year, and the price it
+	// reverts to (the symbol's first price if zero)
+	MeanReversion float64 `json:"meanReversion"`
+	Mean          float64 `json:"mean"`
+
+	// jump: expected jumps per year and the mean and volatility of a
+	// jump's log size
+	JumpIntensity  float64 `json:"jumpIntensity"`
+	JumpMean       float64 `json:"jumpMean"`
+	JumpVolatility float64 `json:"jumpVolatility"`
+
+	// garch: weight of the last shock and of the last variance; Volatility
+	// is the long-run level the variance returns to
+	Alpha float64 `json:"alpha"`
+	Beta  float64 `json:"beta"`
+
+	// How much of the symbol's shock comes from the market factor and from
+	// its sector's factor, see factors.go
+	MarketBeta float64 `json:"marketBeta"`
+	SectorBeta float64 `json:"sectorBeta"`
+}
+
+// ModelConfig picks each symbol's price model. Symbols without an entry use
+// Default; an entry only needs the fields that differ from Default.
+type ModelConfig struct {
+	TickYears float64                `json:"tickYears"` // simulated years per tick
+	Default   ModelParams            `json:"default"`
+	Symbols   map[string]ModelParams `json:"symbols"`
+	Sectors   map[string][]string    `json:"sectors"` // symbols in each sector
+}
+
+// DefaultModelConfig moves every symbol by geometric Brownian motion, about
+// 1% per tick, with shocks driven half by the market and partly by sector
+func DefaultModelConfig() *ModelConfig {
+	return &ModelConfig{
+		TickYears: 0.001,
+		Default:   ModelParams{Model: "gbm", Drift: 0.05, Volatility: 0.3, MarketBeta: 0.5, SectorBeta: 0.4},
+		Symbols:   map[string]ModelParams{},
+		Sectors: map[string][]string{
+			"tech":     {"AAPL", "MSFT", "GOOGL", "META", "NVDA", "AMD", "INTC"},
+			"media":    {"NFLX", "DIS"},
+			"consumer": {"AMZN", "BABA", "TSLA"},
+		},
+	}
+}
+
+// LoadModelConfig reads a model config from a JSON file, or returns the
+// default config if path is empty
+func LoadModelConfig(path string) (*ModelConfig, error) {
+	config := DefaultModelConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		TickYears float64                    `json:"tickYears"`
+		Default   *ModelParams               `json:"default"`
+		Symbols   map[string]json.RawMessage `json:"symbols"`
+		Sectors   map[string][]string        `json:"sectors"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid price model config: %w", err)
+	}
+	if file.TickYears != 0 {
+		config.TickYears = file.TickYears
+	}
+	if file.Default != nil {
+		config.Default = *file.Default
+	}
+	for symbol, raw := range file.Symbols {
+		params := config.Default
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, fmt.Errorf("invalid price model for %s: %w", symbol, err)
+		}
+		config.Symbols[symbol] = params
+	}
+	if file.Sectors != nil {
+		config.Sectors = file.Sectors
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validate checks that every model can be built
+func (c *ModelConfig) validate() error {
+	if c.TickYears <= 0 {
+		return fmt.Errorf("tickYears must be positive")
+	}
+	if _, err := NewPriceModel(c.Default); err != nil {
+		return fmt.Errorf("default price model: %w", err)
+	}
+	for symbol, params := range c.Symbols {
+		if _, err := NewPriceModel(params); err != nil {
+			return fmt.Errorf("price model for %s: %w", symbol, err)
+		}
+	}
+
+	sectors := make(map[string]string)
+	for sector, symbols := range c.Sectors {
+		for _, symbol := range symbols {
+			if other, exists := sectors[symbol]; exists {
+				return fmt.Errorf("%s is in both the %s and %s sectors", symbol, other, sector)
+			}
+			sectors[symbol] = sector
+		}
+	}
+	return nil
+}
+
+// WithInstruments returns a copy of the config in which each instrument's
+// model parameters, from the instrument catalog, override the ones
+// configured for its symbol
+func (c *ModelConfig) WithInstruments(instruments []storage.Instrument) (*ModelConfig, error) {
+	config := *c
+	config.Symbols = make(map[string]ModelParams, len(c.Symbols)+len(instruments))
+	for symbol, params := range c.Symbols {
+		config.Symbols[symbol] = params
+	}
+
+	for _, instrument := range instruments {
+		if len(instrument.Model) == 0 {
+			continue
+		}
+		params := c.params(instrument.Symbol)
+		raw, err := json.Marshal(instrument.Model)
+		if err == nil {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			err = decoder.Decode(&params)
+		}
+		if err == nil {
+			_, err = NewPriceModel(params)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("price model for %s: %w", instrument.Symbol, err)
+		}
+		config.Symbols[instrument.Symbol] = params
+	}
+	return &config, nil
+}
+
+// params returns the model parameters of symbol
+func (c *ModelConfig) params(symbol string) ModelParams {
+	if params, exists := c.Symbols[symbol]; exists {
+		return params
+	}
+	return c.Default
+}
+
+// NewPriceModel builds the model params select
+func NewPriceModel(params ModelParams) (PriceModel, error) {
+	if params.Volatility < 0 || params.JumpVolatility < 0 {
+		return nil, fmt.Errorf("volatility must not be negative")
+	}
+	if params.MarketBeta*params.MarketBeta+params.SectorBeta*params.SectorBeta > 1 {
+		return nil, fmt.Errorf("marketBeta and sectorBeta squared must sum to at most 1")
+	}
+
+	switch params.Model {
+	case "gbm", "":
+		return &GBM{Drift: params.Drift, Volatility: params.Volatility}, nil
+	case "ou":
+		if params.MeanReversion <= 0 {
+			return nil, fmt.Errorf("meanReversion must be positive")
+		}
+		if params.Mean < 0 {
+			return nil, fmt.Errorf("mean must not be negative")
+		}
+		return &OrnsteinUhlenbeck{Rate: params.MeanReversion, Mean: params.Mean, Volatility: params.Volatility}, nil
+	case "jump":
+		if params.JumpIntensity < 0 {
+			return nil, fmt.Errorf("jumpIntensity must not be negative")
+		}
+		return &JumpDiffusion{
+			GBM:            GBM{Drift: params.Drift, Volatility: params.Volatility},
+			Intensity:      params.JumpIntensity,
+			JumpMean:       params.JumpMean,
+			JumpVolatility: params.JumpVolatility,
+		}, nil
+	case "garch":
+		if params.Alpha < 0 || params.Beta < 0 || params.Alpha+params.Beta >= 1 {
+			return nil, fmt.Errorf("alpha and beta must not be negative and must sum to less than 1")
+		}
+		return &GARCH{Drift: params.Drift, Volatility: params.Volatility, Alpha: params.Alpha, Beta: params.Beta}, nil
+	default:
+		return nil, fmt.Errorf("unknown price model %q", params.Model)
+	}
+}
+
+// GBM is geometric Brownian motion: log returns are normal with constant
+// drift and volatility
+type GBM struct {
+	Drift      float64
+	Volatility float64
+}
+
+// Next returns the price dt years after price
+func (m *GBM) Next(price, dt, shock float64, rng *rand.Rand) float64 {
+	return price * math.Exp(m.logReturn(dt, shock))
+}
+
+// logReturn is the log return over dt years for a shock
+func (m *GBM) logReturn(dt, shock float64) float64 {
+	return (m.Drift-m.Volatility*m.Volatility/2)*dt + m.Volatility*math.Sqrt(dt)*shock
+}
+
+// OrnsteinUhlenbeck reverts the log price to the log of Mean at Rate per
+// year, so prices wander around Mean instead of trending
+type OrnsteinUhlenbeck struct {
+	Rate       float64
+	Mean       float64
+	Volatility float64
+}
+
+// Next returns the price dt years after price, stepping the log price by
+// the process's exact transition
+func (m *OrnsteinUhlenbeck) Next(price, dt, shock float64, rng *rand.Rand) float64 {
+	if m.Mean == 0 {
+		m.Mean = price
+	}
+	decay := math.Exp(-m.Rate * dt)
+	logMean := math.Log(m.Mean)
+	stddev := m.Volatility * math.Sqrt((1-decay*decay)/(2*m.Rate))
+	return math.Exp(logMean + (math.Log(price)-logMean)*decay + stddev*shock)
+}
+
+// JumpDiffusion is Merton's model: geometric Brownian motion plus jumps
+// arriving Intensity times a year, each with a normal log size
+type JumpDiffusion struct {
+	GBM
+	Intensity      float64
+	JumpMean       float64
+	JumpVolatility float64
+}
+
+// Next returns the price dt years after price
+func (m *JumpDiffusion) Next(price, dt, shock float64, rng *rand.Rand) float64 {
+	logReturn := m.logReturn(dt, shock)
+	for jumps := poisson(m.Intensity*dt, rng); jumps > 0; jumps-- {
+		logReturn += m.JumpMean + m.JumpVolatility*rng.NormFloat64()
+	}
+	return price * math.Exp(logReturn)
+}
+
+// poisson draws from a Poisson distribution with a small mean
+func poisson(mean float64, rng *rand.Rand) int {
+	limit := math.Exp(-mean)
+	n := 0
+	for p := rng.Float64(); p > limit; p *= rng.Float64() {
+		n++
+	}
+	return n
+}
+
+// GARCH is a GARCH(1,1) model: each step's variance is a weighted mix of
+// the long-run variance, the last step's squared shock and the last step's
+// variance, so calm and turbulent stretches cluster
+type GARCH struct {
+	Drift      float64
+	Volatility float64 // long-run
+	Alpha      float64
+	Beta       float64
+	variance   float64 // of the last step
+	shock      float64 // last step's log return less its mean
+}
+
+// Next returns the price dt years after price
+func (m *GARCH) Next(price, dt, shock float64, rng *rand.Rand) float64 {
+	longRun := m.Volatility * m.Volatility * dt
+	if m.variance == 0 {
+		m.variance = longRun
+	} else {
+		m.variance = (1-m.Alpha-m.Beta)*longRun + m.Alpha*m.shock*m.shock + m.Beta*m.variance
+	}
+	m.shock = math.Sqrt(m.variance) * shock
+	return price * math.Exp(m.Drift*dt-m.variance/2+m.shock)
+}
@@ -0,0 +1,324 @@
+package simulation
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"stocks-backend/internal/money"
+	"stocks-backend/internal/storage"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrReplayFinished is returned by Advance once a replay without looping
+// has run out of bars
+var ErrReplayFinished = errors.New("the price replay has finished")
+
+// timeLayouts are the formats a bar's time may be in, besides Unix seconds
+// or milliseconds. Times without a zone are UTC. Eight digits are a
+// YYYYMMDD date, as daily bar exports often use, rather than Unix seconds.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"20060102",
+}
+
+// Replay is a history of bars that a simulator plays back in place of its
+// price models. Bars with the same time form one step, applied in a single
+// tick. Between steps a running simulator waits the time between their
+// bars divided by speed, except across days, where it waits one tick
+// interval instead of the market's overnight gap.
+type Replay struct {
+	steps    []replayStep
+	speed    float64
+	loop     bool
+	next     int                     // index of the next step
+	closes   map[string]money.Amount // each symbol's last close
+	days     map[string]string       // date of each symbol's last bar
+	finished bool
+}
+
+// replayStep is the bars of one time, in symbol order
+type replayStep struct {
+	time time.Time
+	bars []symbolBar
+}
+
+// symbolBar is a bar of one symbol
+type symbolBar struct {
+	symbol string
+	bar    storage.Bar
+}
+
+// barUpdate is a bar ready to apply: with its change from the previous
+// close and whether it starts a new day for its symbol
+type barUpdate struct {
+	symbolBar
+	change float64
+	newDay bool
+}
+
+// LoadReplay reads the bars in a CSV file, or in every CSV file in a
+// directory. The files need a header row naming the time (or date or
+// timestamp), open, high, low and close columns, and optionally volume and
+// symbol; files without a symbol column are named after their symbol, as in
+// AAPL.csv. Parquet files are not supported yet. The replay plays at speed
+// times real time, and starts over at the end if loop is set.
+func LoadReplay(path string, speed float64, loop bool) (*Replay, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("replay speed must be positive")
+	}
+
+	files := []string{path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.csv")); err != nil {
+			return nil, err
+		}
+	}
+
+	var bars []symbolBar
+	for _, file := range files {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".csv":
+		case ".parquet":
+			return nil, fmt.Errorf("%s: Parquet files are not supported yet, convert them to CSV", file)
+		default:
+			return nil, fmt.Errorf("%s: replay files must be CSV", file)
+		}
+		fileBars, err := readCSVBars(file)
+		if err != nil {
+			return nil, err
+		}
+		bars = append(bars, fileBars...)
+	}
+	if len(bars) == 0 {
+		return nil, fmt.Errorf("no bars to replay in %s", path)
+	}
+
+	sort.SliceStable(bars, func(i, j int) bool {
+		if !bars[i].bar.Time.Equal(bars[j].bar.Time) {
+			return bars[i].bar.Time.Before(bars[j].bar.Time)
+		}
+		return bars[i].symbol < bars[j].symbol
+	})
+	replay := &Replay{speed: speed, loop: loop}
+	for _, bar := range bars {
+		last := len(replay.steps) - 1
+		if last < 0 || !replay.steps[last].time.Equal(bar.bar.Time) {
+			replay.steps = append(replay.steps, replayStep{time: bar.bar.Time})
+			last++
+		}
+		replay.steps[last].bars = append(replay.steps[last].bars, bar)
+	}
+	replay.rewind()
+	return replay, nil
+}
+
+// readCSVBars reads the bars in a CSV file
+func readCSVBars(path string) ([]symbolBar, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading header: %w", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "date", "timestamp", "datetime":
+			name = "time"
+		}
+		columns[name] = i
+	}
+	for _, name := range []string{"time", "open", "high", "low", "close"} {
+		if _, exists := columns[name]; !exists {
+			return nil, fmt.Errorf("%s: missing %s column", path, name)
+		}
+	}
+	fileSymbol := strings.ToUpper(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+
+	var bars []symbolBar
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return bars, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		bar, err := parseBar(record, columns)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		symbol := fileSymbol
+		if i, exists := columns["symbol"]; exists {
+			symbol = strings.ToUpper(strings.TrimSpace(record[i]))
+		}
+		bars = append(bars, symbolBar{symbol: symbol, bar: bar})
+	}
+}
+
+// parseBar parses one CSV record
+func parseBar(record []string, columns map[string]int) (storage.Bar, error) {
+	var bar storage.Bar
+	var err error
+	if bar.Time, err = parseBarTime(strings.TrimSpace(record[columns["time"]])); err != nil {
+		return bar, err
+	}
+
+	prices := map[string]*money.Amount{"open": &bar.Open, "high": &bar.High, "low": &bar.Low, "close": &bar.Close}
+	for name, price := range prices {
+		if *price, err = money.Parse(record[columns[name]]); err != nil {
+			return bar, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if *price <= 0 {
+			return bar, fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if bar.Low > bar.High || bar.Open < bar.Low || bar.Open > bar.High || bar.Close < bar.Low || bar.Close > bar.High {
+		return bar, fmt.Errorf("open and close must lie between low and high")
+	}
+
+	if i, exists := columns["volume"]; exists && strings.TrimSpace(record[i]) != "" {
+		volume, err := strconv.ParseFloat(strings.TrimSpace(record[i]), 64)
+		if err != nil || volume < 0 {
+			return bar, fmt.Errorf("invalid volume %q", record[i])
+		}
+		bar.Volume = int64(volume)
+	}
+	return bar, nil
+}
+
+// parseBarTime parses a bar's time in any of timeLayouts, or as Unix
+// seconds or milliseconds
+func parseBarTime(value string) (time.Time, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil && len(value) > 8 {
+		if n > 1e12 {
+			return time.UnixMilli(n).UTC(), nil
+		}
+		return time.Unix(n, 0).UTC(), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// rewind goes back to the first step, which starts a new day for every
+// symbol
+func (r *Replay) rewind() {
+	r.next = 0
+	r.closes = make(map[string]money.Amount)
+	r.days = make(map[string]string)
+}
+
+// Symbols returns the symbols the replay has bars for
+func (r *Replay) Symbols() []string {
+	seen := make(map[string]bool)
+	var symbols []string
+	for _, step := range r.steps {
+		for _, bar := range step.bars {
+			if !seen[bar.symbol] {
+				seen[bar.symbol] = true
+				symbols = append(symbols, bar.symbol)
+			}
+		}
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// remove drops a symbol's bars, and any steps left empty
+func (r *Replay) remove(symbol string) {
+	steps := r.steps[:0]
+	for _, step := range r.steps {
+		bars := step.bars[:0]
+		for _, bar := range step.bars {
+			if bar.symbol != symbol {
+				bars = append(bars, bar)
+			}
+		}
+		if len(bars) > 0 {
+			step.bars = bars
+			steps = append(steps, step)
+		}
+	}
+	r.steps = steps
+}
+
+// step returns the next step's bars, or false once a replay without
+// looping has played them all
+func (r *Replay) step() ([]barUpdate, bool) {
+	if r.next == len(r.steps) {
+		if !r.loop || len(r.steps) == 0 {
+			r.finished = true
+			return nil, false
+		}
+		r.rewind()
+	}
+
+	step := r.steps[r.next]
+	r.next++
+	updates := make([]barUpdate, len(step.bars))
+	for i, bar := range step.bars {
+		// A symbol's first bar of a day changes from its open
+		previous, seen := r.closes[bar.symbol]
+		day := bar.bar.Time.Format("2006-01-02")
+		newDay := r.days[bar.symbol] != day
+		if !seen || newDay {
+			previous = bar.bar.Open
+		}
+		updates[i] = barUpdate{
+			symbolBar: bar,
+			change:    (bar.bar.Close - previous).Float64() / previous.Float64() * 100.0,
+			newDay:    newDay,
+		}
+		r.closes[bar.symbol] = bar.bar.Close
+		r.days[bar.symbol] = day
+	}
+	return updates, true
+}
+
+// day returns the date of the step played last, or "" if none has been
+// since the replay started or rewound
+func (r *Replay) day() string {
+	if r.next == 0 {
+		return ""
+	}
+	return r.steps[r.next-1].time.Format("2006-01-02")
+}
+
+// wait returns how long to wait before the next step
+func (r *Replay) wait() time.Duration {
+	if r.next == 0 || r.next == len(r.steps) {
+		return tickInterval
+	}
+	previous, next := r.steps[r.next-1].time, r.steps[r.next].time
+	if previous.Format("2006-01-02") != next.Format("2006-01-02") {
+		return tickInterval
+	}
+	return time.Duration(float64(next.Sub(previous)) / r.speed)
+}
@@ -0,0 +1,111 @@
+package simulation
+
+import (
+	"log"
+	"stocks-backend/internal/leader"
+	"stocks-backend/internal/market"
+	"stocks-backend/internal/storage"
+	"time"
+)
+
+// SessionWatcher follows the market calendar through the trading day. At
+// the regular open it starts the day, resetting every stock's day stats, and
+// releases the orders queued while the market was closed; at the start of
+// pre-market or after-hours trading it releases the queued orders other than
+// market orders, which wait for the regular open. Halted symbols keep their
+// orders queued until they resume.
+//
+// Like the simulator, it only acts while elector says this replica is the
+// leader. While a simulator it follows is replaying history, the replay is
+// the clock instead of the calendar: each date the replay reaches is a
+// trading day, in its regular session.
+type SessionWatcher struct {
+	storage   storage.Store
+	calendar  *market.Calendar
+	elector   *leader.Elector
+	simulator *Simulator // followed while replaying, nil for none
+	ticker    *time.Ticker
+	session   market.Session // as of the last check, "" before the first
+	day       string         // trading day of the last check
+}
+
+// NewSessionWatcher creates a new SessionWatcher instance
+func NewSessionWatcher(store storage.Store, calendar *market.Calendar, elector *leader.Elector) *SessionWatcher {
+	return &SessionWatcher{
+		storage:  store,
+		calendar: calendar,
+		elector:  elector,
+		ticker:   time.NewTicker(time.Second),
+	}
+}
+
+// FollowReplay makes the watcher take its sessions from the simulator's
+// replay, while it has one. Call it before Start.
+func (w *SessionWatcher) FollowReplay(simulator *Simulator) {
+	w.simulator = simulator
+}
+
+// Start begins watching the market sessions
+func (w *SessionWatcher) Start() {
+	w.check(time.Now())
+	go func() {
+		log.Println("Market session watcher started")
+		for now := range w.ticker.C {
+			w.check(now)
+		}
+	}()
+}
+
+// Stop stops the watcher
+func (w *SessionWatcher) Stop() {
+	w.ticker.Stop()
+	log.Println("Market session watcher stopped")
+}
+
+// check acts on a change of session or trading day by now. The first check
+// acts on the session the market is already in, so a restart, or a replica
+// that has just become the leader, catches up.
+func (w *SessionWatcher) check(now time.Time) {
+	if !w.elector.IsLeader() {
+		w.session, w.day = "", ""
+		return
+	}
+
+	session, day := w.calendar.SessionAt(now), w.calendar.Day(now)
+	if replayDay, replaying := w.simulator.ReplayDay(); replaying {
+		session, day = market.Regular, replayDay
+	}
+	if session == w.session && day == w.day {
+		return
+	}
+	if session != w.session {
+		log.Printf("Market session is now %s", session)
+	}
+	w.session, w.day = session, day
+
+	switch session {
+	case market.Regular:
+		// A replay that hasn't reached its first bar has no day yet
+		if day != "" {
+			if err := w.storage.StartDay(day); err != nil {
+				log.Printf("Error starting trading day: %v", err)
+			}
+		}
+		w.release(true)
+	case market.PreMarket, market.AfterHours:
+		w.release(false)
+	}
+}
+
+// release releases the queued orders of every symbol that isn't halted,
+// market orders only if marketOrders
+func (w *SessionWatcher) release(marketOrders bool) {
+	for _, price := range w.storage.GetAllPrices() {
+		if price.Halted {
+			continue
+		}
+		if err := w.storage.ReleaseQueued(price.Symbol, marketOrders); err != nil {
+			log.Printf("Error releasing queued %s orders: %v", price.Symbol, err)
+		}
+	}
+}
@@ -1,64 +1,278 @@
 package simulation
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"sort"
+	"stocks-backend/internal/bus"
+	"stocks-backend/internal/leader"
+	"stocks-backend/internal/market"
+	"stocks-backend/internal/money"
 	"stocks-backend/internal/storage"
-	"stocks-backend/internal/websocket"
+	"sync"
 	"time"
 )
 
-// Simulator handles the price simulation logic
+// tickInterval is how often a running simulator ticks
+const tickInterval = 3 * time.Second
+
+// maxAdvance is the most ticks Advance runs at once
+const maxAdvance = 1000
+
+// ErrNotLeader is returned by Advance on a replica that isn't the leader
+var ErrNotLeader = errors.New("this replica is not the simulator leader")
+
+// Simulator handles the price simulation logic. Only the elected leader
+// among the replicas updates prices; the others skip their ticks. Each
+// tradable instrument in the catalog moves by the price model its config
+// and catalog entry pick, driven by shocks correlated across symbols,
+// unless the simulator is replaying history.
+//
+// A simulator ticks every tickInterval once started, or as its replay's
+// bars are spaced; one that isn't started ticks only when Advance is
+// called, so tests control the clock. Given the same seed and starting
+// prices, the price path is the same every run.
+//
+// A running simulator with a calendar doesn't tick while the market is
+// closed, unless it is replaying history. Halted symbols never move.
 type Simulator struct {
-	storage *storage.Storage
-	hub     *websocket.Hub
-	ticker  *time.Ticker
+	storage  storage.Store
+	bus      bus.Bus
+	elector  *leader.Elector
+	config   *ModelConfig
+	models   map[string]symbolModel // built on a symbol's first tick
+	rng      *rand.Rand
+	replay   *Replay          // nil to simulate prices
+	calendar *market.Calendar // nil to tick around the clock
+	stop     chan struct{}
+	mutex    sync.Mutex // serializes ticks, which share rng, models and replay
 }
 
-// NewSimulator creates a new Simulator instance
-func NewSimulator(store *storage.Storage, hub *websocket.Hub) *Simulator {
+// NewSimulator creates a new Simulator instance that publishes its ticks to
+// the bus while elector says this replica is the leader. Its random numbers
+// come from seed, or from the time if seed is 0.
+func NewSimulator(store storage.Store, b bus.Bus, elector *leader.Elector, config *ModelConfig, seed int64) *Simulator {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
 	return &Simulator{
 		storage: store,
-		hub:     hub,
-		ticker:  time.NewTicker(3 * time.Second), // Update every 3 seconds
+		bus:     b,
+		elector: elector,
+		config:  config,
+		models:  make(map[string]symbolModel),
+		rng:     rand.New(rand.NewSource(seed)),
 	}
 }
 
+// symbolModel is a symbol's price model and the params it was built from
+type symbolModel struct {
+	params ModelParams
+	model  PriceModel
+}
+
+// UseReplay makes the simulator replay history instead of simulating
+// prices. Symbols the store doesn't know are left out of the replay.
+func (s *Simulator) UseReplay(replay *Replay) {
+	for _, symbol := range replay.Symbols() {
+		if _, exists := s.storage.GetPrice(symbol); !exists {
+			log.Printf("Skipping replay bars for unknown symbol %s", symbol)
+			replay.remove(symbol)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.replay = replay
+}
+
+// UseCalendar makes a running simulator pause while the market is closed
+func (s *Simulator) UseCalendar(calendar *market.Calendar) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calendar = calendar
+}
+
+// ReplayDay returns the date of the bars the simulator replayed last, "" if
+// none yet, and whether it is replaying at all. A nil simulator isn't.
+func (s *Simulator) ReplayDay() (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.replay == nil {
+		return "", false
+	}
+	return s.replay.day(), true
+}
+
 // Start begins the price simulation
 func (s *Simulator) Start() {
+	s.stop = make(chan struct{})
 	go func() {
 		log.Println("Price simulation started")
-		for range s.ticker.C {
-			s.updatePrices()
+		timer := time.NewTimer(tickInterval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-s.stop:
+				return
+			}
+			if s.elector.IsLeader() && s.marketOpen(time.Now()) {
+				s.tick()
+			}
+			timer.Reset(s.nextWait())
 		}
 	}()
 }
 
 // Stop stops the price simulation
 func (s *Simulator) Stop() {
-	s.ticker.Stop()
+	if s.stop != nil {
+		close(s.stop)
+	}
 	log.Println("Price simulation stopped")
 }
 
-// updatePrices randomly updates all stock prices
-func (s *Simulator) updatePrices() {
-	prices := s.storage.GetAllPrices()
+// marketOpen reports whether a running simulator should tick at now
+func (s *Simulator) marketOpen(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.replay != nil || s.calendar == nil || s.calendar.SessionAt(now) != market.Closed
+}
+
+// nextWait returns how long a running simulator waits for its next tick
+func (s *Simulator) nextWait() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.replay != nil {
+		return s.replay.wait()
+	}
+	return tickInterval
+}
+
+// Advance runs n ticks straight away, whatever the market session, and
+// returns the prices after the last. It fails on a replica that isn't the
+// leader.
+func (s *Simulator) Advance(n int) ([]storage.StockPrice, error) {
+	if n < 1 || n > maxAdvance {
+		return nil, fmt.Errorf("ticks must be between 1 and %d", maxAdvance)
+	}
+	if !s.elector.IsLeader() {
+		return nil, ErrNotLeader
+	}
+
+	var prices []storage.StockPrice
+	for i := 0; i < n; i++ {
+		if updated := s.tick(); updated != nil {
+			prices = updated
+		}
+	}
+	if prices == nil {
+		return nil, ErrReplayFinished
+	}
+	return prices, nil
+}
+
+// tick updates the prices once and returns them, or nil if a replay has
+// finished
+func (s *Simulator) tick() []storage.StockPrice {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.replay != nil {
+		return s.replayPrices()
+	}
+	return s.updatePrices()
+}
+
+// replayPrices applies the replay's next bars and returns the new prices,
+// or nil once the replay has finished
+func (s *Simulator) replayPrices() []storage.StockPrice {
+	wasFinished := s.replay.finished
+	updates, ok := s.replay.step()
+	if !ok {
+		if !wasFinished {
+			log.Println("Price replay finished")
+		}
+		return nil
+	}
+
+	updatedPrices := make([]storage.StockPrice, 0, len(updates))
+	for _, update := range updates {
+		if stock, exists := s.storage.GetPrice(update.symbol); exists && stock.Halted {
+			continue
+		}
+		if instrument, exists := s.storage.GetInstrument(update.symbol); exists && !instrument.Tradable {
+			continue
+		}
+		if err := s.storage.ApplyBar(update.symbol, update.bar, update.change, update.newDay); err != nil {
+			log.Printf("Error replaying bar for %s: %v", update.symbol, err)
+		}
+		if updatedStock, exists := s.storage.GetPrice(update.symbol); exists {
+			updatedPrices = append(updatedPrices, *updatedStock)
+		}
+	}
+
+	s.bus.PublishPrices(updatedPrices)
+	return updatedPrices
+}
+
+// updatePrices moves the price of every tradable instrument one tick along
+// its model and returns the new prices
+func (s *Simulator) updatePrices() []storage.StockPrice {
+	instruments := s.storage.GetInstruments()
+	config, err := s.config.WithInstruments(instruments)
+	if err != nil {
+		log.Printf("Error applying instrument price models: %v", err)
+		config = s.config
+	}
+	tradable := make(map[string]bool, len(instruments))
+	for _, instrument := range instruments {
+		tradable[instrument.Symbol] = instrument.Tradable
+	}
+
+	// Go through symbols in a fixed order, so a seed gives the same path
+	// whatever order the store returns them in
+	var prices []storage.StockPrice
+	for _, price := range s.storage.GetAllPrices() {
+		if tradable[price.Symbol] {
+			prices = append(prices, price)
+		}
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i].Symbol < prices[j].Symbol
+	})
 	updatedPrices := make([]storage.StockPrice, 0, len(prices))
 
-	for _, price := range prices {
-		// Generate a random percentage change between -2% and +2%
-		changePercent := (rand.Float64() - 0.5) * 4.0 // Range: -2.0 to +2.0
-		changeAmount := price.Price * (changePercent / 100.0)
-		newPrice := price.Price + changeAmount
+	// Draw every symbol's shock together so they move as the factors say
+	symbols := make([]string, len(prices))
+	for i, price := range prices {
+		symbols[i] = price.Symbol
+	}
+	shocks := config.Shocks(symbols, s.rng)
 
-		// Ensure price doesn't go below $1
-		if newPrice < 1.0 {
-			newPrice = 1.0
-			changePercent = ((newPrice - price.Price) / price.Price) * 100.0
+	for i, price := range prices {
+		if price.Halted {
+			continue
 		}
+		model, err := s.model(config, price.Symbol)
+		if err != nil {
+			log.Printf("Error building price model for %s: %v", price.Symbol, err)
+			continue
+		}
+		// Prices move in whole cents and don't go below $1
+		next := model.Next(price.Price.Float64(), config.TickYears, shocks[i], s.rng)
+		newPrice := max(money.FromFloat(next).Round(money.Cent), money.One)
+		changePercent := (newPrice - price.Price).Float64() / price.Price.Float64() * 100.0
 
 		// Update storage
-		s.storage.UpdatePrice(price.Symbol, newPrice, changePercent)
+		if err := s.storage.UpdatePrice(price.Symbol, newPrice, changePercent); err != nil {
+			log.Printf("Error updating price for %s: %v", price.Symbol, err)
+		}
 
 		// Fetch the updated stock with all fields (including Logo, Name, and analytics)
 		updatedStock, exists := s.storage.GetPrice(price.Symbol)
@@ -67,11 +281,22 @@ func (s *Simulator) updatePrices() {
 		}
 	}
 
-	// Broadcast updated prices to all WebSocket clients
-	if err := s.hub.Broadcast(map[string]interface{}{
-		"type":   "priceUpdate",
-		"prices": updatedPrices,
-	}); err != nil {
-		log.Printf("Error broadcasting prices: %v", err)
+	// Fan the tick out to the WebSocket clients of every replica
+	s.bus.PublishPrices(updatedPrices)
+	return updatedPrices
+}
+
+// model returns symbol's price model, building it on first use and
+// rebuilding it when config gives it new params
+func (s *Simulator) model(config *ModelConfig, symbol string) (PriceModel, error) {
+	params := config.params(symbol)
+	if cached, exists := s.models[symbol]; exists && cached.params == params {
+		return cached.model, nil
+	}
+	model, err := NewPriceModel(params)
+	if err != nil {
+		return nil, err
 	}
+	s.models[symbol] = symbolModel{params: params, model: model}
+	return model, nil
 }
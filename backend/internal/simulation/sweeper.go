@@ -0,0 +1,56 @@
+package simulation
+
+import (
+	"log"
+	"stocks-backend/internal/leader"
+	"stocks-backend/internal/storage"
+	"time"
+)
+
+// Sweeper periodically expires DAY and GTD orders that have reached their
+// expiry. The store's listener tells their owners. Like the simulator, it
+// only sweeps while elector says this replica is the leader.
+type Sweeper struct {
+	storage storage.Store
+	elector *leader.Elector
+	ticker  *time.Ticker
+}
+
+// NewSweeper creates a new Sweeper instance
+func NewSweeper(store storage.Store, elector *leader.Elector) *Sweeper {
+	return &Sweeper{
+		storage: store,
+		elector: elector,
+		ticker:  time.NewTicker(time.Second),
+	}
+}
+
+// Start begins sweeping for expired orders
+func (s *Sweeper) Start() {
+	go func() {
+		log.Println("Order expiry sweeper started")
+		for now := range s.ticker.C {
+			if s.elector.IsLeader() {
+				s.sweep(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the sweeper
+func (s *Sweeper) Stop() {
+	s.ticker.Stop()
+	log.Println("Order expiry sweeper stopped")
+}
+
+// sweep expires the orders due by now
+func (s *Sweeper) sweep(now time.Time) {
+	expired, err := s.storage.ExpireOrders(now)
+	if err != nil {
+		log.Printf("Error expiring orders: %v", err)
+	}
+
+	for _, order := range expired {
+		log.Printf("Order %s of user=%s expired", order.ID, order.Username)
+	}
+}
@@ -0,0 +1,205 @@
+package storage
+
+import "stocks-backend/internal/money"
+
+// Account balance rules shared by every Store backend. Credits and Portfolio
+// hold the available balances; cash and shares committed to pending orders
+// are moved into HeldCredits and HeldShares until the order is filled or
+// cancelled. Market orders are held at the current price like a limit order,
+// so every fill settles out of a hold.
+//
+// Every money movement is described as a balanceChange. Backends apply a
+// change atomically and refuse it if any balance would go negative, which is
+// what stops two concurrent orders from spending the same credits. Cash is a
+// money.Amount, so a hold and the fills settled out of it add up exactly.
+
+// startingCredits is the cash a new account starts with
+var startingCredits = money.FromInt(2000)
+
+// balanceChange is a set of deltas to apply to one account in a single step
+type balanceChange struct {
+	Username    string
+	Symbol      string
+	Credits     money.Amount // available cash
+	HeldCredits money.Amount // cash reserved by pending buys
+	Shares      int          // available shares of Symbol
+	HeldShares  int          // shares of Symbol reserved by pending sells
+}
+
+// add combines two changes to the same account and symbol
+func (c balanceChange) add(other balanceChange) balanceChange {
+	c.Credits += other.Credits
+	c.HeldCredits += other.HeldCredits
+	c.Shares += other.Shares
+	c.HeldShares += other.HeldShares
+	return c
+}
+
+// negate returns the change that undoes c
+func (c balanceChange) negate() balanceChange {
+	return balanceChange{
+		Username:    c.Username,
+		Symbol:      c.Symbol,
+		Credits:     -c.Credits,
+		HeldCredits: -c.HeldCredits,
+		Shares:      -c.Shares,
+		HeldShares:  -c.HeldShares,
+	}
+}
+
+// isZero reports whether the change moves nothing
+func (c balanceChange) isZero() bool {
+	return c.Credits == 0 && c.HeldCredits == 0 && c.Shares == 0 && c.HeldShares == 0
+}
+
+// shortfallError describes why a change could not be applied
+func (c balanceChange) shortfallError() error {
+	switch {
+	case c.Credits < 0:
+		return &OrderError{ReasonInsufficientCredits, "Insufficient credits"}
+	case c.Shares < 0:
+		return &OrderError{ReasonInsufficientShares, "Insufficient stocks to sell"}
+	default:
+		return &OrderError{ReasonHoldMismatch, "Held balance is lower than expected"}
+	}
+}
+
+// check reports whether account can absorb the change
+func (c balanceChange) check(account *UserAccount) error {
+	if account.Credits+c.Credits < 0 ||
+		account.HeldCredits+c.HeldCredits < 0 ||
+		account.Portfolio[c.Symbol]+c.Shares < 0 ||
+		account.HeldShares[c.Symbol]+c.HeldShares < 0 {
+		return c.shortfallError()
+	}
+	return nil
+}
+
+// apply checks and applies the change to an in-memory account
+func (c balanceChange) apply(account *UserAccount) error {
+	ensureMaps(account)
+	if err := c.check(account); err != nil {
+		return err
+	}
+
+	account.Credits += c.Credits
+	account.HeldCredits += c.HeldCredits
+	if c.Symbol != "" {
+		account.Portfolio[c.Symbol] += c.Shares
+		account.HeldShares[c.Symbol] += c.HeldShares
+		cleanupPosition(account, c.Symbol)
+	}
+	return nil
+}
+
+// holdChange moves the funds needed by the unfilled part of an open order
+// from the available balances into the hold
+func holdChange(order *Order) balanceChange {
+	return holdChangeFor(order, order.Remaining())
+}
+
+// holdChangeFor holds the funds needed to fill quantity of an order. A
+// bracket exit whose funds are held by its sibling holds nothing.
+func holdChangeFor(order *Order, quantity int) balanceChange {
+	change := balanceChange{Username: order.Username, Symbol: order.Symbol}
+	if order.HeldBySibling {
+		return change
+	}
+	if order.Side == "buy" {
+		cost := order.Price.Mul(quantity)
+		change.Credits = -cost
+		change.HeldCredits = cost
+	} else {
+		change.Shares = -quantity
+		change.HeldShares = quantity
+	}
+	return change
+}
+
+// coverableQuantity returns how much of an order the account's available
+// balances can pay for, up to the unfilled quantity
+func coverableQuantity(account *UserAccount, order *Order) int {
+	covered := order.Remaining()
+	if order.Side == "buy" {
+		if order.Price > 0 {
+			covered = min(covered, int(account.Credits/order.Price))
+		}
+	} else {
+		covered = min(covered, account.Portfolio[order.Symbol])
+	}
+	return max(covered, 0)
+}
+
+// placementQuantity returns how much of a new order the account can place.
+// Limit, FOK and queued orders must be covered in full; other orders executing at
+// market are cut down to what the available balances pay for, and only rejected if that is
+// nothing.
+func placementQuantity(account *UserAccount, order *Order) (int, error) {
+	covered := coverableQuantity(account, order)
+	cutDown := order.executesAsMarket() && order.TimeInForce != TimeInForceFOK && !order.Queued
+	if covered == order.Remaining() || (cutDown && covered > 0) {
+		return covered, nil
+	}
+	return 0, holdChange(order).shortfallError()
+}
+
+// releaseChange returns the held funds of an open order's unfilled part to
+// the available balances
+func releaseChange(order *Order) balanceChange {
+	return holdChange(order).negate()
+}
+
+// heldFillChange settles quantity of an open order at fillPrice out of its
+// hold. A buy that fills below its limit gets the difference back as
+// available credits.
+func heldFillChange(order *Order, quantity int, fillPrice money.Amount) balanceChange {
+	change := balanceChange{Username: order.Username, Symbol: order.Symbol}
+	if order.Side == "buy" {
+		held := order.Price.Mul(quantity)
+		change.HeldCredits = -held
+		change.Credits = held - fillPrice.Mul(quantity)
+		change.Shares = quantity
+	} else {
+		change.HeldShares = -quantity
+		change.Credits = fillPrice.Mul(quantity)
+	}
+	return change
+}
+
+// ensureMaps initializes maps that may be missing on accounts created before
+// the field existed
+func ensureMaps(account *UserAccount) {
+	if account.Portfolio == nil {
+		account.Portfolio = make(map[string]int)
+	}
+	if account.HeldShares == nil {
+		account.HeldShares = make(map[string]int)
+	}
+}
+
+// cleanupPosition removes zero entries so the portfolio only lists holdings
+func cleanupPosition(account *UserAccount, symbol string) {
+	if account.Portfolio[symbol] == 0 {
+		delete(account.Portfolio, symbol)
+	}
+	if account.HeldShares[symbol] == 0 {
+		delete(account.HeldShares, symbol)
+	}
+}
+
+// TotalCredits returns available plus held credits
+func (a *UserAccount) TotalCredits() money.Amount {
+	return a.Credits + a.HeldCredits
+}
+
+// TotalShares returns available plus held shares per symbol
+func (a *UserAccount) TotalShares() map[string]int {
+	total := make(map[string]int, len(a.Portfolio))
+	for symbol, qty := range a.Portfolio {
+		total[symbol] += qty
+	}
+	for symbol, qty := range a.HeldShares {
+		total[symbol] += qty
+	}
+	return total
+}
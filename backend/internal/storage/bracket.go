@@ -0,0 +1,65 @@
+package storage
+
+import "stocks-backend/internal/money"
+
+// A bracket is an entry order with up to two exits on the opposite side: a
+// take-profit limit and a stop-loss stop. The exits are stored with the
+// entry as inactive children and hold nothing. When the entry closes they
+// become active for the quantity it filled, or are cancelled if it filled
+// nothing.
+//
+// With both exits present they are a one-cancels-other (OCO) pair closing
+// the same position, so only the take-profit holds funds and the stop-loss
+// is HeldBySibling. As one exit fills the other shrinks to match, and it is
+// cancelled once the first has filled in full. If the take-profit closes any
+// other way the stop-loss takes over the hold, and a triggered stop-loss
+// cancels the take-profit before it executes.
+
+// prepareBracket links exits to their entry order. Exits are given as
+// take-profit, then stop-loss.
+func prepareBracket(entry *Order, exits []*Order) {
+	for _, exit := range exits {
+		prepareOrder(exit)
+		exit.ParentID = entry.ID
+		exit.Status = StatusInactive
+		exit.Quantity = entry.Quantity
+		entry.ChildIDs = append(entry.ChildIDs, exit.ID)
+	}
+	if len(exits) == 2 {
+		exits[0].OCOWith, exits[1].OCOWith = exits[1].ID, exits[0].ID
+		exits[1].HeldBySibling = true
+	}
+}
+
+// activateExit opens an inactive exit for the quantity its entry filled. If
+// the entry filled nothing the exit is cancelled instead and false is
+// returned.
+func activateExit(exit, entry *Order, marketPrice money.Amount) bool {
+	if entry.FilledQuantity == 0 {
+		exit.Status = StatusCancelled
+		exit.RejectReason = "Entry order did not fill"
+		exit.RejectCode = ReasonEntryNotFilled
+		return false
+	}
+	exit.Quantity = entry.FilledQuantity
+	exit.Status = StatusNew
+	if isStopType(exit.OrderType) {
+		initStop(exit, marketPrice)
+	}
+	return true
+}
+
+// handOverHold makes an exit that was held by its sibling hold its own
+// funds, returning the change that does so
+func handOverHold(exit *Order) balanceChange {
+	exit.HeldBySibling = false
+	return holdChange(exit)
+}
+
+// shrinkToSibling resizes an open exit so it covers no more than its filling
+// sibling has left, returning the change that moves its hold to match
+func shrinkToSibling(exit, filling *Order) balanceChange {
+	release := releaseChange(exit)
+	exit.Quantity = min(exit.Quantity, exit.FilledQuantity+filling.Remaining())
+	return release.add(holdChange(exit))
+}
@@ -0,0 +1,65 @@
+package storage
+
+// Listener is told about every order and account a store changes, so the
+// change can be pushed to the user it belongs to. Stores call it after the
+// change is saved and their locks are released, with the latest state of
+// each order and account, orders first.
+type Listener interface {
+	OrderChanged(order Order)
+	AccountChanged(account UserAccount)
+}
+
+// changeSet collects the IDs of the orders and the usernames of the accounts
+// changed while a store's lock is held, each once and in the order they
+// first changed
+type changeSet struct {
+	orders   []string
+	accounts []string
+	seen     map[string]bool
+}
+
+// order records that an order changed
+func (c *changeSet) order(orderID string) {
+	if c.mark("order:" + orderID) {
+		c.orders = append(c.orders, orderID)
+	}
+}
+
+// account records that a user's balances changed
+func (c *changeSet) account(username string) {
+	if c.mark("account:" + username) {
+		c.accounts = append(c.accounts, username)
+	}
+}
+
+// mark records key, reporting whether it is new
+func (c *changeSet) mark(key string) bool {
+	if c.seen == nil {
+		c.seen = make(map[string]bool)
+	}
+	if c.seen[key] {
+		return false
+	}
+	c.seen[key] = true
+	return true
+}
+
+// take returns the collected changes and starts a new set
+func (c *changeSet) take() changeSet {
+	taken := *c
+	*c = changeSet{}
+	return taken
+}
+
+// notify passes changed orders and accounts to listener, if there is one
+func notify(listener Listener, orders []Order, accounts []UserAccount) {
+	if listener == nil {
+		return
+	}
+	for _, order := range orders {
+		listener.OrderChanged(order)
+	}
+	for _, account := range accounts {
+		listener.AccountChanged(account)
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"stocks-backend/internal/money"
+	"time"
+)
+
+// Instrument is a symbol in the catalog of what can be traded. Adding one
+// creates its stock price at StartingPrice. A delisted instrument keeps its
+// price and the positions in it, but can't be traded.
+type Instrument struct {
+	Symbol        string                 `json:"symbol" bson:"_id"`
+	Name          string                 `json:"name" bson:"name"`
+	Logo          string                 `json:"logo" bson:"logo"`
+	TickSize      money.Amount           `json:"tickSize" bson:"tickSize"`       // smallest price increment
+	LotSize       int                    `json:"lotSize" bson:"lotSize"`         // quantities are multiples of it
+	MinQuantity   int                    `json:"minQuantity" bson:"minQuantity"` // smallest order quantity, 0 for none
+	MaxQuantity   int                    `json:"maxQuantity" bson:"maxQuantity"` // largest order quantity, 0 for none
+	StartingPrice money.Amount           `json:"startingPrice" bson:"startingPrice"`
+	Model         map[string]interface{} `json:"model,omitempty" bson:"model,omitempty"` // price model params over the configured ones, see internal/simulation
+	Tradable      bool                   `json:"tradable" bson:"tradable"`
+	CreatedAt     time.Time              `json:"createdAt" bson:"createdAt"`
+	UpdatedAt     time.Time              `json:"updatedAt" bson:"updatedAt"`
+}
+
+// ErrInstrumentExists is returned when adding a symbol already in the catalog
+var ErrInstrumentExists = &OrderError{ReasonInstrumentExists, "Instrument already exists"}
+
+// errDelisted is the reject reason of the orders cancelled by a delisting
+var errDelisted = &OrderError{ReasonDelisted, "Instrument delisted"}
+
+// defaultInstruments returns the catalog every new store is seeded with
+func defaultInstruments() []Instrument {
+	instruments := []Instrument{
+		{Symbol: "AAPL", Name: "Apple Inc.", Logo: "https://logo.clearbit.com/apple.com", StartingPrice: money.FromInt(150)},
+		{Symbol: "TSLA", Name: "Tesla, Inc.", Logo: "https://logo.clearbit.com/tesla.com", StartingPrice: money.FromInt(250)},
+		{Symbol: "AMZN", Name: "Amazon.com, Inc.", Logo: "https://logo.clearbit.com/amazon.com", StartingPrice: money.FromInt(135)},
+		{Symbol: "GOOGL", Name: "Alphabet Inc.", Logo: "https://logo.clearbit.com/google.com", StartingPrice: money.FromInt(140)},
+		{Symbol: "MSFT", Name: "Microsoft Corporation", Logo: "https://logo.clearbit.com/microsoft.com", StartingPrice: money.FromInt(380)},
+		{Symbol: "NVDA", Name: "NVIDIA Corporation", Logo: "https://logo.clearbit.com/nvidia.com", StartingPrice: money.FromInt(495)},
+		{Symbol: "META", Name: "Meta Platforms, Inc.", Logo: "https://logo.clearbit.com/meta.com", StartingPrice: money.FromInt(330)},
+		{Symbol: "NFLX", Name: "Netflix, Inc.", Logo: "https://logo.clearbit.com/netflix.com", StartingPrice: money.FromInt(445)},
+		{Symbol: "AMD", Name: "Advanced Micro Devices", Logo: "https://logo.clearbit.com/amd.com", StartingPrice: money.FromInt(120)},
+		{Symbol: "DIS", Name: "The Walt Disney Company", Logo: "https://logo.clearbit.com/disney.com", StartingPrice: money.FromInt(95)},
+		{Symbol: "INTC", Name: "Intel Corporation", Logo: "https://logo.clearbit.com/intel.com", StartingPrice: money.FromInt(45)},
+		{Symbol: "BABA", Name: "Alibaba Group", Logo: "https://logo.clearbit.com/alibaba.com", StartingPrice: money.FromInt(85)},
+	}
+	for i := range instruments {
+		instruments[i].TickSize = money.Cent
+		instruments[i].LotSize = 1
+		instruments[i].MinQuantity = 1
+		instruments[i].MaxQuantity = 100000
+		instruments[i].Tradable = true
+	}
+	return instruments
+}
+
+// newStockPrice returns the price of a newly added instrument
+func newStockPrice(instrument *Instrument) StockPrice {
+	price := instrument.StartingPrice
+	return StockPrice{
+		Symbol:       instrument.Symbol,
+		Price:        price,
+		PriceHistory: []money.Amount{price},
+		Logo:         instrument.Logo,
+		Name:         instrument.Name,
+		DayHigh:      price,
+		DayLow:       price,
+		DayOpen:      price,
+	}
+}
+
+// copyInstrument returns a copy so callers can't mutate stored state
+func copyInstrument(instrument *Instrument) Instrument {
+	c := *instrument
+	if instrument.Model != nil {
+		c.Model = make(map[string]interface{}, len(instrument.Model))
+		for key, value := range instrument.Model {
+			c.Model[key] = value
+		}
+	}
+	return c
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"stocks-backend/internal/money"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The ledger is an append-only double-entry journal of every movement of
+// cash or shares into or out of a user's account: fills, deposits,
+// withdrawals, fees and admin adjustments. Each entry's postings sum to
+// zero per asset, the other side being one of the house accounts below.
+// Holds only move balances within an account, between available and held,
+// so they aren't journaled; the ledger balance of a user is their total
+// credits and shares. Reconcile checks the accounts against it.
+
+// Ledger accounts other than the users', which are "user:<username>"
+const (
+	LedgerMarket      = "market"      // the other side of every fill
+	LedgerExternal    = "external"    // cash deposited and withdrawn
+	LedgerFees        = "fees"        // fees charged
+	LedgerAdjustments = "adjustments" // corrections made by admins
+)
+
+// Ledger entry kinds
+const (
+	EntryFill       = "fill"
+	EntryDeposit    = "deposit"
+	EntryWithdrawal = "withdrawal"
+	EntryFee        = "fee"
+	EntryAdjustment = "adjustment"
+	EntryOpening    = "opening" // balances of an account from before the ledger
+)
+
+// LedgerEntry is one balanced journal entry
+type LedgerEntry struct {
+	ID        string    `json:"id" bson:"_id"`
+	Kind      string    `json:"kind" bson:"kind"`
+	Username  string    `json:"username" bson:"username"`
+	OrderID   string    `json:"orderId,omitempty" bson:"orderId,omitempty"` // fills
+	TradeID   string    `json:"tradeId,omitempty" bson:"tradeId,omitempty"` // fills
+	Memo      string    `json:"memo,omitempty" bson:"memo,omitempty"`
+	Postings  []Posting `json:"postings" bson:"postings"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// Posting moves cash, or shares of Symbol, into (positive) or out of
+// (negative) a ledger account
+type Posting struct {
+	Account  string       `json:"account" bson:"account"`
+	Symbol   string       `json:"symbol,omitempty" bson:"symbol,omitempty"`
+	Amount   money.Amount `json:"amount,omitempty" bson:"amount,omitempty"`     // cash
+	Quantity int          `json:"quantity,omitempty" bson:"quantity,omitempty"` // shares of Symbol
+}
+
+// Adjustment is a movement of cash or shares an admin posts to an account.
+// Deposits, withdrawals and fees move Credits, which must be positive;
+// adjustments move Credits and/or Shares of Symbol, either way.
+type Adjustment struct {
+	Username string
+	Kind     string // EntryDeposit, EntryWithdrawal, EntryFee or EntryAdjustment
+	Credits  money.Amount
+	Symbol   string
+	Shares   int
+	Memo     string
+}
+
+// userLedgerAccount returns the ledger account of a user
+func userLedgerAccount(username string) string {
+	return "user:" + username
+}
+
+// newLedgerEntry journals a change to a user's balances against
+// counterparty. Only the change to the user's totals is posted.
+func newLedgerEntry(kind string, change balanceChange, counterparty string, at time.Time) LedgerEntry {
+	entry := LedgerEntry{
+		ID:        primitive.NewObjectID().Hex(),
+		Kind:      kind,
+		Username:  change.Username,
+		CreatedAt: at,
+	}
+	user := userLedgerAccount(change.Username)
+	if cash := change.Credits + change.HeldCredits; cash != 0 {
+		entry.Postings = append(entry.Postings,
+			Posting{Account: user, Amount: cash},
+			Posting{Account: counterparty, Amount: -cash})
+	}
+	if shares := change.Shares + change.HeldShares; shares != 0 {
+		entry.Postings = append(entry.Postings,
+			Posting{Account: user, Symbol: change.Symbol, Quantity: shares},
+			Posting{Account: counterparty, Symbol: change.Symbol, Quantity: -shares})
+	}
+	return entry
+}
+
+// fillEntry journals one side of a fill settled by change
+func fillEntry(change balanceChange, trade Trade) LedgerEntry {
+	entry := newLedgerEntry(EntryFill, change, LedgerMarket, trade.ExecutedAt)
+	entry.OrderID, entry.TradeID = trade.OrderID, trade.ID
+	return entry
+}
+
+// openingEntry journals the balances account already has
+func openingEntry(account *UserAccount, at time.Time) LedgerEntry {
+	entry := newLedgerEntry(EntryOpening, balanceChange{Username: account.Username, Credits: account.TotalCredits()}, LedgerExternal, at)
+	for _, symbol := range sortedSymbols(account.TotalShares()) {
+		shares := newLedgerEntry(EntryOpening, balanceChange{
+			Username: account.Username,
+			Symbol:   symbol,
+			Shares:   account.TotalShares()[symbol],
+		}, LedgerExternal, at)
+		entry.Postings = append(entry.Postings, shares.Postings...)
+	}
+	return entry
+}
+
+// change returns the balance change an adjustment makes and the ledger
+// account on its other side
+func (a Adjustment) change() (balanceChange, string, error) {
+	change := balanceChange{Username: a.Username, Symbol: a.Symbol}
+	invalid := func(message string) (balanceChange, string, error) {
+		return balanceChange{}, "", &OrderError{ReasonInvalidAdjustment, message}
+	}
+
+	switch a.Kind {
+	case EntryDeposit, EntryWithdrawal, EntryFee:
+		if a.Credits <= 0 || a.Symbol != "" || a.Shares != 0 {
+			return invalid("Deposits, withdrawals and fees move a positive amount of credits only")
+		}
+	case EntryAdjustment:
+		if a.Credits == 0 && a.Shares == 0 {
+			return invalid("An adjustment must move credits or shares")
+		}
+		if (a.Symbol == "") != (a.Shares == 0) {
+			return invalid("Shares must be adjusted with a symbol")
+		}
+	default:
+		return invalid("Kind must be 'deposit', 'withdrawal', 'fee' or 'adjustment'")
+	}
+
+	switch a.Kind {
+	case EntryDeposit:
+		change.Credits = a.Credits
+		return change, LedgerExternal, nil
+	case EntryWithdrawal:
+		change.Credits = -a.Credits
+		return change, LedgerExternal, nil
+	case EntryFee:
+		change.Credits = -a.Credits
+		return change, LedgerFees, nil
+	default:
+		change.Credits, change.Shares = a.Credits, a.Shares
+		return change, LedgerAdjustments, nil
+	}
+}
+
+// adjustmentEntry journals an adjustment applied as change
+func adjustmentEntry(a Adjustment, change balanceChange, counterparty string, at time.Time) LedgerEntry {
+	entry := newLedgerEntry(a.Kind, change, counterparty, at)
+	entry.Memo = a.Memo
+	return entry
+}
+
+// copyLedgerEntry returns a copy so callers can't mutate stored state
+func copyLedgerEntry(entry *LedgerEntry) LedgerEntry {
+	c := *entry
+	c.Postings = append([]Posting(nil), entry.Postings...)
+	return c
+}
+
+// Reconciliation is the result of checking every account against the
+// ledger
+type Reconciliation struct {
+	Accounts   int        `json:"accounts"`   // accounts checked
+	Entries    int        `json:"entries"`    // ledger entries read
+	Unbalanced []string   `json:"unbalanced"` // IDs of entries whose postings don't sum to zero
+	Mismatches []Mismatch `json:"mismatches"`
+	CheckedAt  time.Time  `json:"checkedAt"`
+}
+
+// Mismatch is a balance whose account and ledger values differ. Symbol is
+// set for a share balance, whose values are whole numbers of shares.
+type Mismatch struct {
+	Username string       `json:"username"`
+	Symbol   string       `json:"symbol,omitempty"`
+	Ledger   money.Amount `json:"ledger"`
+	Account  money.Amount `json:"account"`
+}
+
+// ledgerBalance is a user's total credits and shares according to the
+// ledger
+type ledgerBalance struct {
+	Credits money.Amount
+	Shares  map[string]int
+}
+
+// ledgerBalances sums the postings to user accounts, by username
+func ledgerBalances(postings []Posting) map[string]*ledgerBalance {
+	balances := make(map[string]*ledgerBalance)
+	for _, posting := range postings {
+		username, isUser := strings.CutPrefix(posting.Account, "user:")
+		if !isUser {
+			continue
+		}
+		balance, exists := balances[username]
+		if !exists {
+			balance = &ledgerBalance{Shares: make(map[string]int)}
+			balances[username] = balance
+		}
+		if posting.Symbol == "" {
+			balance.Credits += posting.Amount
+		} else {
+			balance.Shares[posting.Symbol] += posting.Quantity
+		}
+	}
+	return balances
+}
+
+// balanced reports whether an entry's postings sum to zero per asset
+func (e *LedgerEntry) balanced() bool {
+	cash := money.Amount(0)
+	shares := make(map[string]int)
+	for _, posting := range e.Postings {
+		cash += posting.Amount
+		shares[posting.Symbol] += posting.Quantity
+	}
+	for _, quantity := range shares {
+		if quantity != 0 {
+			return false
+		}
+	}
+	return cash == 0
+}
+
+// reconcile compares accounts with their ledger balances
+func reconcile(accounts []UserAccount, balances map[string]*ledgerBalance) []Mismatch {
+	mismatches := []Mismatch{}
+	checked := make(map[string]bool, len(accounts))
+	compare := func(username string, account *UserAccount, balance *ledgerBalance) {
+		if balance == nil {
+			balance = &ledgerBalance{}
+		}
+		if account.TotalCredits() != balance.Credits {
+			mismatches = append(mismatches, Mismatch{Username: username, Ledger: balance.Credits, Account: account.TotalCredits()})
+		}
+		totalShares := account.TotalShares()
+		symbols := sortedSymbols(totalShares)
+		for symbol := range balance.Shares {
+			if _, held := totalShares[symbol]; !held {
+				symbols = append(symbols, symbol)
+			}
+		}
+		sort.Strings(symbols)
+		for _, symbol := range symbols {
+			if ledger, held := balance.Shares[symbol], totalShares[symbol]; ledger != held {
+				mismatches = append(mismatches, Mismatch{
+					Username: username,
+					Symbol:   symbol,
+					Ledger:   money.FromInt(int64(ledger)),
+					Account:  money.FromInt(int64(held)),
+				})
+			}
+		}
+	}
+
+	for i := range accounts {
+		checked[accounts[i].Username] = true
+		compare(accounts[i].Username, &accounts[i], balances[accounts[i].Username])
+	}
+	// Ledger balances of users without an account
+	var orphans []string
+	for username := range balances {
+		if !checked[username] {
+			orphans = append(orphans, username)
+		}
+	}
+	sort.Strings(orphans)
+	for _, username := range orphans {
+		compare(username, &UserAccount{Username: username}, balances[username])
+	}
+	return mismatches
+}
+
+// sortedSymbols returns the symbols of a share balance map in order
+func sortedSymbols(shares map[string]int) []string {
+	symbols := make([]string, 0, len(shares))
+	for symbol := range shares {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
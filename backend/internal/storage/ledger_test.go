@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"stocks-backend/internal/money"
+)
+
+func TestBalanced(t *testing.T) {
+	tests := []struct {
+		name     string
+		postings []Posting
+		want     bool
+	}{
+		{"no postings", nil, true},
+		{"cash", []Posting{{Account: "user:a", Amount: 100}, {Account: LedgerExternal, Amount: -100}}, true},
+		{"cash off by a unit", []Posting{{Account: "user:a", Amount: 100}, {Account: LedgerExternal, Amount: -99}}, false},
+		{"shares", []Posting{
+			{Account: "user:a", Symbol: "AAPL", Quantity: 5},
+			{Account: LedgerMarket, Symbol: "AAPL", Quantity: -5},
+		}, true},
+		{"shares of different symbols", []Posting{
+			{Account: "user:a", Symbol: "AAPL", Quantity: 5},
+			{Account: LedgerMarket, Symbol: "MSFT", Quantity: -5},
+		}, false},
+		{"cash against shares", []Posting{
+			{Account: "user:a", Amount: 5},
+			{Account: LedgerMarket, Symbol: "AAPL", Quantity: -5},
+		}, false},
+	}
+	for _, tt := range tests {
+		entry := LedgerEntry{Postings: tt.postings}
+		if got := entry.balanced(); got != tt.want {
+			t.Errorf("%s: balanced() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFillEntries(t *testing.T) {
+	s := NewMemoryStorage(CostAverage)
+	s.CreateAccount("buyer", "secret")
+	s.CreateAccount("seller", "secret")
+	if _, err := s.AdjustAccount(Adjustment{Username: "seller", Kind: EntryAdjustment, Symbol: "AAPL", Shares: 10}); err != nil {
+		t.Fatalf("AdjustAccount: %v", err)
+	}
+
+	ask := Order{ID: "ask", Username: "seller", Symbol: "AAPL", Side: "sell", OrderType: "limit", Quantity: 10, Price: money.FromInt(151)}
+	if err := s.PlaceOrder(&ask); err != nil {
+		t.Fatalf("PlaceOrder(ask): %v", err)
+	}
+	bid := Order{ID: "bid", Username: "buyer", Symbol: "AAPL", Side: "buy", OrderType: "limit", Quantity: 4, Price: money.FromInt(152)}
+	if err := s.PlaceOrder(&bid); err != nil {
+		t.Fatalf("PlaceOrder(bid): %v", err)
+	}
+
+	cost := money.FromInt(151 * 4)
+	want := map[string][]Posting{
+		"bid": {
+			{Account: "user:buyer", Amount: -cost},
+			{Account: LedgerMarket, Amount: cost},
+			{Account: "user:buyer", Symbol: "AAPL", Quantity: 4},
+			{Account: LedgerMarket, Symbol: "AAPL", Quantity: -4},
+		},
+		"ask": {
+			{Account: "user:seller", Amount: cost},
+			{Account: LedgerMarket, Amount: -cost},
+			{Account: "user:seller", Symbol: "AAPL", Quantity: -4},
+			{Account: LedgerMarket, Symbol: "AAPL", Quantity: 4},
+		},
+	}
+	fills := 0
+	for _, entry := range s.GetLedger("") {
+		if entry.Kind != EntryFill {
+			continue
+		}
+		fills++
+		if !entry.balanced() {
+			t.Errorf("fill entry for %s is unbalanced: %+v", entry.OrderID, entry.Postings)
+		}
+		if entry.TradeID == "" {
+			t.Errorf("fill entry for %s has no trade", entry.OrderID)
+		}
+		if !reflect.DeepEqual(entry.Postings, want[entry.OrderID]) {
+			t.Errorf("fill entry for %s = %+v, want %+v", entry.OrderID, entry.Postings, want[entry.OrderID])
+		}
+	}
+	if fills != 2 {
+		t.Errorf("%d fill entries, want one per side", fills)
+	}
+
+	result, err := s.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(result.Mismatches) != 0 || len(result.Unbalanced) != 0 {
+		t.Errorf("Reconcile = %+v, want the accounts to match the ledger", result)
+	}
+}
+
+func TestAdjustmentChange(t *testing.T) {
+	credits := money.FromInt(50)
+	tests := []struct {
+		name             string
+		adjustment       Adjustment
+		wantChange       balanceChange
+		wantCounterparty string
+		wantErr          bool
+	}{
+		{
+			name:             "deposit",
+			adjustment:       Adjustment{Username: "a", Kind: EntryDeposit, Credits: credits},
+			wantChange:       balanceChange{Username: "a", Credits: credits},
+			wantCounterparty: LedgerExternal,
+		},
+		{
+			name:             "withdrawal",
+			adjustment:       Adjustment{Username: "a", Kind: EntryWithdrawal, Credits: credits},
+			wantChange:       balanceChange{Username: "a", Credits: -credits},
+			wantCounterparty: LedgerExternal,
+		},
+		{
+			name:             "fee",
+			adjustment:       Adjustment{Username: "a", Kind: EntryFee, Credits: credits},
+			wantChange:       balanceChange{Username: "a", Credits: -credits},
+			wantCounterparty: LedgerFees,
+		},
+		{
+			name:             "adjustment of credits",
+			adjustment:       Adjustment{Username: "a", Kind: EntryAdjustment, Credits: -credits},
+			wantChange:       balanceChange{Username: "a", Credits: -credits},
+			wantCounterparty: LedgerAdjustments,
+		},
+		{
+			name:             "adjustment of shares",
+			adjustment:       Adjustment{Username: "a", Kind: EntryAdjustment, Symbol: "AAPL", Shares: -3},
+			wantChange:       balanceChange{Username: "a", Symbol: "AAPL", Shares: -3},
+			wantCounterparty: LedgerAdjustments,
+		},
+		{
+			name:       "deposit of nothing",
+			adjustment: Adjustment{Username: "a", Kind: EntryDeposit},
+			wantErr:    true,
+		},
+		{
+			name:       "negative withdrawal",
+			adjustment: Adjustment{Username: "a", Kind: EntryWithdrawal, Credits: -credits},
+			wantErr:    true,
+		},
+		{
+			name:       "fee in shares",
+			adjustment: Adjustment{Username: "a", Kind: EntryFee, Credits: credits, Symbol: "AAPL", Shares: 1},
+			wantErr:    true,
+		},
+		{
+			name:       "adjustment of nothing",
+			adjustment: Adjustment{Username: "a", Kind: EntryAdjustment},
+			wantErr:    true,
+		},
+		{
+			name:       "shares without a symbol",
+			adjustment: Adjustment{Username: "a", Kind: EntryAdjustment, Shares: 3},
+			wantErr:    true,
+		},
+		{
+			name:       "symbol without shares",
+			adjustment: Adjustment{Username: "a", Kind: EntryAdjustment, Credits: credits, Symbol: "AAPL"},
+			wantErr:    true,
+		},
+		{
+			name:       "unknown kind",
+			adjustment: Adjustment{Username: "a", Kind: EntryFill, Credits: credits},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change, counterparty, err := tt.adjustment.change()
+			if tt.wantErr {
+				var orderErr *OrderError
+				if !errors.As(err, &orderErr) || orderErr.Code != ReasonInvalidAdjustment {
+					t.Errorf("change() error = %v, want %s", err, ReasonInvalidAdjustment)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("change(): %v", err)
+			}
+			if change != tt.wantChange || counterparty != tt.wantCounterparty {
+				t.Errorf("change() = %+v against %s, want %+v against %s", change, counterparty, tt.wantChange, tt.wantCounterparty)
+			}
+		})
+	}
+}
+
+func TestAdjustAccount(t *testing.T) {
+	s := NewMemoryStorage(CostAverage)
+	s.CreateAccount("alice", "secret")
+
+	tests := []struct {
+		name       string
+		adjustment Adjustment
+		wantCode   string
+	}{
+		{"deposit", Adjustment{Username: "alice", Kind: EntryDeposit, Credits: money.FromInt(500)}, ""},
+		{"fee", Adjustment{Username: "alice", Kind: EntryFee, Credits: money.FromInt(25)}, ""},
+		{"shares", Adjustment{Username: "alice", Kind: EntryAdjustment, Symbol: "AAPL", Shares: 8}, ""},
+		{"withdrawal past the balance", Adjustment{Username: "alice", Kind: EntryWithdrawal, Credits: money.FromInt(1_000_000)}, ReasonInsufficientCredits},
+		{"shares taken past the holding", Adjustment{Username: "alice", Kind: EntryAdjustment, Symbol: "AAPL", Shares: -9}, ReasonInsufficientShares},
+		{"invalid", Adjustment{Username: "alice", Kind: EntryWithdrawal}, ReasonInvalidAdjustment},
+		{"unknown account", Adjustment{Username: "bob", Kind: EntryDeposit, Credits: money.FromInt(5)}, ReasonAccountNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := s.AdjustAccount(tt.adjustment)
+			if tt.wantCode != "" {
+				var orderErr *OrderError
+				if !errors.As(err, &orderErr) || orderErr.Code != tt.wantCode {
+					t.Errorf("AdjustAccount error = %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AdjustAccount: %v", err)
+			}
+			if entry.Kind != tt.adjustment.Kind || !entry.balanced() {
+				t.Errorf("entry = %+v, want a balanced %s", entry, tt.adjustment.Kind)
+			}
+		})
+	}
+
+	account := s.GetAccount("alice")
+	if want := startingCredits + money.FromInt(475); account.Credits != want {
+		t.Errorf("credits = %s, want %s", account.Credits, want)
+	}
+	if account.Portfolio["AAPL"] != 8 {
+		t.Errorf("AAPL shares = %d, want 8", account.Portfolio["AAPL"])
+	}
+	if entries := s.GetLedger("alice"); len(entries) != 4 {
+		t.Errorf("%d ledger entries, want the starting deposit and 3 adjustments", len(entries))
+	}
+	result, err := s.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(result.Mismatches) != 0 {
+		t.Errorf("mismatches = %+v, want none", result.Mismatches)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	s := NewMemoryStorage(CostAverage)
+	s.CreateAccount("alice", "secret")
+	s.CreateAccount("bob", "secret")
+	s.CreateAccount("carol", "secret")
+	for _, adjustment := range []Adjustment{
+		{Username: "alice", Kind: EntryAdjustment, Symbol: "AAPL", Shares: 10},
+		{Username: "alice", Kind: EntryAdjustment, Symbol: "MSFT", Shares: 4},
+		{Username: "bob", Kind: EntryAdjustment, Symbol: "AAPL", Shares: 2},
+	} {
+		if _, err := s.AdjustAccount(adjustment); err != nil {
+			t.Fatalf("AdjustAccount: %v", err)
+		}
+	}
+
+	// Change balances behind the ledger's back
+	s.users["alice"].HeldShares["AAPL"] = 3    // 13 in all
+	delete(s.users["alice"].Portfolio, "MSFT") // held in the ledger only
+	s.users["alice"].Portfolio["GOOGL"] = 1    // held in the account only
+	s.users["carol"].HeldCredits = money.Cent  // credits off by a cent
+	delete(s.users, "bob")                     // ledger balances without an account
+	unbalanced := LedgerEntry{ID: "broken", Kind: EntryAdjustment, Username: "carol", CreatedAt: time.Now(),
+		Postings: []Posting{{Account: LedgerAdjustments, Amount: money.One}}}
+	s.ledger = append(s.ledger, unbalanced)
+
+	result, err := s.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if result.Accounts != 2 || result.Entries != 7 {
+		t.Errorf("checked %d accounts and %d entries, want 2 and 7", result.Accounts, result.Entries)
+	}
+	if !reflect.DeepEqual(result.Unbalanced, []string{"broken"}) {
+		t.Errorf("unbalanced = %v, want [broken]", result.Unbalanced)
+	}
+	want := []Mismatch{
+		{Username: "alice", Symbol: "AAPL", Ledger: money.FromInt(10), Account: money.FromInt(13)},
+		{Username: "alice", Symbol: "GOOGL", Ledger: 0, Account: money.FromInt(1)},
+		{Username: "alice", Symbol: "MSFT", Ledger: money.FromInt(4), Account: 0},
+		{Username: "carol", Ledger: startingCredits, Account: startingCredits + money.Cent},
+		{Username: "bob", Ledger: startingCredits, Account: 0},
+		{Username: "bob", Symbol: "AAPL", Ledger: money.FromInt(2), Account: 0},
+	}
+	if !reflect.DeepEqual(result.Mismatches, want) {
+		t.Errorf("mismatches = %+v, want %+v", result.Mismatches, want)
+	}
+}
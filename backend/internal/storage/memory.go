@@ -0,0 +1,972 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"stocks-backend/internal/money"
+	"stocks-backend/internal/orderbook"
+	"sync"
+	"time"
+)
+
+// MemoryStorage provides process-local storage with no external dependencies.
+// Data is lost when the process exits, which makes it suitable for local
+// development and tests.
+type MemoryStorage struct {
+	users       map[string]*UserAccount
+	orders      []*Order // in creation order
+	orderIndex  map[string]*Order
+	trades      []Trade
+	ledger      []LedgerEntry // append-only
+	stops       stopList      // stop orders waiting to trigger
+	queued      stopList      // orders waiting for their symbol to trade
+	prices      map[string]*StockPrice
+	instruments map[string]*Instrument
+	symbols     []string // keeps GetAllPrices and GetInstruments in the order added
+	engine      *orderbook.Engine
+	changes     changeSet // orders and accounts changed under mutex
+	listener    Listener
+	costBasis   CostBasisMethod
+	mutex       sync.RWMutex
+}
+
+// NewMemoryStorage creates a new in-memory storage instance seeded with the
+// default instruments, whose positions take the cost of shares sold by
+// costBasis
+func NewMemoryStorage(costBasis CostBasisMethod) *MemoryStorage {
+	storage := &MemoryStorage{
+		costBasis:   costBasis,
+		users:       make(map[string]*UserAccount),
+		orderIndex:  make(map[string]*Order),
+		prices:      make(map[string]*StockPrice),
+		instruments: make(map[string]*Instrument),
+		stops:       make(stopList),
+		queued:      make(stopList),
+		engine:      orderbook.NewEngine(),
+	}
+
+	now := time.Now()
+	for _, instrument := range defaultInstruments() {
+		instrument := instrument
+		instrument.CreatedAt, instrument.UpdatedAt = now, now
+		storage.addInstrument(&instrument)
+	}
+
+	return storage
+}
+
+// SetListener sets the listener told about order and account changes
+func (s *MemoryStorage) SetListener(listener Listener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listener = listener
+}
+
+// unlock releases s.mutex and tells the listener about the orders and
+// accounts changed while it was held
+func (s *MemoryStorage) unlock() {
+	changes := s.changes.take()
+	orders := make([]Order, 0, len(changes.orders))
+	for _, id := range changes.orders {
+		orders = append(orders, *s.orderIndex[id])
+	}
+	accounts := make([]UserAccount, 0, len(changes.accounts))
+	for _, username := range changes.accounts {
+		accounts = append(accounts, *copyAccount(s.users[username]))
+	}
+	listener := s.listener
+	s.mutex.Unlock()
+
+	notify(listener, orders, accounts)
+}
+
+// copyAccount returns a deep copy so callers can't mutate stored state
+func copyAccount(account *UserAccount) *UserAccount {
+	c := *account
+	c.Portfolio = make(map[string]int, len(account.Portfolio))
+	for symbol, qty := range account.Portfolio {
+		c.Portfolio[symbol] = qty
+	}
+	c.HeldShares = make(map[string]int, len(account.HeldShares))
+	for symbol, qty := range account.HeldShares {
+		c.HeldShares[symbol] = qty
+	}
+	c.Positions = make(map[string]Position, len(account.Positions))
+	for symbol, position := range account.Positions {
+		c.Positions[symbol] = copyPosition(position)
+	}
+	return &c
+}
+
+// copyPrice returns a deep copy so callers can't mutate stored state
+func copyPrice(price *StockPrice) StockPrice {
+	c := *price
+	c.PriceHistory = append([]money.Amount(nil), price.PriceHistory...)
+	return c
+}
+
+// CreateAccount creates a new user account with initial credits
+func (s *MemoryStorage) CreateAccount(username, password string) *UserAccount {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.users[username]; exists {
+		return nil // Account already exists
+	}
+
+	account := &UserAccount{
+		Username:     username,
+		PasswordHash: hashPassword(password),
+		Credits:      startingCredits,
+		Portfolio:    make(map[string]int),
+		HeldShares:   make(map[string]int),
+		Positions:    make(map[string]Position),
+	}
+	s.users[username] = account
+	deposit := newLedgerEntry(EntryDeposit, balanceChange{Username: username, Credits: startingCredits}, LedgerExternal, time.Now())
+	deposit.Memo = "Starting credits"
+	s.ledger = append(s.ledger, deposit)
+
+	return copyAccount(account)
+}
+
+// ValidatePassword checks if the provided password matches the stored hash
+func (s *MemoryStorage) ValidatePassword(username, password string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	account, exists := s.users[username]
+	if !exists {
+		return false
+	}
+
+	return account.PasswordHash == hashPassword(password)
+}
+
+// GetAccount returns a user's account
+func (s *MemoryStorage) GetAccount(username string) *UserAccount {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	account, exists := s.users[username]
+	if !exists {
+		return nil
+	}
+
+	return copyAccount(account)
+}
+
+// PlaceOrder validates and stores a new order, reserves its funds and routes
+// it through the symbol's order book. Market orders are priced at the
+// current price and fill as much as the account can pay for; limit orders
+// rest in the book until matched and stop orders wait until they trigger.
+// Orders the account can't cover are stored as rejected and the reason is
+// returned.
+func (s *MemoryStorage) PlaceOrder(order *Order) error {
+	return s.PlaceBracket(order, nil)
+}
+
+// PlaceBracket places an entry order like PlaceOrder, storing its exits as
+// inactive children that activate once it fills
+func (s *MemoryStorage) PlaceBracket(order *Order, exits []*Order) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	prepareOrder(order)
+	prepareBracket(order, exits)
+
+	stock, exists := s.prices[order.Symbol]
+	if !exists {
+		return ErrStockNotFound
+	}
+	account, exists := s.users[order.Username]
+	if !exists {
+		return &OrderError{ReasonAccountNotFound, "Account not found"}
+	}
+	if order.OrderType == "market" {
+		order.Price = stock.Price.Round(money.Cent)
+	}
+	if isStopType(order.OrderType) {
+		initStop(order, stock.Price)
+	}
+	order.Status = StatusNew
+
+	stored := *order
+	s.orders = append(s.orders, &stored)
+	s.orderIndex[stored.ID] = &stored
+	s.changes.order(stored.ID)
+	for _, exit := range exits {
+		storedExit := *exit
+		s.orders = append(s.orders, &storedExit)
+		s.orderIndex[storedExit.ID] = &storedExit
+		s.changes.order(storedExit.ID)
+	}
+
+	quantity, err := placementQuantity(account, &stored)
+	if err == nil {
+		err = s.applyChange(holdChangeFor(&stored, quantity))
+	}
+	if err != nil {
+		rejectOrder(&stored, err)
+		s.resolveChildren(&stored) // only cancels the exits, nothing filled
+		*order = stored
+		return err
+	}
+
+	switch {
+	case stored.awaitingRelease():
+		s.queued.add(&stored)
+	case stored.awaitingTrigger():
+		s.stops.add(&stored)
+		err = s.triggerStops(stored.Symbol, stock.Price)
+	default:
+		err = s.submit(&stored, quantity, stock.Price)
+	}
+
+	*order = stored
+	return followUp(err)
+}
+
+// submit routes quantity of an open order through its book and settles the
+// fills. If the order must not rest, the hold on whatever did not fill is
+// released. The caller must hold s.mutex.
+func (s *MemoryStorage) submit(order *Order, quantity int, marketPrice money.Amount) error {
+	filledBefore := order.FilledQuantity
+	entry := bookOrder(order)
+	entry.Quantity = quantity
+	err := s.settleFills(s.engine.Submit(order.Symbol, entry, marketPrice))
+
+	if closeUnfilled(order) {
+		s.changes.order(order.ID)
+		unfilled := quantity - (order.FilledQuantity - filledBefore)
+		err = errors.Join(err, s.applyChange(holdChangeFor(order, unfilled).negate()), s.resolveChildren(order))
+	}
+	return err
+}
+
+// openSibling returns the open OCO sibling of a bracket exit, or nil. The
+// caller must hold s.mutex.
+func (s *MemoryStorage) openSibling(order *Order) *Order {
+	sibling, exists := s.orderIndex[order.OCOWith]
+	if order.OCOWith == "" || !exists || !sibling.IsOpen() {
+		return nil
+	}
+	return sibling
+}
+
+// resolveChildren activates the exits of a bracket entry once it has
+// closed, or cancels them if it filled nothing. All exits hold their funds
+// before any is submitted, so one that fills at once can cancel its sibling.
+// The caller must hold s.mutex.
+func (s *MemoryStorage) resolveChildren(entry *Order) error {
+	if entry.IsOpen() || len(entry.ChildIDs) == 0 {
+		return nil
+	}
+	marketPrice := s.prices[entry.Symbol].Price
+
+	var active []*Order
+	for _, id := range entry.ChildIDs {
+		exit := s.orderIndex[id]
+		if exit.Status != StatusInactive {
+			continue
+		}
+		s.changes.order(exit.ID)
+		if !activateExit(exit, entry, marketPrice) {
+			continue
+		}
+		if exit.HeldBySibling && s.openSibling(exit) == nil {
+			exit.HeldBySibling = false
+		}
+		if err := s.applyChange(holdChange(exit)); err != nil {
+			rejectOrder(exit, err)
+			continue
+		}
+		active = append(active, exit)
+	}
+
+	var errs []error
+	waiting := false
+	for _, exit := range active {
+		if exit.awaitingTrigger() {
+			s.stops.add(exit)
+			waiting = true
+		} else if exit.IsOpen() {
+			errs = append(errs, s.submit(exit, exit.Remaining(), marketPrice))
+		}
+	}
+	if waiting {
+		errs = append(errs, s.triggerStops(entry.Symbol, marketPrice))
+	}
+	return errors.Join(errs...)
+}
+
+// fillSibling keeps a filling bracket exit's OCO sibling in step: it shrinks
+// to what the exit has left and is cancelled once the exit has filled. The
+// caller must hold s.mutex.
+func (s *MemoryStorage) fillSibling(exit *Order) error {
+	sibling := s.openSibling(exit)
+	if sibling == nil {
+		return nil
+	}
+	if exit.Remaining() == 0 {
+		return s.closeOrder(sibling, StatusCancelled, errSiblingFilled)
+	}
+
+	if err := s.applyChange(shrinkToSibling(sibling, exit)); err != nil {
+		return err
+	}
+	s.changes.order(sibling.ID)
+	// A resting sibling goes to the back of its level with the new quantity
+	if resting, inBook := s.engine.Cancel(sibling.Symbol, sibling.ID); inBook {
+		resting.Quantity = sibling.Remaining()
+		s.engine.Add(sibling.Symbol, resting)
+	}
+	return nil
+}
+
+// triggerStops trails symbol's waiting stop orders to the market price and
+// submits the ones it triggers. The caller must hold s.mutex.
+func (s *MemoryStorage) triggerStops(symbol string, marketPrice money.Amount) error {
+	var errs []error
+	for _, order := range s.stops.waiting(symbol) {
+		if trailStop(order, marketPrice) {
+			s.changes.order(order.ID)
+		}
+		if !stopTriggered(order, marketPrice) {
+			continue
+		}
+		s.stops.remove(symbol, order.ID)
+		s.changes.order(order.ID)
+
+		// A stop-loss closes the position itself, so its take-profit goes
+		if sibling := s.openSibling(order); sibling != nil && order.HeldBySibling {
+			if err := s.closeOrder(sibling, StatusCancelled, errSiblingTriggered); err != nil {
+				errs = append(errs, fmt.Errorf("trigger order %s: %w", order.ID, err))
+				continue
+			}
+		}
+
+		change, quantity, rejectErr := triggerStop(s.users[order.Username], order, marketPrice)
+		if err := s.applyChange(change); err != nil {
+			errs = append(errs, fmt.Errorf("trigger order %s: %w", order.ID, err))
+			continue
+		}
+		if rejectErr != nil {
+			rejectOrder(order, rejectErr)
+			continue
+		}
+		if err := s.submit(order, quantity, marketPrice); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyChange applies a balance change to the stored account. A zero
+// change does nothing. The caller must hold s.mutex.
+func (s *MemoryStorage) applyChange(change balanceChange) error {
+	if change.isZero() {
+		return nil
+	}
+	account, exists := s.users[change.Username]
+	if !exists {
+		return &OrderError{ReasonAccountNotFound, "Account not found"}
+	}
+	if err := change.apply(account); err != nil {
+		return err
+	}
+	s.changes.account(change.Username)
+	return nil
+}
+
+// settleFills applies order book fills to the orders and accounts on each
+// side. Both sides of a fill are checked before either is settled, so a
+// fill settles in full or not at all. The book already took the fills out
+// of the resting orders, so the orders of a fill that fails to settle are
+// put back as they are stored. The caller must hold s.mutex.
+func (s *MemoryStorage) settleFills(fills []orderbook.Fill) error {
+	var errs []error
+	var failed []orderbook.Fill
+	for _, fill := range fills {
+		var orderIDs []string
+		for _, orderID := range []string{fill.BuyOrderID, fill.SellOrderID} {
+			if orderID != orderbook.MarketOrderID {
+				orderIDs = append(orderIDs, orderID)
+			}
+		}
+
+		settled := true
+		for _, orderID := range orderIDs {
+			if err := s.checkOrderFill(orderID, fill.Quantity, fill.Price); err != nil {
+				errs = append(errs, fmt.Errorf("fill order %s: %w", orderID, err))
+				settled = false
+			}
+		}
+		if settled {
+			for _, orderID := range orderIDs {
+				if err := s.settleOrderFill(orderID, fill.Quantity, fill.Price); err != nil {
+					errs = append(errs, fmt.Errorf("fill order %s: %w", orderID, err))
+					settled = false
+				}
+			}
+		}
+		if !settled {
+			failed = append(failed, fill)
+		}
+	}
+
+	for _, orderID := range fillOrderIDs(failed) {
+		if order, exists := s.orderIndex[orderID]; exists {
+			s.engine.Restore(order.Symbol, restingBookOrder(order))
+		} else {
+			s.engine.Restore(failed[0].Symbol, orderbook.Order{ID: orderID})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkOrderFill checks that one side of a fill can be settled out of the
+// order's hold, without settling it. The caller must hold s.mutex.
+func (s *MemoryStorage) checkOrderFill(orderID string, quantity int, price money.Amount) error {
+	order, exists := s.orderIndex[orderID]
+	if !exists {
+		return ErrOrderNotFound
+	}
+	if !order.IsOpen() {
+		return ErrOrderNotOpen
+	}
+	account, exists := s.users[order.Username]
+	if !exists {
+		return &OrderError{ReasonAccountNotFound, "Account not found"}
+	}
+	return heldFillChange(order, quantity, price).check(account)
+}
+
+// settleOrderFill settles one side of a fill out of the order's hold. The
+// caller must hold s.mutex.
+func (s *MemoryStorage) settleOrderFill(orderID string, quantity int, price money.Amount) error {
+	order, exists := s.orderIndex[orderID]
+	if !exists {
+		return ErrOrderNotFound
+	}
+	if !order.IsOpen() {
+		return ErrOrderNotOpen
+	}
+
+	change := heldFillChange(order, quantity, price)
+	if err := s.applyChange(change); err != nil {
+		return err
+	}
+	account := s.users[order.Username]
+	position := account.position(order.Symbol)
+	fill := Fill{Timestamp: time.Now(), Quantity: quantity, Price: price}
+	fill.RealizedPnL = position.fill(order.Side, quantity, price, fill.Timestamp, s.costBasis)
+	account.setPosition(order.Symbol, position)
+
+	recordFill(order, fill)
+	s.changes.order(order.ID)
+	trade := newTrade(order, fill)
+	s.trades = append(s.trades, trade)
+	s.ledger = append(s.ledger, fillEntry(change, trade))
+	return errors.Join(s.fillSibling(order), s.resolveChildren(order))
+}
+
+// GetOrders returns all orders for a user
+func (s *MemoryStorage) GetOrders(username string) []Order {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	orders := []Order{}
+	for _, order := range s.orders {
+		if order.Username == username {
+			orders = append(orders, *order)
+		}
+	}
+
+	return orders
+}
+
+// findOwnOrder returns the stored order belonging to username. The caller
+// must hold s.mutex.
+func (s *MemoryStorage) findOwnOrder(username, orderID string) (*Order, error) {
+	order, exists := s.orderIndex[orderID]
+	if !exists || order.Username != username {
+		return nil, ErrOrderNotFound
+	}
+	return order, nil
+}
+
+// CancelOrder cancels one of the user's open orders, removes it from the
+// order book and releases its hold
+func (s *MemoryStorage) CancelOrder(username, orderID string) (*Order, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	order, err := s.findOwnOrder(username, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status == StatusInactive {
+		order.Status = StatusCancelled // holds nothing yet
+		s.changes.order(order.ID)
+		cancelled := *order
+		return &cancelled, nil
+	}
+	if !order.IsOpen() {
+		return nil, ErrOrderNotOpen
+	}
+
+	if err := s.closeOrder(order, StatusCancelled, nil); err != nil {
+		return nil, err
+	}
+
+	cancelled := *order
+	return &cancelled, nil
+}
+
+// closeOrder releases an open order's hold, takes it off the book or stop
+// list and gives it its final status. An OCO sibling it was holding for
+// takes over the hold, and a bracket entry's exits are resolved. The caller
+// must hold s.mutex.
+func (s *MemoryStorage) closeOrder(order *Order, status string, reason *OrderError) error {
+	if err := s.applyChange(releaseChange(order)); err != nil {
+		return err
+	}
+	s.engine.Cancel(order.Symbol, order.ID)
+	s.stops.remove(order.Symbol, order.ID)
+	s.queued.remove(order.Symbol, order.ID)
+	order.Status = status
+	setReason(order, reason)
+	s.changes.order(order.ID)
+
+	if sibling := s.openSibling(order); sibling != nil && sibling.HeldBySibling {
+		if err := s.applyChange(handOverHold(sibling)); err != nil {
+			return err
+		}
+		s.changes.order(sibling.ID)
+	}
+	return s.resolveChildren(order)
+}
+
+// ExpireOrders expires every open order whose expiry has passed by now,
+// releasing its hold, and returns the expired orders
+func (s *MemoryStorage) ExpireOrders(now time.Time) ([]Order, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	var expired []Order
+	var errs []error
+	for _, order := range s.orders {
+		if !order.IsOpen() || !order.expiredAt(now) {
+			continue
+		}
+		if err := s.closeOrder(order, StatusExpired, nil); err != nil {
+			errs = append(errs, fmt.Errorf("expire order %s: %w", order.ID, err))
+			continue
+		}
+		expired = append(expired, *order)
+	}
+	return expired, errors.Join(errs...)
+}
+
+// AmendOrder changes the price and/or quantity of one of the user's open
+// limit orders, moving the hold to match. A zero price or quantity leaves
+// that field unchanged. The amended order loses its time priority and may
+// match immediately at its new price.
+func (s *MemoryStorage) AmendOrder(username, orderID string, price money.Amount, quantity int) (*Order, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	order, err := s.findOwnOrder(username, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !order.IsOpen() {
+		return nil, ErrOrderNotOpen
+	}
+	if order.awaitingTrigger() {
+		return nil, ErrAmendStop
+	}
+	if order.ParentID != "" && quantity != 0 {
+		return nil, ErrAmendExit
+	}
+
+	amended := *order
+	if price != 0 {
+		amended.Price = price
+	}
+	if quantity != 0 {
+		amended.Quantity = quantity
+	}
+	if amended.Remaining() <= 0 {
+		return nil, ErrAmendBelowFill
+	}
+	if s.prices[order.Symbol].Halted && !order.Queued {
+		return nil, ErrAmendHalted
+	}
+
+	if err := s.applyChange(releaseChange(order).add(holdChange(&amended))); err != nil {
+		return nil, err
+	}
+
+	s.engine.Cancel(order.Symbol, order.ID)
+	*order = amended
+	s.changes.order(order.ID)
+	if order.awaitingRelease() {
+		result := *order
+		return &result, nil
+	}
+	fills := s.engine.Submit(order.Symbol, bookOrder(order), s.prices[order.Symbol].Price)
+	err = s.settleFills(fills)
+
+	result := *order
+	return &result, err
+}
+
+// UpdatePrice updates a stock price and fills any limit orders it triggers
+func (s *MemoryStorage) UpdatePrice(symbol string, newPrice money.Amount, change float64) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	stock, exists := s.prices[symbol]
+	if !exists {
+		return ErrStockNotFound
+	}
+
+	// Update day high/low
+	if newPrice > stock.DayHigh {
+		stock.DayHigh = newPrice
+	}
+	if newPrice < stock.DayLow || stock.DayLow == 0 {
+		stock.DayLow = newPrice
+	}
+
+	return s.setPrice(stock, newPrice, change)
+}
+
+// ApplyBar moves a stock's price to the bar's close, as UpdatePrice does,
+// and adds the bar to the day's open, high, low and volume, starting a new
+// day if newDay
+func (s *MemoryStorage) ApplyBar(symbol string, bar Bar, change float64, newDay bool) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	stock, exists := s.prices[symbol]
+	if !exists {
+		return ErrStockNotFound
+	}
+
+	stock.foldBar(bar, newDay)
+	return s.setPrice(stock, bar.Close, change)
+}
+
+// StartDay resets every stock's day open, high, low and volume to its
+// current price for day, unless they are already for day
+func (s *MemoryStorage) StartDay(day string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	for _, stock := range s.prices {
+		stock.startDay(day)
+	}
+	return nil
+}
+
+// SetHalted halts or resumes trading in a stock
+func (s *MemoryStorage) SetHalted(symbol string, halted bool) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	stock, exists := s.prices[symbol]
+	if !exists {
+		return ErrStockNotFound
+	}
+	stock.Halted = halted
+	return nil
+}
+
+// ReleaseQueued submits a stock's queued orders, oldest first, at the
+// current price. Queued market orders are only released if marketOrders.
+// An order whose release fails stays queued to be retried.
+func (s *MemoryStorage) ReleaseQueued(symbol string, marketOrders bool) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	stock, exists := s.prices[symbol]
+	if !exists {
+		return ErrStockNotFound
+	}
+
+	var errs []error
+	for _, order := range s.queued.waiting(symbol) {
+		if order.OrderType == "market" && !marketOrders {
+			continue
+		}
+		released := *order
+		change, quantity, rejectErr := releaseOrder(s.users[order.Username], &released, stock.Price)
+		if err := s.applyChange(change); err != nil {
+			errs = append(errs, fmt.Errorf("release order %s: %w", order.ID, err))
+			continue
+		}
+		s.queued.remove(symbol, order.ID)
+		*order = released
+		s.changes.order(order.ID)
+		if rejectErr != nil {
+			rejectOrder(order, rejectErr)
+			continue
+		}
+		if err := s.submit(order, quantity, stock.Price); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setPrice sets a stock's price, adds it to the history and fills any
+// limit orders it triggers. The caller must hold s.mutex.
+func (s *MemoryStorage) setPrice(stock *StockPrice, newPrice money.Amount, change float64) error {
+	// Update price and add to history (keep last 20)
+	stock.Price = newPrice
+	stock.Change = change
+	stock.PriceHistory = append(stock.PriceHistory, newPrice)
+	if len(stock.PriceHistory) > 20 {
+		stock.PriceHistory = stock.PriceHistory[len(stock.PriceHistory)-20:]
+	}
+
+	// Check and update order statuses
+	return s.updateOrderStatuses(stock.Symbol, newPrice)
+}
+
+// GetPrice returns the price for a specific symbol
+func (s *MemoryStorage) GetPrice(symbol string) (*StockPrice, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	price, exists := s.prices[symbol]
+	if !exists {
+		return nil, false
+	}
+
+	c := copyPrice(price)
+	return &c, true
+}
+
+// GetAllPrices returns all stock prices
+func (s *MemoryStorage) GetAllPrices() []StockPrice {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	prices := make([]StockPrice, 0, len(s.symbols))
+	for _, symbol := range s.symbols {
+		prices = append(prices, copyPrice(s.prices[symbol]))
+	}
+
+	return prices
+}
+
+// GetInstruments returns the instrument catalog, delisted instruments
+// included
+func (s *MemoryStorage) GetInstruments() []Instrument {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	instruments := make([]Instrument, 0, len(s.symbols))
+	for _, symbol := range s.symbols {
+		instruments = append(instruments, copyInstrument(s.instruments[symbol]))
+	}
+	return instruments
+}
+
+// GetInstrument returns the catalog entry for a symbol
+func (s *MemoryStorage) GetInstrument(symbol string) (*Instrument, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	instrument, exists := s.instruments[symbol]
+	if !exists {
+		return nil, false
+	}
+	c := copyInstrument(instrument)
+	return &c, true
+}
+
+// CreateInstrument adds an instrument to the catalog and creates its price
+func (s *MemoryStorage) CreateInstrument(instrument *Instrument) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	if _, exists := s.instruments[instrument.Symbol]; exists {
+		return ErrInstrumentExists
+	}
+	instrument.CreatedAt = time.Now()
+	instrument.UpdatedAt = instrument.CreatedAt
+	stored := copyInstrument(instrument)
+	s.addInstrument(&stored)
+	return nil
+}
+
+// addInstrument stores an instrument and its starting price. The caller
+// must hold s.mutex.
+func (s *MemoryStorage) addInstrument(instrument *Instrument) {
+	price := newStockPrice(instrument)
+	s.instruments[instrument.Symbol] = instrument
+	s.prices[instrument.Symbol] = &price
+	s.symbols = append(s.symbols, instrument.Symbol)
+}
+
+// UpdateInstrument changes an instrument's details, and the name and logo
+// of its price. Its creation time and tradable flag are kept, and
+// instrument is refreshed with the stored state.
+func (s *MemoryStorage) UpdateInstrument(instrument *Instrument) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	stored, exists := s.instruments[instrument.Symbol]
+	if !exists {
+		return ErrStockNotFound
+	}
+	instrument.CreatedAt = stored.CreatedAt
+	instrument.Tradable = stored.Tradable
+	instrument.UpdatedAt = time.Now()
+	*stored = copyInstrument(instrument)
+
+	price := s.prices[instrument.Symbol]
+	price.Name, price.Logo = instrument.Name, instrument.Logo
+	return nil
+}
+
+// SetTradable lists or delists an instrument. Delisting cancels every open
+// and inactive order in it, releasing their holds.
+func (s *MemoryStorage) SetTradable(symbol string, tradable bool) error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	instrument, exists := s.instruments[symbol]
+	if !exists {
+		return ErrStockNotFound
+	}
+	instrument.Tradable = tradable
+	instrument.UpdatedAt = time.Now()
+	if tradable {
+		return nil
+	}
+
+	// Cancel the inactive bracket exits first, so closing their entries
+	// doesn't activate them
+	var open []*Order
+	for _, order := range s.orderIndex {
+		if order.Symbol != symbol {
+			continue
+		}
+		if order.Status == StatusInactive {
+			order.Status = StatusCancelled
+			setReason(order, errDelisted)
+			s.changes.order(order.ID)
+		} else if order.IsOpen() {
+			open = append(open, order)
+		}
+	}
+
+	var errs []error
+	for _, order := range open {
+		if err := s.closeOrder(order, StatusCancelled, errDelisted); err != nil {
+			errs = append(errs, fmt.Errorf("cancel order %s: %w", order.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AdjustAccount applies a deposit, withdrawal, fee or adjustment to an
+// account and journals it. Nothing is applied if a balance would go
+// negative.
+func (s *MemoryStorage) AdjustAccount(adjustment Adjustment) (*LedgerEntry, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	change, counterparty, err := adjustment.change()
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := s.users[adjustment.Username]; !exists {
+		return nil, &OrderError{ReasonAccountNotFound, "Account not found"}
+	}
+	if err := s.applyChange(change); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if change.Shares != 0 {
+		var price money.Amount
+		if stock, exists := s.prices[change.Symbol]; exists {
+			price = stock.Price
+		}
+		account := s.users[adjustment.Username]
+		position := account.position(change.Symbol)
+		position.adjust(change.Shares, price, now, s.costBasis)
+		account.setPosition(change.Symbol, position)
+	}
+	entry := adjustmentEntry(adjustment, change, counterparty, now)
+	s.ledger = append(s.ledger, entry)
+	c := copyLedgerEntry(&entry)
+	return &c, nil
+}
+
+// GetLedger returns a user's ledger entries, oldest first, or every entry
+// if username is empty
+func (s *MemoryStorage) GetLedger(username string) []LedgerEntry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries := []LedgerEntry{}
+	for i := range s.ledger {
+		if username == "" || s.ledger[i].Username == username {
+			entries = append(entries, copyLedgerEntry(&s.ledger[i]))
+		}
+	}
+	return entries
+}
+
+// Reconcile recomputes every account's total credits and shares from the
+// ledger and reports the ones that differ
+func (s *MemoryStorage) Reconcile() (*Reconciliation, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := &Reconciliation{Entries: len(s.ledger), Unbalanced: []string{}, CheckedAt: time.Now()}
+	var postings []Posting
+	for i := range s.ledger {
+		if !s.ledger[i].balanced() {
+			result.Unbalanced = append(result.Unbalanced, s.ledger[i].ID)
+		}
+		postings = append(postings, s.ledger[i].Postings...)
+	}
+
+	accounts := make([]UserAccount, 0, len(s.users))
+	for _, account := range s.users {
+		accounts = append(accounts, *account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Username < accounts[j].Username })
+	result.Accounts = len(accounts)
+	result.Mismatches = reconcile(accounts, ledgerBalances(postings))
+	return result, nil
+}
+
+// updateOrderStatuses triggers the stop orders the new market price reaches,
+// then lets it fill the resting orders it crosses. The caller must hold
+// s.mutex.
+func (s *MemoryStorage) updateOrderStatuses(symbol string, currentPrice money.Amount) error {
+	stopErr := s.triggerStops(symbol, currentPrice)
+	return errors.Join(stopErr, s.settleFills(s.engine.MarketTick(symbol, currentPrice)))
+}
+
+// ReloadBooks does nothing: the memory store's books are the only copy of
+// its open orders
+func (s *MemoryStorage) ReloadBooks() error {
+	return nil
+}
+
+// GetOrderBook returns up to depth aggregated levels per side of symbol's
+// order book
+func (s *MemoryStorage) GetOrderBook(symbol string, depth int) orderbook.Depth {
+	return s.engine.Depth(symbol, depth)
+}
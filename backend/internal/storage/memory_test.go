@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"testing"
+
+	"stocks-backend/internal/money"
+)
+
+func TestFailedSettleRestoresBook(t *testing.T) {
+	s := NewMemoryStorage(CostAverage)
+	s.CreateAccount("buyer", "secret")
+	s.CreateAccount("seller", "secret")
+	if _, err := s.AdjustAccount(Adjustment{Username: "seller", Kind: EntryAdjustment, Symbol: "AAPL", Shares: 10}); err != nil {
+		t.Fatalf("AdjustAccount: %v", err)
+	}
+
+	ask := Order{ID: "ask", Username: "seller", Symbol: "AAPL", Side: "sell", OrderType: "limit", Quantity: 10, Price: money.FromInt(151)}
+	if err := s.PlaceOrder(&ask); err != nil {
+		t.Fatalf("PlaceOrder(ask): %v", err)
+	}
+	// The seller's hold disappears, so settling the ask's side will fail
+	s.users["seller"].HeldShares["AAPL"] = 0
+
+	buyerLedger := len(s.GetLedger("buyer"))
+	bid := Order{ID: "bid", Username: "buyer", Symbol: "AAPL", Side: "buy", OrderType: "limit", Quantity: 4, Price: money.FromInt(151)}
+	if err := s.PlaceOrder(&bid); err == nil {
+		t.Fatal("PlaceOrder(bid) settled against an ask without a hold")
+	}
+
+	depth := s.GetOrderBook("AAPL", 5)
+	if len(depth.Asks) != 1 || depth.Asks[0].Quantity != 10 {
+		t.Errorf("asks = %+v, want the ask restored with 10 shares", depth.Asks)
+	}
+	if len(depth.Bids) != 1 || depth.Bids[0].Quantity != 4 {
+		t.Errorf("bids = %+v, want the bid resting with 4 shares", depth.Bids)
+	}
+	for _, id := range []string{"ask", "bid"} {
+		if stored := s.orderIndex[id]; stored.FilledQuantity != 0 || len(stored.Fills) != 0 || !stored.IsOpen() {
+			t.Errorf("%s = %s with %d filled, want open and unfilled", id, stored.Status, stored.FilledQuantity)
+		}
+	}
+
+	// Neither side of the failed fill settled
+	buyer := s.GetAccount("buyer")
+	if buyer.TotalCredits() != startingCredits || buyer.HeldCredits != money.FromInt(151*4) {
+		t.Errorf("buyer credits = %s with %s held, want %s in all with the bid's hold", buyer.TotalCredits(), buyer.HeldCredits, startingCredits)
+	}
+	if len(buyer.Portfolio) != 0 || len(buyer.Positions) != 0 {
+		t.Errorf("buyer holds %v with positions %+v, want nothing", buyer.Portfolio, buyer.Positions)
+	}
+	if seller := s.GetAccount("seller"); seller.TotalCredits() != startingCredits {
+		t.Errorf("seller credits = %s, want %s", seller.TotalCredits(), startingCredits)
+	}
+	if len(s.trades) != 0 {
+		t.Errorf("trades = %+v, want none", s.trades)
+	}
+	if entries := s.GetLedger("buyer"); len(entries) != buyerLedger {
+		t.Errorf("buyer has %d ledger entries, want %d", len(entries), buyerLedger)
+	}
+}
@@ -0,0 +1,1936 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"stocks-backend/internal/money"
+	"stocks-backend/internal/orderbook"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStorage provides MongoDB-backed storage. Order placement, fills,
+// cancels and amendments each run in a single transaction, so the server
+// must be connected to a replica set (MongoDB Atlas clusters are).
+//
+// Open orders are also kept in an in-memory order book per symbol, and stop
+// orders waiting to trigger in a stop list; both are rebuilt from the orders
+// collection on startup. matchMutex serializes book and stop list changes
+// with the writes that settle them, and guards the set of changes the
+// listener is told about once it is released.
+type MongoStorage struct {
+	db             *mongo.Database
+	usersCol       *mongo.Collection
+	ordersCol      *mongo.Collection
+	pricesCol      *mongo.Collection
+	tradesCol      *mongo.Collection
+	instrumentsCol *mongo.Collection
+	ledgerCol      *mongo.Collection
+	engine         *orderbook.Engine
+	stops          stopList
+	queued         stopList
+	changes        changeSet
+	listener       Listener
+	costBasis      CostBasisMethod
+	matchMutex     sync.Mutex
+}
+
+// NewMongoStorage creates a new MongoDB storage instance whose positions
+// take the cost of shares sold by costBasis
+func NewMongoStorage(client *mongo.Client, dbName string, costBasis CostBasisMethod) (*MongoStorage, error) {
+	db := client.Database(dbName)
+
+	storage := &MongoStorage{
+		costBasis:      costBasis,
+		db:             db,
+		usersCol:       db.Collection("users"),
+		ordersCol:      db.Collection("orders"),
+		pricesCol:      db.Collection("prices"),
+		tradesCol:      db.Collection("trades"),
+		instrumentsCol: db.Collection("instruments"),
+		ledgerCol:      db.Collection("ledger"),
+		engine:         orderbook.NewEngine(),
+		stops:          make(stopList),
+		queued:         make(stopList),
+	}
+
+	// Create indexes
+	ctx := context.Background()
+	if err := storage.createIndexes(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create indexes: %w", err)
+	}
+
+	// Seed the instrument catalog and create the prices it lacks
+	if err := storage.initializeInstruments(ctx); err != nil {
+		return nil, fmt.Errorf("failed to initialize instruments: %w", err)
+	}
+
+	// Give older accounts the fields balance updates $inc into
+	if err := storage.migrateAccounts(ctx); err != nil {
+		return nil, fmt.Errorf("failed to migrate accounts: %w", err)
+	}
+
+	// Rename order statuses from before the fill lifecycle
+	if err := storage.migrateOrderStatuses(ctx); err != nil {
+		return nil, fmt.Errorf("failed to migrate order statuses: %w", err)
+	}
+
+	// Store money amounts written as doubles as decimals
+	if err := storage.migrateMoney(ctx); err != nil {
+		return nil, fmt.Errorf("failed to migrate money amounts: %w", err)
+	}
+
+	// Open the ledger of accounts created before it
+	if err := storage.migrateLedger(ctx); err != nil {
+		return nil, fmt.Errorf("failed to migrate ledger: %w", err)
+	}
+
+	// Build the positions of accounts from before cost basis tracking
+	if err := storage.migratePositions(ctx); err != nil {
+		return nil, fmt.Errorf("failed to migrate positions: %w", err)
+	}
+
+	// Restore resting orders into the order books
+	if err := storage.loadOrderBooks(ctx); err != nil {
+		return nil, fmt.Errorf("failed to load order books: %w", err)
+	}
+
+	return storage, nil
+}
+
+// Collections returns the prices, orders and users collections, whose
+// change streams carry the store's writes to other replicas
+func (s *MongoStorage) Collections() (prices, orders, users *mongo.Collection) {
+	return s.pricesCol, s.ordersCol, s.usersCol
+}
+
+// Database returns the store's database, for other collections shared by
+// the replicas that use it
+func (s *MongoStorage) Database() *mongo.Database {
+	return s.db
+}
+
+// createIndexes creates database indexes for performance
+func (s *MongoStorage) createIndexes(ctx context.Context) error {
+	// Index on orders collection
+	_, err := s.ordersCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+		{Keys: bson.D{{Key: "symbol", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "parentId", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Index on trades collection
+	_, err = s.tradesCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+		{Keys: bson.D{{Key: "orderId", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Index on ledger collection
+	_, err = s.ledgerCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "createdAt", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// initializeInstruments seeds an empty instrument catalog with the default
+// instruments, then creates the price of any instrument without one
+func (s *MongoStorage) initializeInstruments(ctx context.Context) error {
+	count, err := s.instrumentsCol.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		now := time.Now()
+		var defaults []interface{}
+		for _, instrument := range defaultInstruments() {
+			instrument.CreatedAt, instrument.UpdatedAt = now, now
+			defaults = append(defaults, instrument)
+		}
+		if _, err := s.instrumentsCol.InsertMany(ctx, defaults); err != nil {
+			return err
+		}
+	}
+
+	for _, instrument := range s.GetInstruments() {
+		if err := s.insertPrice(ctx, &instrument); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertPrice creates an instrument's starting price if it has no price
+func (s *MongoStorage) insertPrice(ctx context.Context, instrument *Instrument) error {
+	filter := bson.M{"_id": instrument.Symbol}
+	update := bson.M{"$setOnInsert": newStockPrice(instrument)}
+	opts := options.Update().SetUpsert(true)
+	_, err := s.pricesCol.UpdateOne(ctx, filter, update, opts)
+	return err
+}
+
+// migrateAccounts replaces missing or null balance fields with empty values
+func (s *MongoStorage) migrateAccounts(ctx context.Context) error {
+	for field, value := range map[string]interface{}{
+		"portfolio":   bson.M{},
+		"heldShares":  bson.M{},
+		"heldCredits": money.Amount(0),
+	} {
+		_, err := s.usersCol.UpdateMany(ctx, bson.M{field: nil}, bson.M{"$set": bson.M{field: value}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateLedger journals an opening entry with the current balances of
+// every account that has no ledger entries yet
+func (s *MongoStorage) migrateLedger(ctx context.Context) error {
+	journaled, err := s.ledgerCol.Distinct(ctx, "username", bson.M{})
+	if err != nil {
+		return err
+	}
+	cursor, err := s.usersCol.Find(ctx, bson.M{"_id": bson.M{"$nin": journaled}})
+	if err != nil {
+		return err
+	}
+	var accounts []UserAccount
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var entries []interface{}
+	for i := range accounts {
+		if entry := openingEntry(&accounts[i], now); len(entry.Postings) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if _, err := s.ledgerCol.InsertMany(ctx, entries); err != nil {
+		return err
+	}
+	log.Printf("Opened the ledger of %d accounts", len(entries))
+	return nil
+}
+
+// migratePositions builds the positions of accounts from before cost basis
+// tracking by replaying their trades. Shares the trades don't account for
+// are added at the current price.
+func (s *MongoStorage) migratePositions(ctx context.Context) error {
+	cursor, err := s.usersCol.Find(ctx, bson.M{"positions": nil})
+	if err != nil {
+		return err
+	}
+	var accounts []UserAccount
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return err
+	}
+	if len(accounts) == 0 {
+		return nil
+	}
+
+	prices := make(map[string]money.Amount)
+	for _, price := range s.GetAllPrices() {
+		prices[price.Symbol] = price.Price
+	}
+	now := time.Now()
+	for i := range accounts {
+		account := &accounts[i]
+		account.Positions = make(map[string]Position)
+
+		opts := options.Find().SetSort(bson.D{{Key: "executedAt", Value: 1}, {Key: "_id", Value: 1}})
+		cursor, err := s.tradesCol.Find(ctx, bson.M{"username": account.Username}, opts)
+		if err != nil {
+			return err
+		}
+		var trades []Trade
+		if err := cursor.All(ctx, &trades); err != nil {
+			return err
+		}
+		for _, trade := range trades {
+			position := account.position(trade.Symbol)
+			position.fill(trade.Side, trade.Quantity, trade.Price, trade.ExecutedAt, s.costBasis)
+			account.setPosition(trade.Symbol, position)
+		}
+
+		totalShares := account.TotalShares()
+		symbols := sortedSymbols(totalShares)
+		for symbol := range account.Positions {
+			if _, held := totalShares[symbol]; !held {
+				symbols = append(symbols, symbol)
+			}
+		}
+		for _, symbol := range symbols {
+			position := account.position(symbol)
+			position.adjust(totalShares[symbol]-position.Quantity, prices[symbol], now, s.costBasis)
+			account.setPosition(symbol, position)
+		}
+
+		update := bson.M{"$set": bson.M{"positions": account.Positions}}
+		if _, err := s.usersCol.UpdateOne(ctx, bson.M{"_id": account.Username}, update); err != nil {
+			return err
+		}
+	}
+	log.Printf("Built the positions of %d accounts from their trades", len(accounts))
+	return nil
+}
+
+// migrateOrderStatuses renames the old "pending" and "done" statuses
+func (s *MongoStorage) migrateOrderStatuses(ctx context.Context) error {
+	renames := []struct {
+		filter bson.M
+		status string
+	}{
+		{bson.M{"status": "pending", "filledQuantity": bson.M{"$gt": 0}}, StatusPartiallyFilled},
+		{bson.M{"status": "pending"}, StatusNew},
+		{bson.M{"status": "done"}, StatusFilled},
+	}
+	for _, r := range renames {
+		_, err := s.ordersCol.UpdateMany(ctx, r.filter, bson.M{"$set": bson.M{"status": r.status}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateMoney converts money amounts stored as doubles, before amounts
+// were decimals, to Decimal128 rounded to money.Places decimal places
+func (s *MongoStorage) migrateMoney(ctx context.Context) error {
+	// The money.Amount fields of each collection: scalar fields, arrays of
+	// amounts and arrays of documents with a price
+	moneyFields := []struct {
+		col     *mongo.Collection
+		scalars []string
+		arrays  []string
+		fills   []string
+	}{
+		{s.usersCol, []string{"credits", "heldCredits"}, nil, nil},
+		{s.pricesCol, []string{"price", "dayHigh", "dayLow", "dayOpen"}, []string{"priceHistory"}, nil},
+		{s.ordersCol, []string{"price", "stopPrice", "trailAmount", "waterMark", "avgFillPrice"}, nil, []string{"fills"}},
+		{s.tradesCol, []string{"price"}, nil, nil},
+		{s.instrumentsCol, []string{"tickSize", "startingPrice"}, nil, nil},
+	}
+	toDecimal := func(value string) bson.M {
+		return bson.M{"$round": bson.A{bson.M{"$toDecimal": value}, money.Places}}
+	}
+	for _, m := range moneyFields {
+		var doubles bson.A
+		set := bson.M{}
+		for _, field := range m.scalars {
+			doubles = append(doubles, bson.M{field: bson.M{"$type": "double"}})
+			isDouble := bson.M{"$eq": bson.A{bson.M{"$type": "$" + field}, "double"}}
+			set[field] = bson.M{"$cond": bson.A{isDouble, toDecimal("$" + field), "$" + field}}
+		}
+		for _, field := range m.arrays {
+			doubles = append(doubles, bson.M{field: bson.M{"$type": "double"}})
+			converted := bson.M{"$map": bson.M{"input": "$" + field, "in": toDecimal("$$this")}}
+			set[field] = bson.M{"$cond": bson.A{bson.M{"$isArray": "$" + field}, converted, "$" + field}}
+		}
+		for _, field := range m.fills {
+			doubles = append(doubles, bson.M{field + ".price": bson.M{"$type": "double"}})
+			price := bson.M{"price": toDecimal("$$this.price")}
+			converted := bson.M{"$map": bson.M{"input": "$" + field, "in": bson.M{"$mergeObjects": bson.A{"$$this", price}}}}
+			set[field] = bson.M{"$cond": bson.A{bson.M{"$isArray": "$" + field}, converted, "$" + field}}
+		}
+
+		update := mongo.Pipeline{{{Key: "$set", Value: set}}}
+		result, err := m.col.UpdateMany(ctx, bson.M{"$or": doubles}, update)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			log.Printf("Converted the money amounts of %d %s documents to decimals", result.ModifiedCount, m.col.Name())
+		}
+	}
+	return nil
+}
+
+// loadOrderBooks rests every open order in its book, oldest first so time
+// priority is preserved across restarts, and lists the stop orders still
+// waiting to trigger and the orders queued for their symbol to trade
+func (s *MongoStorage) loadOrderBooks(ctx context.Context) error {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cursor, err := s.ordersCol.Find(ctx, bson.M{"status": bson.M{"$in": openStatuses}}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return err
+	}
+
+	for i := range orders {
+		if orders[i].awaitingRelease() {
+			s.queued.add(&orders[i])
+			continue
+		}
+		if orders[i].awaitingTrigger() {
+			s.stops.add(&orders[i])
+			continue
+		}
+		s.engine.Add(orders[i].Symbol, bookOrder(&orders[i]))
+	}
+	return nil
+}
+
+// SetListener sets the listener told about order and account changes
+func (s *MongoStorage) SetListener(listener Listener) {
+	s.matchMutex.Lock()
+	defer s.matchMutex.Unlock()
+	s.listener = listener
+}
+
+// unlockMatch releases s.matchMutex, then loads the orders and accounts
+// changed while it was held and tells the listener about them
+func (s *MongoStorage) unlockMatch() {
+	changes := s.changes.take()
+	listener := s.listener
+	s.matchMutex.Unlock()
+	if listener == nil {
+		return
+	}
+
+	ctx := context.Background()
+	orders, err := s.findOrders(ctx, changes.orders)
+	if err != nil {
+		log.Printf("Error loading changed orders: %v", err)
+	}
+	accounts, err := s.findAccounts(ctx, changes.accounts)
+	if err != nil {
+		log.Printf("Error loading changed accounts: %v", err)
+	}
+	notify(listener, orders, accounts)
+}
+
+// findOrders loads the orders with the given IDs, in that order
+func (s *MongoStorage) findOrders(ctx context.Context, orderIDs []string) ([]Order, error) {
+	if len(orderIDs) == 0 {
+		return nil, nil
+	}
+	cursor, err := s.ordersCol.Find(ctx, bson.M{"_id": bson.M{"$in": orderIDs}})
+	if err != nil {
+		return nil, err
+	}
+	var found []Order
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]Order, len(found))
+	for _, order := range found {
+		byID[order.ID] = order
+	}
+	orders := make([]Order, 0, len(found))
+	for _, id := range orderIDs {
+		if order, exists := byID[id]; exists {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+// findAccounts loads the accounts of the given users, in that order
+func (s *MongoStorage) findAccounts(ctx context.Context, usernames []string) ([]UserAccount, error) {
+	if len(usernames) == 0 {
+		return nil, nil
+	}
+	cursor, err := s.usersCol.Find(ctx, bson.M{"_id": bson.M{"$in": usernames}})
+	if err != nil {
+		return nil, err
+	}
+	var found []UserAccount
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]UserAccount, len(found))
+	for _, account := range found {
+		byName[account.Username] = account
+	}
+	accounts := make([]UserAccount, 0, len(found))
+	for _, username := range usernames {
+		if account, exists := byName[username]; exists {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, nil
+}
+
+// withTransaction runs fn inside a MongoDB transaction, retrying on
+// transient errors such as write conflicts
+func (s *MongoStorage) withTransaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	session, err := s.db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// applyChange applies a balance change with a single conditional $inc. The
+// filter requires every balance the change decreases to cover it, so the
+// update matches nothing (and returns the shortfall error) instead of
+// overdrawing the account.
+func (s *MongoStorage) applyChange(ctx context.Context, change balanceChange) error {
+	filter := bson.M{"_id": change.Username}
+	inc := bson.M{}
+
+	if change.Credits != 0 {
+		inc["credits"] = change.Credits
+		if change.Credits < 0 {
+			filter["credits"] = bson.M{"$gte": -change.Credits}
+		}
+	}
+	if change.HeldCredits != 0 {
+		inc["heldCredits"] = change.HeldCredits
+		if change.HeldCredits < 0 {
+			filter["heldCredits"] = bson.M{"$gte": -change.HeldCredits}
+		}
+	}
+	sharesKey := "portfolio." + change.Symbol
+	heldKey := "heldShares." + change.Symbol
+	if change.Shares != 0 {
+		inc[sharesKey] = change.Shares
+		if change.Shares < 0 {
+			filter[sharesKey] = bson.M{"$gte": -change.Shares}
+		}
+	}
+	if change.HeldShares != 0 {
+		inc[heldKey] = change.HeldShares
+		if change.HeldShares < 0 {
+			filter[heldKey] = bson.M{"$gte": -change.HeldShares}
+		}
+	}
+	if len(inc) == 0 {
+		return nil
+	}
+
+	result, err := s.usersCol.UpdateOne(ctx, filter, bson.M{"$inc": inc})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return change.shortfallError()
+	}
+	s.changes.account(change.Username)
+
+	// Remove positions that dropped to zero so the portfolio only lists holdings
+	if change.Shares < 0 {
+		if _, err := s.usersCol.UpdateOne(ctx,
+			bson.M{"_id": change.Username, sharesKey: 0},
+			bson.M{"$unset": bson.M{sharesKey: ""}},
+		); err != nil {
+			return err
+		}
+	}
+	if change.HeldShares < 0 {
+		if _, err := s.usersCol.UpdateOne(ctx,
+			bson.M{"_id": change.Username, heldKey: 0},
+			bson.M{"$unset": bson.M{heldKey: ""}},
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateOpenOrder applies update to an order that is still open and has
+// filled exactly what the caller last saw, failing with ErrOrderNotOpen if it
+// has filled, been cancelled or changed in the meantime
+func (s *MongoStorage) updateOpenOrder(ctx context.Context, order *Order, update bson.M) error {
+	filter := bson.M{
+		"_id":            order.ID,
+		"status":         bson.M{"$in": openStatuses},
+		"filledQuantity": order.FilledQuantity,
+	}
+	result, err := s.ordersCol.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrOrderNotOpen
+	}
+	return nil
+}
+
+// CreateAccount creates a new user account with initial credits
+func (s *MongoStorage) CreateAccount(username, password string) *UserAccount {
+	ctx := context.Background()
+
+	// Check if account already exists
+	var existing UserAccount
+	err := s.usersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&existing)
+	if err == nil {
+		return nil // Account already exists
+	}
+
+	account := &UserAccount{
+		Username:     username,
+		PasswordHash: hashPassword(password),
+		Credits:      startingCredits,
+		Portfolio:    make(map[string]int),
+		HeldShares:   make(map[string]int),
+		Positions:    make(map[string]Position),
+	}
+
+	deposit := newLedgerEntry(EntryDeposit, balanceChange{Username: username, Credits: startingCredits}, LedgerExternal, time.Now())
+	deposit.Memo = "Starting credits"
+	err = s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		if _, err := s.usersCol.InsertOne(sc, account); err != nil {
+			return err
+		}
+		_, err := s.ledgerCol.InsertOne(sc, deposit)
+		return err
+	})
+	if err != nil {
+		return nil
+	}
+
+	return account
+}
+
+// ValidatePassword checks if the provided password matches the stored hash
+func (s *MongoStorage) ValidatePassword(username, password string) bool {
+	ctx := context.Background()
+
+	var account UserAccount
+	err := s.usersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&account)
+	if err != nil {
+		return false
+	}
+
+	return account.PasswordHash == hashPassword(password)
+}
+
+// GetAccount returns a user's account
+func (s *MongoStorage) GetAccount(username string) *UserAccount {
+	ctx := context.Background()
+
+	var account UserAccount
+	err := s.usersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&account)
+	if err != nil {
+		return nil
+	}
+
+	return &account
+}
+
+// PlaceOrder validates and stores a new order and reserves its funds in one
+// transaction, then routes it through the symbol's order book. Market orders
+// are priced at the current price and fill as much as the account can pay
+// for; limit orders rest in the book until matched and stop orders wait until
+// they trigger. Orders the account can't cover are stored as rejected and the
+// reason is returned.
+func (s *MongoStorage) PlaceOrder(order *Order) error {
+	return s.PlaceBracket(order, nil)
+}
+
+// PlaceBracket places an entry order like PlaceOrder, storing its exits as
+// inactive children in the same transaction. They activate once it fills.
+func (s *MongoStorage) PlaceBracket(order *Order, exits []*Order) error {
+	ctx := context.Background()
+	prepareOrder(order)
+	prepareBracket(order, exits)
+
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	var stock StockPrice
+	var quantity int
+	var rejectErr error
+	err := s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		rejectErr = nil
+
+		err := s.pricesCol.FindOne(sc, bson.M{"_id": order.Symbol}).Decode(&stock)
+		if err == mongo.ErrNoDocuments {
+			return ErrStockNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		if order.OrderType == "market" {
+			order.Price = stock.Price.Round(money.Cent)
+		}
+		if isStopType(order.OrderType) {
+			initStop(order, stock.Price)
+		}
+		order.Status = StatusNew
+
+		var account UserAccount
+		err = s.usersCol.FindOne(sc, bson.M{"_id": order.Username}).Decode(&account)
+		if err == mongo.ErrNoDocuments {
+			return &OrderError{ReasonAccountNotFound, "Account not found"}
+		}
+		if err != nil {
+			return err
+		}
+		quantity, rejectErr = placementQuantity(&account, order)
+		if rejectErr == nil {
+			rejectErr = s.applyChange(sc, holdChangeFor(order, quantity))
+		}
+		var orderErr *OrderError
+		if rejectErr != nil && !errors.As(rejectErr, &orderErr) {
+			return rejectErr
+		}
+		if rejectErr != nil {
+			rejectOrder(order, rejectErr)
+		}
+
+		for _, exit := range exits {
+			if _, err := s.ordersCol.InsertOne(sc, exit); err != nil {
+				return err
+			}
+		}
+		_, err = s.ordersCol.InsertOne(sc, order)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.changes.order(order.ID)
+	for _, exit := range exits {
+		s.changes.order(exit.ID)
+	}
+	if rejectErr != nil {
+		if err := s.resolveChildren(ctx, order); err != nil {
+			log.Printf("Error cancelling the exits of rejected order %s: %v", order.ID, err)
+		}
+		return rejectErr
+	}
+
+	if order.awaitingRelease() {
+		queued := *order
+		s.queued.add(&queued)
+		return nil
+	}
+	if order.awaitingTrigger() {
+		waiting := *order
+		s.stops.add(&waiting)
+		err = s.triggerStops(ctx, order.Symbol, stock.Price)
+		if reloadErr := s.ordersCol.FindOne(ctx, bson.M{"_id": order.ID}).Decode(order); reloadErr != nil {
+			err = errors.Join(err, reloadErr)
+		}
+		return followUp(err)
+	}
+	return followUp(s.submit(ctx, order, quantity, stock.Price))
+}
+
+// submit routes quantity of a stored open order through its book, settles
+// the fills and refreshes order with the stored state. If the order must not
+// rest, it is closed and the hold on whatever did not fill is released in
+// one transaction. The caller must hold s.matchMutex.
+func (s *MongoStorage) submit(ctx context.Context, order *Order, quantity int, marketPrice money.Amount) error {
+	filledBefore := order.FilledQuantity
+	entry := bookOrder(order)
+	entry.Quantity = quantity
+	fills := s.engine.Submit(order.Symbol, entry, marketPrice)
+	err := s.settleAndReload(ctx, order, fills)
+
+	if closeUnfilled(order) {
+		unfilled := quantity - (order.FilledQuantity - filledBefore)
+		closeErr := s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+			update := bson.M{"$set": bson.M{"status": order.Status, "rejectReason": order.RejectReason, "rejectCode": order.RejectCode}}
+			if err := s.updateOpenOrder(sc, order, update); err != nil {
+				return err
+			}
+			return s.applyChange(sc, holdChangeFor(order, unfilled).negate())
+		})
+		err = errors.Join(err, closeErr)
+		if closeErr == nil {
+			s.changes.order(order.ID)
+			err = errors.Join(err, s.resolveChildren(ctx, order))
+		}
+	}
+	return err
+}
+
+// findOpenOrder loads an order if it is still open, returning nil otherwise
+func (s *MongoStorage) findOpenOrder(ctx context.Context, orderID string) (*Order, error) {
+	var order Order
+	filter := bson.M{"_id": orderID, "status": bson.M{"$in": openStatuses}}
+	err := s.ordersCol.FindOne(ctx, filter).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// resolveChildren activates the exits of a bracket entry once it has
+// closed, or cancels them if it filled nothing. All exits are activated and
+// hold their funds in one transaction before any is submitted, so one that
+// fills at once can cancel its sibling. The caller must hold s.matchMutex.
+func (s *MongoStorage) resolveChildren(ctx context.Context, entry *Order) error {
+	if entry.IsOpen() || len(entry.ChildIDs) == 0 {
+		return nil
+	}
+	stock, exists := s.GetPrice(entry.Symbol)
+	if !exists {
+		return ErrStockNotFound
+	}
+
+	var active []*Order
+	err := s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		active = nil
+		cursor, err := s.ordersCol.Find(sc, bson.M{"_id": bson.M{"$in": entry.ChildIDs}, "status": StatusInactive})
+		if err != nil {
+			return err
+		}
+		var found []Order
+		if err := cursor.All(sc, &found); err != nil {
+			return err
+		}
+		byID := make(map[string]*Order, len(found))
+		for i := range found {
+			byID[found[i].ID] = &found[i]
+		}
+
+		opened := make(map[string]bool)
+		for _, id := range entry.ChildIDs {
+			exit, exists := byID[id]
+			if !exists {
+				continue
+			}
+			if activateExit(exit, entry, stock.Price) {
+				if exit.HeldBySibling && !opened[exit.OCOWith] {
+					exit.HeldBySibling = false
+				}
+				err := s.applyChange(sc, holdChange(exit))
+				var orderErr *OrderError
+				if err != nil && !errors.As(err, &orderErr) {
+					return err
+				}
+				if err != nil {
+					rejectOrder(exit, err)
+				}
+			}
+
+			update := bson.M{"$set": bson.M{
+				"status":        exit.Status,
+				"quantity":      exit.Quantity,
+				"price":         exit.Price,
+				"stopPrice":     exit.StopPrice,
+				"heldBySibling": exit.HeldBySibling,
+				"rejectReason":  exit.RejectReason,
+				"rejectCode":    exit.RejectCode,
+			}}
+			if _, err := s.ordersCol.UpdateOne(sc, bson.M{"_id": exit.ID, "status": StatusInactive}, update); err != nil {
+				return err
+			}
+			if exit.IsOpen() {
+				opened[exit.ID] = true
+				active = append(active, exit)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range entry.ChildIDs {
+		s.changes.order(id)
+	}
+
+	var errs []error
+	waiting := false
+	for _, exit := range active {
+		if exit.awaitingTrigger() {
+			s.stops.add(exit)
+			waiting = true
+			continue
+		}
+		// An exit submitted earlier may have filled and cancelled this one
+		current, err := s.findOpenOrder(ctx, exit.ID)
+		if err != nil || current == nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, s.submit(ctx, current, current.Remaining(), stock.Price))
+	}
+	if waiting {
+		errs = append(errs, s.triggerStops(ctx, entry.Symbol, stock.Price))
+	}
+	return errors.Join(errs...)
+}
+
+// fillSibling keeps a filling bracket exit's OCO sibling in step: it shrinks
+// to what the exit has left and is cancelled once the exit has filled. The
+// caller must hold s.matchMutex.
+func (s *MongoStorage) fillSibling(ctx context.Context, exit *Order) error {
+	if exit.OCOWith == "" {
+		return nil
+	}
+	sibling, err := s.findOpenOrder(ctx, exit.OCOWith)
+	if err != nil || sibling == nil {
+		return err
+	}
+	if exit.Remaining() == 0 {
+		return s.closeOrder(ctx, sibling, StatusCancelled, errSiblingFilled)
+	}
+
+	shrunk := *sibling
+	change := shrinkToSibling(&shrunk, exit)
+	err = s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		if err := s.updateOpenOrder(sc, sibling, bson.M{"$set": bson.M{"quantity": shrunk.Quantity}}); err != nil {
+			return err
+		}
+		return s.applyChange(sc, change)
+	})
+	if err != nil {
+		return err
+	}
+	s.changes.order(shrunk.ID)
+
+	s.stops.update(&shrunk)
+	// A resting sibling goes to the back of its level with the new quantity
+	if resting, inBook := s.engine.Cancel(shrunk.Symbol, shrunk.ID); inBook {
+		resting.Quantity = shrunk.Remaining()
+		s.engine.Add(shrunk.Symbol, resting)
+	}
+	return nil
+}
+
+// triggerStops trails symbol's waiting stop orders to the market price and
+// submits the ones it triggers. Trailing stops that moved are saved so they
+// survive a restart. The caller must hold s.matchMutex.
+func (s *MongoStorage) triggerStops(ctx context.Context, symbol string, marketPrice money.Amount) error {
+	var errs []error
+	for _, order := range s.stops.waiting(symbol) {
+		trailed := trailStop(order, marketPrice)
+		if !stopTriggered(order, marketPrice) {
+			if trailed {
+				update := bson.M{"$set": bson.M{"stopPrice": order.StopPrice, "waterMark": order.WaterMark}}
+				if _, err := s.ordersCol.UpdateOne(ctx, bson.M{"_id": order.ID}, update); err != nil {
+					errs = append(errs, fmt.Errorf("trail order %s: %w", order.ID, err))
+				} else {
+					s.changes.order(order.ID)
+				}
+			}
+			continue
+		}
+
+		s.stops.remove(symbol, order.ID)
+		if order.HeldBySibling {
+			if err := s.cancelHolder(ctx, order); err != nil {
+				log.Printf("Error triggering order %s: %v", order.ID, err)
+				errs = append(errs, err)
+				s.stops.add(order)
+				continue
+			}
+		}
+		if err := s.triggerStop(ctx, order, marketPrice); err != nil {
+			log.Printf("Error triggering order %s: %v", order.ID, err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cancelHolder cancels the take-profit holding a triggered stop-loss's
+// funds, since the stop-loss closes the position itself. The stop-loss takes
+// over the hold and order is refreshed to match.
+func (s *MongoStorage) cancelHolder(ctx context.Context, order *Order) error {
+	sibling, err := s.findOpenOrder(ctx, order.OCOWith)
+	if err != nil {
+		return err
+	}
+	if sibling != nil {
+		if err := s.closeOrder(ctx, sibling, StatusCancelled, errSiblingTriggered); err != nil {
+			return err
+		}
+	}
+	return s.ordersCol.FindOne(ctx, bson.M{"_id": order.ID}).Decode(order)
+}
+
+// triggerStop converts a triggered stop order and moves its hold in one
+// transaction, then submits it to the book. If the transaction fails the
+// order goes back on the stop list to be retried on the next price.
+func (s *MongoStorage) triggerStop(ctx context.Context, order *Order, marketPrice money.Amount) error {
+	var triggered Order
+	var quantity int
+	var rejectErr error
+	err := s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		triggered = *order
+
+		var account UserAccount
+		if err := s.usersCol.FindOne(sc, bson.M{"_id": order.Username}).Decode(&account); err != nil {
+			return err
+		}
+		var change balanceChange
+		change, quantity, rejectErr = triggerStop(&account, &triggered, marketPrice)
+		if err := s.applyChange(sc, change); err != nil {
+			return err
+		}
+		if rejectErr != nil {
+			rejectOrder(&triggered, rejectErr)
+		}
+
+		return s.updateOpenOrder(sc, order, bson.M{"$set": bson.M{
+			"triggered":    true,
+			"price":        triggered.Price,
+			"stopPrice":    triggered.StopPrice,
+			"waterMark":    triggered.WaterMark,
+			"status":       triggered.Status,
+			"rejectReason": triggered.RejectReason,
+			"rejectCode":   triggered.RejectCode,
+		}})
+	})
+	if err != nil {
+		s.stops.add(order)
+		return err
+	}
+	s.changes.order(order.ID)
+	if rejectErr != nil {
+		return nil
+	}
+	return s.submit(ctx, &triggered, quantity, marketPrice)
+}
+
+// ReleaseQueued submits a stock's queued orders, oldest first, at the
+// current price. Queued market orders are only released if marketOrders.
+// An order whose release fails stays queued to be retried.
+func (s *MongoStorage) ReleaseQueued(symbol string, marketOrders bool) error {
+	ctx := context.Background()
+
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	stock, exists := s.GetPrice(symbol)
+	if !exists {
+		return ErrStockNotFound
+	}
+
+	var errs []error
+	for _, order := range s.queued.waiting(symbol) {
+		if order.OrderType == "market" && !marketOrders {
+			continue
+		}
+		s.queued.remove(symbol, order.ID)
+		if err := s.releaseOrder(ctx, order, stock.Price); err != nil {
+			log.Printf("Error releasing order %s: %v", order.ID, err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// releaseOrder takes a queued order out of the queue and moves its hold in
+// one transaction, then submits it to the book. If the transaction fails the
+// order goes back in the queue.
+func (s *MongoStorage) releaseOrder(ctx context.Context, order *Order, marketPrice money.Amount) error {
+	var released Order
+	var quantity int
+	var rejectErr error
+	err := s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		released = *order
+
+		var account UserAccount
+		if err := s.usersCol.FindOne(sc, bson.M{"_id": order.Username}).Decode(&account); err != nil {
+			return err
+		}
+		var change balanceChange
+		change, quantity, rejectErr = releaseOrder(&account, &released, marketPrice)
+		if err := s.applyChange(sc, change); err != nil {
+			return err
+		}
+		if rejectErr != nil {
+			rejectOrder(&released, rejectErr)
+		}
+
+		return s.updateOpenOrder(sc, order, bson.M{"$set": bson.M{
+			"queued":       false,
+			"price":        released.Price,
+			"status":       released.Status,
+			"rejectReason": released.RejectReason,
+			"rejectCode":   released.RejectCode,
+		}})
+	})
+	if err != nil {
+		s.queued.add(order)
+		return err
+	}
+	s.changes.order(order.ID)
+	if rejectErr != nil {
+		return nil
+	}
+	return s.submit(ctx, &released, quantity, marketPrice)
+}
+
+// settleAndReload settles fills and refreshes order with the stored state
+func (s *MongoStorage) settleAndReload(ctx context.Context, order *Order, fills []orderbook.Fill) error {
+	settleErr := s.settleFills(ctx, fills)
+
+	if err := s.ordersCol.FindOne(ctx, bson.M{"_id": order.ID}).Decode(order); err != nil {
+		return errors.Join(settleErr, err)
+	}
+	return settleErr
+}
+
+// settleFills applies order book fills to the orders and accounts on each
+// side. Each fill is one transaction; failures are collected and returned so
+// one bad order doesn't block the rest. The book already took the fills out
+// of the resting orders, so the orders of a fill that fails to settle are
+// put back as they are stored. The caller must hold s.matchMutex.
+func (s *MongoStorage) settleFills(ctx context.Context, fills []orderbook.Fill) error {
+	var errs []error
+	var failed []orderbook.Fill
+	for _, fill := range fills {
+		var filled []*Order
+		err := s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+			filled = nil
+			for _, orderID := range []string{fill.BuyOrderID, fill.SellOrderID} {
+				if orderID == orderbook.MarketOrderID {
+					continue
+				}
+				order, err := s.settleOrderFill(sc, orderID, fill.Quantity, fill.Price)
+				if err != nil {
+					return fmt.Errorf("order %s: %w", orderID, err)
+				}
+				filled = append(filled, order)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error settling %s fill: %v", fill.Symbol, err)
+			errs = append(errs, err)
+			failed = append(failed, fill)
+			continue
+		}
+
+		// Bracket follow-ups each run in their own transaction
+		for _, order := range filled {
+			s.changes.order(order.ID)
+			if err := errors.Join(s.fillSibling(ctx, order), s.resolveChildren(ctx, order)); err != nil {
+				log.Printf("Error updating bracket of order %s: %v", order.ID, err)
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if err := s.restoreBook(ctx, failed); err != nil {
+		log.Printf("Error restoring %d failed fills to the order book: %v", len(failed), err)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// restoreBook puts the orders of fills that failed to settle back in their
+// book as they are stored. An order that is gone is taken out of the book.
+func (s *MongoStorage) restoreBook(ctx context.Context, failed []orderbook.Fill) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	ids := fillOrderIDs(failed)
+	cursor, err := s.ordersCol.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return err
+	}
+
+	stored := make(map[string]bool, len(orders))
+	for i := range orders {
+		stored[orders[i].ID] = true
+		s.engine.Restore(orders[i].Symbol, restingBookOrder(&orders[i]))
+	}
+	for _, id := range ids {
+		if !stored[id] {
+			s.engine.Restore(failed[0].Symbol, orderbook.Order{ID: id})
+		}
+	}
+	return nil
+}
+
+// settleOrderFill settles one side of a fill out of the order's hold,
+// records the trade and returns the updated order
+func (s *MongoStorage) settleOrderFill(ctx context.Context, orderID string, quantity int, price money.Amount) (*Order, error) {
+	var order Order
+	if err := s.ordersCol.FindOne(ctx, bson.M{"_id": orderID}).Decode(&order); err != nil {
+		return nil, err
+	}
+	if !order.IsOpen() {
+		return nil, ErrOrderNotOpen
+	}
+
+	change := heldFillChange(&order, quantity, price)
+	if err := s.applyChange(ctx, change); err != nil {
+		return nil, err
+	}
+
+	fill := Fill{Timestamp: time.Now(), Quantity: quantity, Price: price}
+	err := s.updatePosition(ctx, order.Username, order.Symbol, func(position *Position) {
+		fill.RealizedPnL = position.fill(order.Side, quantity, price, fill.Timestamp, s.costBasis)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	before := order
+	recordFill(&order, fill)
+	update := bson.M{
+		"$set": bson.M{
+			"filledQuantity": order.FilledQuantity,
+			"avgFillPrice":   order.AvgFillPrice,
+			"status":         order.Status,
+		},
+		"$push": bson.M{"fills": order.Fills[len(order.Fills)-1]},
+	}
+	if err := s.updateOpenOrder(ctx, &before, update); err != nil {
+		return nil, err
+	}
+
+	trade := newTrade(&order, fill)
+	if _, err := s.tradesCol.InsertOne(ctx, trade); err != nil {
+		return nil, err
+	}
+	if _, err := s.ledgerCol.InsertOne(ctx, fillEntry(change, trade)); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// updatePosition loads an account's position in symbol, lets update change
+// it and stores it
+func (s *MongoStorage) updatePosition(ctx context.Context, username, symbol string, update func(position *Position)) error {
+	key := "positions." + symbol
+	var account UserAccount
+	opts := options.FindOne().SetProjection(bson.M{key: 1})
+	if err := s.usersCol.FindOne(ctx, bson.M{"_id": username}, opts).Decode(&account); err != nil {
+		return err
+	}
+
+	position := account.position(symbol)
+	update(&position)
+	account.setPosition(symbol, position)
+	change := bson.M{"$unset": bson.M{key: ""}}
+	if stored, exists := account.Positions[symbol]; exists {
+		change = bson.M{"$set": bson.M{key: stored}}
+	}
+	_, err := s.usersCol.UpdateOne(ctx, bson.M{"_id": username}, change)
+	return err
+}
+
+// GetOrders returns all orders for a user
+func (s *MongoStorage) GetOrders(username string) []Order {
+	ctx := context.Background()
+
+	filter := bson.M{"username": username}
+	cursor, err := s.ordersCol.Find(ctx, filter)
+	if err != nil {
+		return []Order{}
+	}
+	defer cursor.Close(ctx)
+
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return []Order{}
+	}
+
+	return orders
+}
+
+// findOwnOrder loads an order belonging to username
+func (s *MongoStorage) findOwnOrder(ctx context.Context, username, orderID string) (*Order, error) {
+	var order Order
+	err := s.ordersCol.FindOne(ctx, bson.M{"_id": orderID, "username": username}).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// CancelOrder cancels one of the user's open orders, removes it from the
+// order book and releases its hold
+func (s *MongoStorage) CancelOrder(username, orderID string) (*Order, error) {
+	ctx := context.Background()
+
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	order, err := s.findOwnOrder(ctx, username, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status == StatusInactive {
+		// Holds nothing yet
+		filter := bson.M{"_id": orderID, "status": StatusInactive}
+		result, err := s.ordersCol.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": StatusCancelled}})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, ErrOrderNotOpen
+		}
+		order.Status = StatusCancelled
+		s.changes.order(order.ID)
+		return order, nil
+	}
+	if !order.IsOpen() {
+		return nil, ErrOrderNotOpen
+	}
+
+	if err := s.closeOrder(ctx, order, StatusCancelled, nil); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// closeOrder takes an open order off the book or stop list, then gives it
+// its final status and releases its hold in one transaction. An OCO sibling
+// it was holding for takes over the hold in the same transaction. If the
+// transaction fails the order is put back; otherwise a bracket entry's exits
+// are resolved. The caller must hold s.matchMutex.
+func (s *MongoStorage) closeOrder(ctx context.Context, order *Order, status string, reason *OrderError) error {
+	resting, inBook := s.engine.Cancel(order.Symbol, order.ID)
+	waiting := s.stops.remove(order.Symbol, order.ID)
+	queued := s.queued.remove(order.Symbol, order.ID)
+	var heir *Order
+	err := s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		heir = nil
+		closed := *order
+		setReason(&closed, reason)
+		update := bson.M{"$set": bson.M{"status": status, "rejectReason": closed.RejectReason, "rejectCode": closed.RejectCode}}
+		if err := s.updateOpenOrder(sc, order, update); err != nil {
+			return err
+		}
+		if err := s.applyChange(sc, releaseChange(order)); err != nil {
+			return err
+		}
+		if order.OCOWith == "" {
+			return nil
+		}
+
+		sibling, err := s.findOpenOrder(sc, order.OCOWith)
+		if err != nil || sibling == nil || !sibling.HeldBySibling {
+			return err
+		}
+		if err := s.applyChange(sc, handOverHold(sibling)); err != nil {
+			return err
+		}
+		heir = sibling
+		return s.updateOpenOrder(sc, sibling, bson.M{"$set": bson.M{"heldBySibling": false}})
+	})
+	if err != nil {
+		if inBook {
+			s.engine.Add(order.Symbol, resting)
+		}
+		if waiting {
+			s.stops.add(order)
+		}
+		if queued {
+			s.queued.add(order)
+		}
+		return err
+	}
+
+	order.Status = status
+	setReason(order, reason)
+	s.changes.order(order.ID)
+	if heir != nil {
+		s.stops.update(heir)
+		s.changes.order(heir.ID)
+	}
+	return s.resolveChildren(ctx, order)
+}
+
+// ExpireOrders expires every open order whose expiry has passed by now,
+// releasing its hold, and returns the expired orders
+func (s *MongoStorage) ExpireOrders(now time.Time) ([]Order, error) {
+	ctx := context.Background()
+
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	filter := bson.M{
+		"status":    bson.M{"$in": openStatuses},
+		"expiresAt": bson.M{"$lte": now},
+	}
+	cursor, err := s.ordersCol.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var due []Order
+	if err := cursor.All(ctx, &due); err != nil {
+		return nil, err
+	}
+
+	var expired []Order
+	var errs []error
+	for i := range due {
+		if err := s.closeOrder(ctx, &due[i], StatusExpired, nil); err != nil {
+			errs = append(errs, fmt.Errorf("expire order %s: %w", due[i].ID, err))
+			continue
+		}
+		expired = append(expired, due[i])
+	}
+	return expired, errors.Join(errs...)
+}
+
+// AmendOrder changes the price and/or quantity of one of the user's open
+// limit orders, moving the hold to match. A zero price or quantity leaves
+// that field unchanged. The amended order loses its time priority and may
+// match immediately at its new price.
+func (s *MongoStorage) AmendOrder(username, orderID string, price money.Amount, quantity int) (*Order, error) {
+	ctx := context.Background()
+
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	order, err := s.findOwnOrder(ctx, username, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !order.IsOpen() {
+		return nil, ErrOrderNotOpen
+	}
+	if order.awaitingTrigger() {
+		return nil, ErrAmendStop
+	}
+	if order.ParentID != "" && quantity != 0 {
+		return nil, ErrAmendExit
+	}
+
+	amended := *order
+	if price != 0 {
+		amended.Price = price
+	}
+	if quantity != 0 {
+		amended.Quantity = quantity
+	}
+	if amended.Remaining() <= 0 {
+		return nil, ErrAmendBelowFill
+	}
+
+	stock, exists := s.GetPrice(order.Symbol)
+	if !exists {
+		return nil, ErrStockNotFound
+	}
+	if stock.Halted && !order.Queued {
+		return nil, ErrAmendHalted
+	}
+
+	resting, inBook := s.engine.Cancel(order.Symbol, order.ID)
+	err = s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		update := bson.M{"$set": bson.M{"price": amended.Price, "quantity": amended.Quantity}}
+		if err := s.updateOpenOrder(sc, order, update); err != nil {
+			return err // filled or cancelled in the meantime
+		}
+
+		return s.applyChange(sc, releaseChange(order).add(holdChange(&amended)))
+	})
+	if err != nil {
+		if inBook {
+			s.engine.Add(order.Symbol, resting)
+		}
+		return nil, err
+	}
+	s.changes.order(amended.ID)
+	if amended.awaitingRelease() {
+		s.queued.update(&amended)
+		return &amended, nil
+	}
+
+	fills := s.engine.Submit(amended.Symbol, bookOrder(&amended), stock.Price)
+	err = s.settleAndReload(ctx, &amended, fills)
+	return &amended, err
+}
+
+// UpdatePrice updates a stock price and fills any limit orders it triggers
+func (s *MongoStorage) UpdatePrice(symbol string, newPrice money.Amount, change float64) error {
+	ctx := context.Background()
+
+	// First, get current stock to check day high/low
+	var currentStock StockPrice
+	err := s.pricesCol.FindOne(ctx, bson.M{"_id": symbol}).Decode(&currentStock)
+	if err != nil {
+		return err
+	}
+
+	// Update day high/low
+	dayHigh := currentStock.DayHigh
+	dayLow := currentStock.DayLow
+	if newPrice > dayHigh {
+		dayHigh = newPrice
+	}
+	if newPrice < dayLow || dayLow == 0 {
+		dayLow = newPrice
+	}
+
+	return s.setPrice(ctx, symbol, newPrice, bson.M{
+		"price":   newPrice,
+		"change":  change,
+		"dayHigh": dayHigh,
+		"dayLow":  dayLow,
+	})
+}
+
+// ApplyBar moves a stock's price to the bar's close, as UpdatePrice does,
+// and adds the bar to the day's open, high, low and volume, starting a new
+// day if newDay
+func (s *MongoStorage) ApplyBar(symbol string, bar Bar, change float64, newDay bool) error {
+	ctx := context.Background()
+
+	var currentStock StockPrice
+	err := s.pricesCol.FindOne(ctx, bson.M{"_id": symbol}).Decode(&currentStock)
+	if err != nil {
+		return err
+	}
+	currentStock.foldBar(bar, newDay)
+
+	return s.setPrice(ctx, symbol, bar.Close, bson.M{
+		"price":      bar.Close,
+		"change":     change,
+		"dayOpen":    currentStock.DayOpen,
+		"dayHigh":    currentStock.DayHigh,
+		"dayLow":     currentStock.DayLow,
+		"volume":     currentStock.Volume,
+		"tradingDay": currentStock.TradingDay,
+	})
+}
+
+// setPrice sets a stock's fields, adds its new price to the history and
+// fills any limit orders the price triggers
+func (s *MongoStorage) setPrice(ctx context.Context, symbol string, newPrice money.Amount, fields bson.M) error {
+	// Update price and add to history (keep last 20)
+	update := bson.M{
+		"$set": fields,
+		"$push": bson.M{
+			"priceHistory": bson.M{
+				"$each":  []money.Amount{newPrice},
+				"$slice": -20, // Keep only last 20 items
+			},
+		},
+	}
+
+	if _, err := s.pricesCol.UpdateOne(ctx, bson.M{"_id": symbol}, update); err != nil {
+		return err
+	}
+
+	// Check and update order statuses
+	return s.updateOrderStatuses(ctx, symbol, newPrice)
+}
+
+// StartDay resets every stock's day open, high, low and volume to its
+// current price for day, unless they are already for day
+func (s *MongoStorage) StartDay(day string) error {
+	ctx := context.Background()
+	filter := bson.M{"tradingDay": bson.M{"$ne": day}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"dayOpen":    "$price",
+		"dayHigh":    "$price",
+		"dayLow":     "$price",
+		"volume":     0,
+		"tradingDay": day,
+	}}}}
+	_, err := s.pricesCol.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// SetHalted halts or resumes trading in a stock
+func (s *MongoStorage) SetHalted(symbol string, halted bool) error {
+	ctx := context.Background()
+	result, err := s.pricesCol.UpdateOne(ctx, bson.M{"_id": symbol}, bson.M{"$set": bson.M{"halted": halted}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrStockNotFound
+	}
+	return nil
+}
+
+// GetPrice returns the price for a specific symbol
+func (s *MongoStorage) GetPrice(symbol string) (*StockPrice, bool) {
+	ctx := context.Background()
+
+	var price StockPrice
+	err := s.pricesCol.FindOne(ctx, bson.M{"_id": symbol}).Decode(&price)
+	if err != nil {
+		return nil, false
+	}
+
+	return &price, true
+}
+
+// GetAllPrices returns all stock prices
+func (s *MongoStorage) GetAllPrices() []StockPrice {
+	ctx := context.Background()
+
+	cursor, err := s.pricesCol.Find(ctx, bson.M{})
+	if err != nil {
+		return []StockPrice{}
+	}
+	defer cursor.Close(ctx)
+
+	var prices []StockPrice
+	if err := cursor.All(ctx, &prices); err != nil {
+		return []StockPrice{}
+	}
+
+	return prices
+}
+
+// GetInstruments returns the instrument catalog, delisted instruments
+// included
+func (s *MongoStorage) GetInstruments() []Instrument {
+	ctx := context.Background()
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.instrumentsCol.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return []Instrument{}
+	}
+	defer cursor.Close(ctx)
+
+	var instruments []Instrument
+	if err := cursor.All(ctx, &instruments); err != nil {
+		return []Instrument{}
+	}
+	return instruments
+}
+
+// GetInstrument returns the catalog entry for a symbol
+func (s *MongoStorage) GetInstrument(symbol string) (*Instrument, bool) {
+	ctx := context.Background()
+
+	var instrument Instrument
+	if err := s.instrumentsCol.FindOne(ctx, bson.M{"_id": symbol}).Decode(&instrument); err != nil {
+		return nil, false
+	}
+	return &instrument, true
+}
+
+// CreateInstrument adds an instrument to the catalog and creates its price
+// in one transaction
+func (s *MongoStorage) CreateInstrument(instrument *Instrument) error {
+	ctx := context.Background()
+	instrument.CreatedAt = time.Now()
+	instrument.UpdatedAt = instrument.CreatedAt
+
+	return s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		if _, err := s.instrumentsCol.InsertOne(sc, instrument); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return ErrInstrumentExists
+			}
+			return err
+		}
+		return s.insertPrice(sc, instrument)
+	})
+}
+
+// UpdateInstrument changes an instrument's details, and the name and logo
+// of its price. Its creation time and tradable flag are kept, and
+// instrument is refreshed with the stored state.
+func (s *MongoStorage) UpdateInstrument(instrument *Instrument) error {
+	ctx := context.Background()
+
+	update := bson.M{"$set": bson.M{
+		"name":          instrument.Name,
+		"logo":          instrument.Logo,
+		"tickSize":      instrument.TickSize,
+		"lotSize":       instrument.LotSize,
+		"minQuantity":   instrument.MinQuantity,
+		"maxQuantity":   instrument.MaxQuantity,
+		"startingPrice": instrument.StartingPrice,
+		"model":         instrument.Model,
+		"updatedAt":     time.Now(),
+	}}
+	return s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := s.instrumentsCol.FindOneAndUpdate(sc, bson.M{"_id": instrument.Symbol}, update, opts).Decode(instrument)
+		if err == mongo.ErrNoDocuments {
+			return ErrStockNotFound
+		}
+		if err != nil {
+			return err
+		}
+		priceUpdate := bson.M{"$set": bson.M{"name": instrument.Name, "logo": instrument.Logo}}
+		_, err = s.pricesCol.UpdateOne(sc, bson.M{"_id": instrument.Symbol}, priceUpdate)
+		return err
+	})
+}
+
+// SetTradable lists or delists an instrument. Delisting cancels every open
+// and inactive order in it, releasing their holds.
+func (s *MongoStorage) SetTradable(symbol string, tradable bool) error {
+	ctx := context.Background()
+
+	update := bson.M{"$set": bson.M{"tradable": tradable, "updatedAt": time.Now()}}
+	result, err := s.instrumentsCol.UpdateOne(ctx, bson.M{"_id": symbol}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrStockNotFound
+	}
+	if tradable {
+		return nil
+	}
+
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	// Cancel the inactive bracket exits first, so closing their entries
+	// doesn't activate them
+	filter := bson.M{"symbol": symbol, "status": StatusInactive}
+	cursor, err := s.ordersCol.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var inactive []Order
+	if err := cursor.All(ctx, &inactive); err != nil {
+		return err
+	}
+	for _, order := range inactive {
+		update := bson.M{"$set": bson.M{"status": StatusCancelled, "rejectReason": errDelisted.Message, "rejectCode": errDelisted.Code}}
+		result, err := s.ordersCol.UpdateOne(ctx, bson.M{"_id": order.ID, "status": StatusInactive}, update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount > 0 {
+			s.changes.order(order.ID)
+		}
+	}
+
+	cursor, err = s.ordersCol.Find(ctx, bson.M{"symbol": symbol, "status": bson.M{"$in": openStatuses}})
+	if err != nil {
+		return err
+	}
+	var open []Order
+	if err := cursor.All(ctx, &open); err != nil {
+		return err
+	}
+	var errs []error
+	for i := range open {
+		if err := s.closeOrder(ctx, &open[i], StatusCancelled, errDelisted); err != nil {
+			errs = append(errs, fmt.Errorf("cancel order %s: %w", open[i].ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AdjustAccount applies a deposit, withdrawal, fee or adjustment to an
+// account and journals it in one transaction. Nothing is applied if a
+// balance would go negative.
+func (s *MongoStorage) AdjustAccount(adjustment Adjustment) (*LedgerEntry, error) {
+	ctx := context.Background()
+
+	change, counterparty, err := adjustment.change()
+	if err != nil {
+		return nil, err
+	}
+	count, err := s.usersCol.CountDocuments(ctx, bson.M{"_id": adjustment.Username})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, &OrderError{ReasonAccountNotFound, "Account not found"}
+	}
+
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	now := time.Now()
+	entry := adjustmentEntry(adjustment, change, counterparty, now)
+	err = s.withTransaction(ctx, func(sc mongo.SessionContext) error {
+		if err := s.applyChange(sc, change); err != nil {
+			return err
+		}
+		if change.Shares != 0 {
+			var price money.Amount
+			if stock, exists := s.GetPrice(change.Symbol); exists {
+				price = stock.Price
+			}
+			err := s.updatePosition(sc, adjustment.Username, change.Symbol, func(position *Position) {
+				position.adjust(change.Shares, price, now, s.costBasis)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		_, err := s.ledgerCol.InsertOne(sc, entry)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// GetLedger returns a user's ledger entries, oldest first, or every entry
+// if username is empty
+func (s *MongoStorage) GetLedger(username string) []LedgerEntry {
+	ctx := context.Background()
+
+	filter := bson.M{}
+	if username != "" {
+		filter["username"] = username
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.ledgerCol.Find(ctx, filter, opts)
+	if err != nil {
+		return []LedgerEntry{}
+	}
+	defer cursor.Close(ctx)
+
+	entries := []LedgerEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return []LedgerEntry{}
+	}
+	return entries
+}
+
+// Reconcile recomputes every account's total credits and shares from the
+// ledger and reports the ones that differ. It holds s.matchMutex so no fill
+// settles on this replica while it reads.
+func (s *MongoStorage) Reconcile() (*Reconciliation, error) {
+	ctx := context.Background()
+
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	result := &Reconciliation{Unbalanced: []string{}, CheckedAt: time.Now()}
+	entries, err := s.ledgerCol.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	result.Entries = int(entries)
+
+	// Entries whose postings don't sum to zero for some asset
+	cursor, err := s.ledgerCol.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$postings"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      bson.M{"entry": "$_id", "symbol": "$postings.symbol"},
+			"amount":   bson.M{"$sum": "$postings.amount"},
+			"quantity": bson.M{"$sum": "$postings.quantity"},
+		}}},
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"amount": bson.M{"$ne": 0}},
+			bson.M{"quantity": bson.M{"$ne": 0}},
+		}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$_id.entry"}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var unbalanced []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &unbalanced); err != nil {
+		return nil, err
+	}
+	for _, entry := range unbalanced {
+		result.Unbalanced = append(result.Unbalanced, entry.ID)
+	}
+
+	// Ledger balances of the user accounts, one posting per account and
+	// asset
+	cursor, err = s.ledgerCol.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$postings"}},
+		{{Key: "$match", Value: bson.M{"postings.account": bson.M{"$regex": "^user:"}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      bson.M{"account": "$postings.account", "symbol": "$postings.symbol"},
+			"amount":   bson.M{"$sum": "$postings.amount"},
+			"quantity": bson.M{"$sum": "$postings.quantity"},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var sums []struct {
+		ID struct {
+			Account string `bson:"account"`
+			Symbol  string `bson:"symbol"`
+		} `bson:"_id"`
+		Amount   money.Amount `bson:"amount"`
+		Quantity int          `bson:"quantity"`
+	}
+	if err := cursor.All(ctx, &sums); err != nil {
+		return nil, err
+	}
+	postings := make([]Posting, 0, len(sums))
+	for _, sum := range sums {
+		postings = append(postings, Posting{Account: sum.ID.Account, Symbol: sum.ID.Symbol, Amount: sum.Amount, Quantity: sum.Quantity})
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err = s.usersCol.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var accounts []UserAccount
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+	result.Accounts = len(accounts)
+	result.Mismatches = reconcile(accounts, ledgerBalances(postings))
+	return result, nil
+}
+
+// updateOrderStatuses triggers the stop orders the new market price reaches,
+// then lets it fill the resting orders it crosses
+func (s *MongoStorage) updateOrderStatuses(ctx context.Context, symbol string, currentPrice money.Amount) error {
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	stopErr := s.triggerStops(ctx, symbol, currentPrice)
+	return errors.Join(stopErr, s.settleFills(ctx, s.engine.MarketTick(symbol, currentPrice)))
+}
+
+// ReloadBooks rebuilds the order books, stop lists and queues from the
+// stored open orders. Only the leader matches orders, so a replica that
+// becomes the leader reloads them to pick up what the last one did.
+func (s *MongoStorage) ReloadBooks() error {
+	s.matchMutex.Lock()
+	defer s.unlockMatch()
+
+	s.engine.Reset()
+	s.stops = make(stopList)
+	s.queued = make(stopList)
+	return s.loadOrderBooks(context.Background())
+}
+
+// GetOrderBook returns up to depth aggregated levels per side of symbol's
+// order book
+func (s *MongoStorage) GetOrderBook(symbol string, depth int) orderbook.Depth {
+	return s.engine.Depth(symbol, depth)
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"stocks-backend/internal/money"
+	"time"
+)
+
+// Positions track what the shares of each symbol an account holds cost, so
+// gains can be reported. A position's Quantity is the account's total
+// shares, held ones included. Buys add the shares at what they cost; sells
+// take the cost of the shares sold out of the position by the configured
+// CostBasisMethod and book the rest of the proceeds as realized P&L.
+
+// CostBasisMethod is how the cost of the shares sold is chosen
+type CostBasisMethod string
+
+// Cost basis methods
+const (
+	CostAverage CostBasisMethod = "average" // shares sold cost the position's average cost
+	CostFIFO    CostBasisMethod = "fifo"    // shares sold come from the oldest lots
+	CostLIFO    CostBasisMethod = "lifo"    // shares sold come from the newest lots
+)
+
+// ParseCostBasisMethod reads a cost basis method name
+func ParseCostBasisMethod(name string) (CostBasisMethod, error) {
+	switch method := CostBasisMethod(name); method {
+	case CostAverage, CostFIFO, CostLIFO:
+		return method, nil
+	case "":
+		return CostAverage, nil
+	default:
+		return "", fmt.Errorf("unknown cost basis method %q", name)
+	}
+}
+
+// Position is an account's holding in one symbol and what it cost. A
+// position whose shares have all been sold is kept for its realized P&L.
+type Position struct {
+	Quantity    int          `json:"quantity" bson:"quantity"`             // total shares, held included
+	CostBasis   money.Amount `json:"costBasis" bson:"costBasis"`           // what those shares cost
+	RealizedPnL money.Amount `json:"realizedPnl" bson:"realizedPnl"`       // booked by sells so far
+	Lots        []Lot        `json:"lots,omitempty" bson:"lots,omitempty"` // oldest first, fifo and lifo only
+}
+
+// Lot is shares bought together
+type Lot struct {
+	Quantity   int          `json:"quantity" bson:"quantity"`
+	Cost       money.Amount `json:"cost" bson:"cost"` // of all the lot's shares
+	AcquiredAt time.Time    `json:"acquiredAt" bson:"acquiredAt"`
+}
+
+// AverageCost returns the cost of one share of the position
+func (p *Position) AverageCost() money.Amount {
+	if p.Quantity <= 0 {
+		return 0
+	}
+	return p.CostBasis.Div(p.Quantity)
+}
+
+// fill applies one side of a fill to the position and returns the P&L it
+// realizes: the proceeds of a sell less what the shares sold cost
+func (p *Position) fill(side string, quantity int, price money.Amount, at time.Time, method CostBasisMethod) money.Amount {
+	if side == "buy" {
+		p.add(quantity, price.Mul(quantity), at, method)
+		return 0
+	}
+	realized := price.Mul(quantity) - p.remove(quantity, method)
+	p.RealizedPnL += realized
+	return realized
+}
+
+// adjust adds shares at price, or removes -shares at their cost without
+// realizing anything
+func (p *Position) adjust(shares int, price money.Amount, at time.Time, method CostBasisMethod) {
+	if shares > 0 {
+		p.add(shares, price.Mul(shares), at, method)
+	} else if shares < 0 {
+		p.remove(-shares, method)
+	}
+}
+
+// add adds quantity shares that cost cost
+func (p *Position) add(quantity int, cost money.Amount, at time.Time, method CostBasisMethod) {
+	if method == CostAverage {
+		p.Lots = nil
+	} else {
+		p.syncLots(at)
+		p.Lots = append(p.Lots, Lot{Quantity: quantity, Cost: cost, AcquiredAt: at})
+	}
+	p.Quantity += quantity
+	p.CostBasis += cost
+}
+
+// remove takes quantity shares out of the position and returns what they
+// cost
+func (p *Position) remove(quantity int, method CostBasisMethod) money.Amount {
+	if quantity >= p.Quantity {
+		cost := p.CostBasis
+		p.Quantity, p.CostBasis, p.Lots = 0, 0, nil
+		return cost
+	}
+
+	var cost money.Amount
+	if method == CostAverage {
+		p.Lots = nil
+		cost = p.CostBasis.MulDiv(quantity, p.Quantity)
+	} else {
+		p.syncLots(time.Time{})
+		for remaining := quantity; remaining > 0; {
+			i := 0
+			if method == CostLIFO {
+				i = len(p.Lots) - 1
+			}
+			lot := &p.Lots[i]
+			take := min(remaining, lot.Quantity)
+			part := lot.Cost.MulDiv(take, lot.Quantity)
+			lot.Quantity -= take
+			lot.Cost -= part
+			cost += part
+			remaining -= take
+			if lot.Quantity == 0 {
+				p.Lots = append(p.Lots[:i], p.Lots[i+1:]...)
+			}
+		}
+	}
+	p.Quantity -= quantity
+	p.CostBasis -= cost
+	return cost
+}
+
+// syncLots replaces lots that don't add up to the position, kept under
+// another method, with one lot of all its shares
+func (p *Position) syncLots(at time.Time) {
+	quantity := 0
+	for _, lot := range p.Lots {
+		quantity += lot.Quantity
+	}
+	if quantity == p.Quantity {
+		return
+	}
+	p.Lots = nil
+	if p.Quantity > 0 {
+		p.Lots = []Lot{{Quantity: p.Quantity, Cost: p.CostBasis, AcquiredAt: at}}
+	}
+}
+
+// copyPosition returns a copy that shares no lots with position
+func copyPosition(position Position) Position {
+	position.Lots = append([]Lot(nil), position.Lots...)
+	return position
+}
+
+// position returns a copy of the account's position in symbol
+func (a *UserAccount) position(symbol string) Position {
+	return copyPosition(a.Positions[symbol])
+}
+
+// setPosition stores the account's position in symbol, dropping it once
+// it holds nothing and has realized nothing
+func (a *UserAccount) setPosition(symbol string, position Position) {
+	if position.Quantity == 0 && position.RealizedPnL == 0 {
+		delete(a.Positions, symbol)
+		return
+	}
+	if a.Positions == nil {
+		a.Positions = make(map[string]Position)
+	}
+	a.Positions[symbol] = position
+}
+
+// PositionValue is a position valued at the current price. The day change
+// is what the shares gained since the day's open.
+type PositionValue struct {
+	Symbol        string       `json:"symbol"`
+	Quantity      int          `json:"quantity"`
+	AverageCost   money.Amount `json:"averageCost"`
+	CostBasis     money.Amount `json:"costBasis"`
+	Price         money.Amount `json:"price"`
+	MarketValue   money.Amount `json:"marketValue"`
+	UnrealizedPnL money.Amount `json:"unrealizedPnl"`
+	UnrealizedPct float64      `json:"unrealizedPnlPercent"`
+	DayChange     money.Amount `json:"dayChange"`
+	DayChangePct  float64      `json:"dayChangePercent"`
+	RealizedPnL   money.Amount `json:"realizedPnl"`
+	Lots          []Lot        `json:"lots,omitempty"`
+}
+
+// Valuation is an account's positions valued at the current prices, with
+// their totals
+type Valuation struct {
+	Positions     []PositionValue `json:"positions"`
+	MarketValue   money.Amount    `json:"marketValue"`
+	CostBasis     money.Amount    `json:"costBasis"`
+	UnrealizedPnL money.Amount    `json:"unrealizedPnl"`
+	DayChange     money.Amount    `json:"dayChange"`
+	RealizedPnL   money.Amount    `json:"realizedPnl"`
+}
+
+// Value values the account's positions at prices, by symbol. Positions
+// without a price are valued at cost.
+func (a *UserAccount) Value(prices map[string]StockPrice) Valuation {
+	symbols := make([]string, 0, len(a.Positions))
+	for symbol := range a.Positions {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	valuation := Valuation{Positions: make([]PositionValue, 0, len(symbols))}
+	for _, symbol := range symbols {
+		position := a.Positions[symbol]
+		value := PositionValue{
+			Symbol:      symbol,
+			Quantity:    position.Quantity,
+			AverageCost: position.AverageCost(),
+			CostBasis:   position.CostBasis,
+			Price:       position.AverageCost(),
+			MarketValue: position.CostBasis,
+			RealizedPnL: position.RealizedPnL,
+			Lots:        position.Lots,
+		}
+		if price, exists := prices[symbol]; exists {
+			value.Price = price.Price
+			value.MarketValue = price.Price.Mul(position.Quantity)
+			if price.DayOpen > 0 {
+				value.DayChange = (price.Price - price.DayOpen).Mul(position.Quantity)
+				value.DayChangePct = percentOf(price.Price-price.DayOpen, price.DayOpen)
+			}
+		}
+		value.UnrealizedPnL = value.MarketValue - position.CostBasis
+		value.UnrealizedPct = percentOf(value.UnrealizedPnL, position.CostBasis)
+
+		valuation.Positions = append(valuation.Positions, value)
+		valuation.MarketValue += value.MarketValue
+		valuation.CostBasis += value.CostBasis
+		valuation.UnrealizedPnL += value.UnrealizedPnL
+		valuation.DayChange += value.DayChange
+		valuation.RealizedPnL += value.RealizedPnL
+	}
+	return valuation
+}
+
+// percentOf returns part as a percentage of whole, to 2 decimal places
+func percentOf(part, whole money.Amount) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return math.Round(part.Float64()/whole.Float64()*10000) / 100
+}
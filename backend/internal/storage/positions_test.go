@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"stocks-backend/internal/money"
+)
+
+// step is one fill applied to a position, at the step's index in hours
+// after the first
+type step struct {
+	side     string
+	quantity int
+	price    money.Amount
+	method   CostBasisMethod
+}
+
+// at returns the time of the i'th step
+func at(i int) time.Time {
+	return time.Date(2024, 3, 1, 14, 30, 0, 0, time.UTC).Add(time.Duration(i) * time.Hour)
+}
+
+func TestPositionFill(t *testing.T) {
+	buy := func(quantity int, price int64, method CostBasisMethod) step {
+		return step{"buy", quantity, money.FromInt(price), method}
+	}
+	sell := func(quantity int, price int64, method CostBasisMethod) step {
+		return step{"sell", quantity, money.FromInt(price), method}
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		want  Position
+	}{
+		{
+			name:  "average sell takes the average cost",
+			steps: []step{buy(10, 100, CostAverage), buy(10, 120, CostAverage), sell(15, 130, CostAverage)},
+			want:  Position{Quantity: 5, CostBasis: money.FromInt(550), RealizedPnL: money.FromInt(300)},
+		},
+		{
+			name:  "fifo sell takes the oldest lots, part of the next",
+			steps: []step{buy(10, 100, CostFIFO), buy(10, 120, CostFIFO), sell(15, 130, CostFIFO)},
+			want: Position{Quantity: 5, CostBasis: money.FromInt(600), RealizedPnL: money.FromInt(350),
+				Lots: []Lot{{Quantity: 5, Cost: money.FromInt(600), AcquiredAt: at(1)}}},
+		},
+		{
+			name:  "lifo sell takes the newest lots, part of the next",
+			steps: []step{buy(10, 100, CostLIFO), buy(10, 120, CostLIFO), sell(15, 130, CostLIFO)},
+			want: Position{Quantity: 5, CostBasis: money.FromInt(500), RealizedPnL: money.FromInt(250),
+				Lots: []Lot{{Quantity: 5, Cost: money.FromInt(500), AcquiredAt: at(0)}}},
+		},
+		{
+			name:  "fifo sell of exactly the oldest lot",
+			steps: []step{buy(10, 100, CostFIFO), buy(10, 120, CostFIFO), sell(10, 130, CostFIFO)},
+			want: Position{Quantity: 10, CostBasis: money.FromInt(1200), RealizedPnL: money.FromInt(300),
+				Lots: []Lot{{Quantity: 10, Cost: money.FromInt(1200), AcquiredAt: at(1)}}},
+		},
+		{
+			name: "average sell rounds its share of the cost",
+			steps: []step{
+				{"buy", 2, money.FromFloat(1.0001), CostAverage},
+				buy(1, 1, CostAverage),
+				sell(1, 2, CostAverage),
+			},
+			want: Position{Quantity: 2, CostBasis: money.FromFloat(2.0001), RealizedPnL: money.FromFloat(0.9999)},
+		},
+		{
+			name:  "switching from average to fifo collapses the position into one lot",
+			steps: []step{buy(10, 100, CostAverage), buy(10, 120, CostAverage), sell(5, 130, CostFIFO)},
+			want: Position{Quantity: 15, CostBasis: money.FromInt(1650), RealizedPnL: money.FromInt(100),
+				Lots: []Lot{{Quantity: 15, Cost: money.FromInt(1650)}}},
+		},
+		{
+			name: "switching to lifo rounds a partial take of the collapsed lot",
+			steps: []step{
+				{"buy", 2, money.FromFloat(1.0001), CostAverage},
+				buy(1, 1, CostAverage),
+				sell(1, 2, CostLIFO),
+			},
+			want: Position{Quantity: 2, CostBasis: money.FromFloat(2.0001), RealizedPnL: money.FromFloat(0.9999),
+				Lots: []Lot{{Quantity: 2, Cost: money.FromFloat(2.0001)}}},
+		},
+		{
+			name: "switching from fifo to average drops the lots, and back collapses them",
+			steps: []step{
+				buy(10, 100, CostFIFO), buy(10, 120, CostFIFO),
+				sell(10, 130, CostAverage),
+				buy(5, 140, CostFIFO),
+			},
+			want: Position{Quantity: 15, CostBasis: money.FromInt(1800), RealizedPnL: money.FromInt(200),
+				Lots: []Lot{
+					{Quantity: 10, Cost: money.FromInt(1100), AcquiredAt: at(3)},
+					{Quantity: 5, Cost: money.FromInt(700), AcquiredAt: at(3)},
+				}},
+		},
+		{
+			name:  "switching from fifo to lifo keeps the lots",
+			steps: []step{buy(10, 100, CostFIFO), buy(10, 120, CostFIFO), sell(5, 130, CostLIFO)},
+			want: Position{Quantity: 15, CostBasis: money.FromInt(1600), RealizedPnL: money.FromInt(50),
+				Lots: []Lot{
+					{Quantity: 10, Cost: money.FromInt(1000), AcquiredAt: at(0)},
+					{Quantity: 5, Cost: money.FromInt(600), AcquiredAt: at(1)},
+				}},
+		},
+	}
+	// A sell larger than the position realizes against all of its cost,
+	// whatever the method
+	for _, method := range []CostBasisMethod{CostAverage, CostFIFO, CostLIFO} {
+		tests = append(tests, struct {
+			name  string
+			steps []step
+			want  Position
+		}{
+			name:  string(method) + " sell larger than the position",
+			steps: []step{buy(10, 100, method), buy(5, 110, method), sell(20, 120, method)},
+			want:  Position{RealizedPnL: money.FromInt(2400 - 1550)},
+		})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var position Position
+			var realized money.Amount
+			for i, s := range tt.steps {
+				realized += position.fill(s.side, s.quantity, s.price, at(i), s.method)
+			}
+			if !reflect.DeepEqual(position, tt.want) {
+				t.Errorf("position = %+v, want %+v", position, tt.want)
+			}
+			if realized != tt.want.RealizedPnL {
+				t.Errorf("fills realized %s, want %s", realized, tt.want.RealizedPnL)
+			}
+		})
+	}
+}
+
+func TestPositionAdjust(t *testing.T) {
+	for _, method := range []CostBasisMethod{CostAverage, CostFIFO, CostLIFO} {
+		t.Run(string(method), func(t *testing.T) {
+			var position Position
+			position.adjust(10, money.FromInt(100), at(0), method)
+			position.adjust(10, money.FromInt(120), at(1), method)
+			position.adjust(-10, money.FromInt(500), at(2), method)
+
+			want := map[CostBasisMethod]money.Amount{
+				CostAverage: money.FromInt(1100),
+				CostFIFO:    money.FromInt(1200),
+				CostLIFO:    money.FromInt(1000),
+			}[method]
+			if position.Quantity != 10 || position.CostBasis != want || position.RealizedPnL != 0 {
+				t.Errorf("position = %+v, want 10 shares costing %s and nothing realized", position, want)
+			}
+		})
+	}
+}
+
+func TestValue(t *testing.T) {
+	account := UserAccount{
+		Username: "alice",
+		Positions: map[string]Position{
+			"AAPL":  {Quantity: 10, CostBasis: money.FromInt(1000)},
+			"MSFT":  {Quantity: 5, CostBasis: money.FromInt(500), RealizedPnL: money.FromInt(20)},
+			"GOOGL": {RealizedPnL: money.FromInt(-30)},
+			"TSLA":  {Quantity: 2, CostBasis: money.FromInt(300)},
+		},
+	}
+	prices := map[string]StockPrice{
+		"AAPL":  {Symbol: "AAPL", Price: money.FromInt(120), DayOpen: money.FromInt(110)},
+		"MSFT":  {Symbol: "MSFT", Price: money.FromInt(90)},
+		"GOOGL": {Symbol: "GOOGL", Price: money.FromInt(50), DayOpen: money.FromInt(40)},
+	}
+
+	want := Valuation{
+		Positions: []PositionValue{
+			{
+				Symbol: "AAPL", Quantity: 10, AverageCost: money.FromInt(100), CostBasis: money.FromInt(1000),
+				Price: money.FromInt(120), MarketValue: money.FromInt(1200),
+				UnrealizedPnL: money.FromInt(200), UnrealizedPct: 20,
+				DayChange: money.FromInt(100), DayChangePct: 9.09,
+			},
+			{
+				// closed, kept for what it realized
+				Symbol: "GOOGL", Price: money.FromInt(50), DayChangePct: 25, RealizedPnL: money.FromInt(-30),
+			},
+			{
+				// no day open yet, so no day change
+				Symbol: "MSFT", Quantity: 5, AverageCost: money.FromInt(100), CostBasis: money.FromInt(500),
+				Price: money.FromInt(90), MarketValue: money.FromInt(450),
+				UnrealizedPnL: money.FromInt(-50), UnrealizedPct: -10, RealizedPnL: money.FromInt(20),
+			},
+			{
+				// no price, so valued at cost
+				Symbol: "TSLA", Quantity: 2, AverageCost: money.FromInt(150), CostBasis: money.FromInt(300),
+				Price: money.FromInt(150), MarketValue: money.FromInt(300),
+			},
+		},
+		MarketValue:   money.FromInt(1950),
+		CostBasis:     money.FromInt(1800),
+		UnrealizedPnL: money.FromInt(150),
+		DayChange:     money.FromInt(100),
+		RealizedPnL:   money.FromInt(-10),
+	}
+	if got := account.Value(prices); !reflect.DeepEqual(got, want) {
+		t.Errorf("Value() = %+v\nwant %+v", got, want)
+	}
+
+	if got := (&UserAccount{}).Value(prices); len(got.Positions) != 0 || got.MarketValue != 0 {
+		t.Errorf("Value() of no positions = %+v", got)
+	}
+}
@@ -0,0 +1,28 @@
+package storage
+
+import "stocks-backend/internal/money"
+
+// Orders placed while their symbol can't trade, because the market is
+// closed or the symbol is halted, are queued. A queued order is open and
+// holds its funds like any other, and can be amended, cancelled or expire,
+// but it stays off the book until ReleaseQueued submits it. Queued market
+// orders must be covered in full at the price they were placed at, and are
+// re-priced at the market when released, like a triggered stop.
+
+// awaitingRelease reports whether the order is an open order waiting in the
+// queue
+func (o *Order) awaitingRelease() bool {
+	return o.Queued && o.IsOpen()
+}
+
+// releaseOrder takes a queued order out of the queue at marketPrice. It
+// returns the balance change that moves the hold of a market order to the
+// new price and the quantity to submit to the book; a market buy the
+// account can no longer pay for at all is rejected, as for triggerStop.
+func releaseOrder(account *UserAccount, order *Order, marketPrice money.Amount) (balanceChange, int, error) {
+	order.Queued = false
+	if order.OrderType != "market" {
+		return balanceChange{}, order.Remaining(), nil
+	}
+	return reholdAtMarket(account, order, releaseChange(order), marketPrice)
+}
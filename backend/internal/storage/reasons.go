@@ -0,0 +1,58 @@
+package storage
+
+// Reason codes say why an order or order request was refused, so clients
+// can act on it without parsing the message. The API returns them as "code"
+// next to the "error" message, and rejected orders keep theirs in
+// RejectCode.
+const (
+	// Malformed requests
+	ReasonInvalidBody        = "INVALID_BODY"
+	ReasonInvalidSymbol      = "INVALID_SYMBOL"
+	ReasonInvalidSide        = "INVALID_SIDE"
+	ReasonInvalidOrderType   = "INVALID_ORDER_TYPE"
+	ReasonInvalidQuantity    = "INVALID_QUANTITY"
+	ReasonInvalidPrice       = "INVALID_PRICE"
+	ReasonInvalidStop        = "INVALID_STOP"
+	ReasonInvalidBracket     = "INVALID_BRACKET"
+	ReasonInvalidTimeInForce = "INVALID_TIME_IN_FORCE"
+
+	// Instrument rules
+	ReasonUnknownSymbol    = "UNKNOWN_SYMBOL"
+	ReasonDelisted         = "SYMBOL_DELISTED"
+	ReasonPriceOffTick     = "PRICE_OFF_TICK"
+	ReasonPriceOutsideBand = "PRICE_OUTSIDE_BAND"
+	ReasonQuantityOffLot   = "QUANTITY_OFF_LOT"
+	ReasonQuantityBelowMin = "QUANTITY_BELOW_MIN"
+	ReasonQuantityAboveMax = "QUANTITY_ABOVE_MAX"
+	ReasonInstrumentExists = "INSTRUMENT_EXISTS"
+
+	// Market sessions and halts
+	ReasonMarketClosed   = "MARKET_CLOSED"
+	ReasonHalted         = "SYMBOL_HALTED"
+	ReasonOutsideRegular = "OUTSIDE_REGULAR_SESSION"
+
+	// Accounts and balances
+	ReasonAccountNotFound     = "ACCOUNT_NOT_FOUND"
+	ReasonInsufficientCredits = "INSUFFICIENT_CREDITS"
+	ReasonInsufficientShares  = "INSUFFICIENT_SHARES"
+	ReasonHoldMismatch        = "HOLD_MISMATCH"
+	ReasonInvalidAdjustment   = "INVALID_ADJUSTMENT"
+
+	// Changes to existing orders
+	ReasonOrderNotFound  = "ORDER_NOT_FOUND"
+	ReasonOrderNotOpen   = "ORDER_NOT_OPEN"
+	ReasonAmendBelowFill = "AMEND_BELOW_FILL"
+	ReasonAmendStop      = "AMEND_STOP"
+	ReasonAmendExit      = "AMEND_EXIT"
+	ReasonAmendHalted    = "AMEND_HALTED"
+
+	// Orders closed unfilled
+	ReasonIOCUnfilled      = "IOC_UNFILLED"
+	ReasonFOKUnfilled      = "FOK_UNFILLED"
+	ReasonEntryNotFilled   = "ENTRY_NOT_FILLED"
+	ReasonSiblingFilled    = "OCO_SIBLING_FILLED"
+	ReasonSiblingTriggered = "OCO_SIBLING_TRIGGERED"
+
+	// Anything unexpected, reported without details
+	ReasonInternal = "INTERNAL_ERROR"
+)
@@ -0,0 +1,155 @@
+package storage
+
+import "stocks-backend/internal/money"
+
+// Stop orders wait off the book until the market price reaches their stop
+// price: at or above it for buys, at or below it for sells. Once triggered a
+// stop or trailing_stop order executes like a market order and a stop_limit
+// order rests in the book as a limit order at Price.
+//
+// A trailing_stop order's stop price follows the market at a fixed distance,
+// TrailAmount or TrailPercent of the water mark: the highest price seen for
+// sells, the lowest for buys. The stop only ever moves in the order's favour.
+//
+// Until it triggers, a stop order is held like a limit order at Price. Stop
+// and trailing_stop orders are held at their initial stop price, then re-held
+// at the market price when they trigger.
+
+// isStopType reports whether orderType waits for a stop price
+func isStopType(orderType string) bool {
+	return orderType == "stop" || orderType == "stop_limit" || orderType == "trailing_stop"
+}
+
+// awaitingTrigger reports whether the order is an open stop order that has
+// not triggered yet
+func (o *Order) awaitingTrigger() bool {
+	return isStopType(o.OrderType) && !o.Triggered && o.IsOpen()
+}
+
+// executesAsMarket reports whether the order fills against the market
+// instead of resting in the book
+func (o *Order) executesAsMarket() bool {
+	switch o.OrderType {
+	case "market":
+		return true
+	case "stop", "trailing_stop":
+		return o.Triggered
+	default:
+		return false
+	}
+}
+
+// initStop sets up a new stop order at the current market price
+func initStop(order *Order, marketPrice money.Amount) {
+	if order.OrderType == "trailing_stop" {
+		order.WaterMark = marketPrice
+		order.StopPrice = trailingStopPrice(order)
+	}
+	if order.OrderType != "stop_limit" {
+		order.Price = order.StopPrice
+	}
+}
+
+// trailingStopPrice returns the stop price at the order's trail from its
+// water mark
+func trailingStopPrice(order *Order) money.Amount {
+	trail := order.TrailAmount
+	if order.TrailPercent > 0 {
+		trail = order.WaterMark.Percent(order.TrailPercent)
+	}
+	if order.Side == "sell" {
+		return (order.WaterMark - trail).Round(money.Cent)
+	}
+	return (order.WaterMark + trail).Round(money.Cent)
+}
+
+// trailStop moves a trailing stop's water mark and stop price with the
+// market, reporting whether they changed
+func trailStop(order *Order, marketPrice money.Amount) bool {
+	if order.OrderType != "trailing_stop" {
+		return false
+	}
+	if order.Side == "sell" && marketPrice <= order.WaterMark ||
+		order.Side == "buy" && marketPrice >= order.WaterMark {
+		return false
+	}
+	order.WaterMark = marketPrice
+	order.StopPrice = trailingStopPrice(order)
+	return true
+}
+
+// stopTriggered reports whether marketPrice reaches the order's stop price
+func stopTriggered(order *Order, marketPrice money.Amount) bool {
+	if order.Side == "buy" {
+		return marketPrice >= order.StopPrice
+	}
+	return marketPrice <= order.StopPrice
+}
+
+// triggerStop converts a triggered stop order into the order it executes as.
+// It returns the balance change that moves the hold to the new price and the
+// quantity to submit to the book. A triggered market buy is cut down to what
+// account can pay for; if that is nothing, the change only releases the hold
+// and the rejection reason is returned.
+func triggerStop(account *UserAccount, order *Order, marketPrice money.Amount) (balanceChange, int, error) {
+	release := releaseChange(order)
+	order.Triggered = true
+	if order.OrderType == "stop_limit" {
+		return balanceChange{}, order.Remaining(), nil
+	}
+	return reholdAtMarket(account, order, release, marketPrice)
+}
+
+// reholdAtMarket prices an order that executes against the market at
+// marketPrice and swaps release, its current hold, for one at that price. A
+// market buy is cut down to what account can pay for; if that is nothing,
+// the change only releases the hold and the rejection reason is returned.
+func reholdAtMarket(account *UserAccount, order *Order, release balanceChange, marketPrice money.Amount) (balanceChange, int, error) {
+	order.Price = marketPrice.Round(money.Cent)
+	released := copyAccount(account)
+	if err := release.apply(released); err != nil {
+		return balanceChange{}, 0, err
+	}
+	quantity, err := placementQuantity(released, order)
+	if err != nil {
+		return release, 0, err
+	}
+	return release.add(holdChangeFor(order, quantity)), quantity, nil
+}
+
+// stopList holds each symbol's stop orders that are waiting to trigger, in
+// placement order. It is not safe for concurrent use.
+type stopList map[string][]*Order
+
+// add appends an order to its symbol's list
+func (l stopList) add(order *Order) {
+	l[order.Symbol] = append(l[order.Symbol], order)
+}
+
+// remove drops an order from its symbol's list, reporting whether it was
+// there
+func (l stopList) remove(symbol, orderID string) bool {
+	for i, order := range l[symbol] {
+		if order.ID == orderID {
+			l[symbol] = append(l[symbol][:i:i], l[symbol][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// update replaces the listed copy of an order with order, keeping its place
+func (l stopList) update(order *Order) {
+	for i, listed := range l[order.Symbol] {
+		if listed.ID == order.ID {
+			l[order.Symbol][i] = order
+			return
+		}
+	}
+}
+
+// waiting returns a copy of symbol's list so callers can remove orders while
+// iterating
+func (l stopList) waiting(symbol string) []*Order {
+	return append([]*Order(nil), l[symbol]...)
+}
@@ -1,660 +1,402 @@
 package storage
 
 import (
-	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
-	"sync"
+	"errors"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
+	"stocks-backend/internal/money"
+	"stocks-backend/internal/orderbook"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // Order represents a trading order
 type Order struct {
-	ID        string    `json:"id" bson:"_id,omitempty"`
-	Username  string    `json:"username" bson:"username"`
-	Symbol    string    `json:"symbol" bson:"symbol"`
-	Side      string    `json:"side" bson:"side"`           // "buy" or "sell"
-	OrderType string    `json:"orderType" bson:"orderType"` // "market" or "limit"
-	Quantity  int       `json:"quantity" bson:"quantity"`
-	Price     float64   `json:"price" bson:"price"`
-	Status    string    `json:"status" bson:"status"`
-	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
-}
-
-// StockPrice represents the current price of a stock
-type StockPrice struct {
-	Symbol       string    `json:"symbol" bson:"_id"`
-	Price        float64   `json:"price" bson:"price"`
-	Change       float64   `json:"change" bson:"change"` // percentage change
-	PriceHistory []float64 `json:"priceHistory" bson:"priceHistory"`
-	Logo         string    `json:"logo" bson:"logo"`
-	Name         string    `json:"name" bson:"name"`
-	DayHigh      float64   `json:"dayHigh" bson:"dayHigh"`
-	DayLow       float64   `json:"dayLow" bson:"dayLow"`
-	DayOpen      float64   `json:"dayOpen" bson:"dayOpen"`
-	Volume       int64     `json:"volume" bson:"volume"`
-}
-
-// UserAccount represents a user's trading account
-type UserAccount struct {
-	Username     string         `json:"username" bson:"_id"`
-	PasswordHash string         `json:"-" bson:"passwordHash"` // Don't expose in JSON
-	Credits      float64        `json:"credits" bson:"credits"`
-	Portfolio    map[string]int `json:"portfolio" bson:"portfolio"` // symbol -> quantity
+	ID        string       `json:"id" bson:"_id,omitempty"`
+	Username  string       `json:"username" bson:"username"`
+	Symbol    string       `json:"symbol" bson:"symbol"`
+	Side      string       `json:"side" bson:"side"`           // "buy" or "sell"
+	OrderType string       `json:"orderType" bson:"orderType"` // "market", "limit", "stop", "stop_limit" or "trailing_stop"
+	Quantity  int          `json:"quantity" bson:"quantity"`
+	Price     money.Amount `json:"price" bson:"price"`
+	Status    string       `json:"status" bson:"status"`
+	CreatedAt time.Time    `json:"createdAt" bson:"createdAt"`
+
+	// Time in force, see timeinforce.go
+	TimeInForce string     `json:"timeInForce" bson:"timeInForce"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+
+	// Stop orders, see stops.go
+	StopPrice    money.Amount `json:"stopPrice,omitempty" bson:"stopPrice,omitempty"`
+	TrailAmount  money.Amount `json:"trailAmount,omitempty" bson:"trailAmount,omitempty"`
+	TrailPercent float64      `json:"trailPercent,omitempty" bson:"trailPercent,omitempty"`
+	WaterMark    money.Amount `json:"waterMark,omitempty" bson:"waterMark,omitempty"`
+	Triggered    bool         `json:"triggered,omitempty" bson:"triggered,omitempty"`
+
+	// Orders waiting for their symbol to trade, see queue.go
+	Queued bool `json:"queued,omitempty" bson:"queued,omitempty"`
+
+	// Bracket orders, see bracket.go
+	ParentID      string   `json:"parentId,omitempty" bson:"parentId,omitempty"`
+	ChildIDs      []string `json:"childIds,omitempty" bson:"childIds,omitempty"`
+	OCOWith       string   `json:"ocoWith,omitempty" bson:"ocoWith,omitempty"`
+	HeldBySibling bool     `json:"heldBySibling,omitempty" bson:"heldBySibling,omitempty"`
+
+	FilledQuantity int          `json:"filledQuantity" bson:"filledQuantity"`
+	AvgFillPrice   money.Amount `json:"avgFillPrice" bson:"avgFillPrice"`
+	Fills          []Fill       `json:"fills" bson:"fills"`
+	RejectReason   string       `json:"rejectReason,omitempty" bson:"rejectReason,omitempty"`
+	RejectCode     string       `json:"rejectCode,omitempty" bson:"rejectCode,omitempty"` // see reasons.go
 }
 
-// Storage provides MongoDB-backed storage
-type Storage struct {
-	db             *mongo.Database
-	usersCol       *mongo.Collection
-	ordersCol      *mongo.Collection
-	pricesCol      *mongo.Collection
-	accountMutexes map[string]*sync.RWMutex
-	mutexLock      sync.RWMutex
+// Fill records one execution of an order
+type Fill struct {
+	Timestamp   time.Time    `json:"timestamp" bson:"timestamp"`
+	Quantity    int          `json:"quantity" bson:"quantity"`
+	Price       money.Amount `json:"price" bson:"price"`
+	RealizedPnL money.Amount `json:"realizedPnl,omitempty" bson:"realizedPnl,omitempty"` // sells only
 }
 
-// NewStorage creates a new MongoDB storage instance
-func NewStorage(client *mongo.Client, dbName string) (*Storage, error) {
-	db := client.Database(dbName)
-
-	storage := &Storage{
-		db:             db,
-		usersCol:       db.Collection("users"),
-		ordersCol:      db.Collection("orders"),
-		pricesCol:      db.Collection("prices"),
-		accountMutexes: make(map[string]*sync.RWMutex),
-	}
-
-	// Create indexes
-	ctx := context.Background()
-	if err := storage.createIndexes(ctx); err != nil {
-		return nil, fmt.Errorf("failed to create indexes: %w", err)
-	}
+// Order statuses. New and partially filled orders are open: they hold funds
+// and can still fill, be amended or be cancelled. Inactive bracket exits wait
+// for their entry order, see bracket.go. The rest are final.
+const (
+	StatusInactive        = "inactive"
+	StatusNew             = "new"
+	StatusPartiallyFilled = "partially_filled"
+	StatusFilled          = "filled"
+	StatusCancelled       = "cancelled"
+	StatusRejected        = "rejected"
+	StatusExpired         = "expired"
+)
 
-	// Initialize default stock prices if not exist
-	if err := storage.initializeStocks(ctx); err != nil {
-		return nil, fmt.Errorf("failed to initialize stocks: %w", err)
-	}
+// openStatuses lists the statuses of orders that can still fill
+var openStatuses = []string{StatusNew, StatusPartiallyFilled}
 
-	return storage, nil
+// IsOpen reports whether the order can still fill
+func (o *Order) IsOpen() bool {
+	return o.Status == StatusNew || o.Status == StatusPartiallyFilled
 }
 
-// createIndexes creates database indexes for performance
-func (s *Storage) createIndexes(ctx context.Context) error {
-	// Index on orders collection
-	_, err := s.ordersCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
-		{Keys: bson.D{{Key: "username", Value: 1}}},
-		{Keys: bson.D{{Key: "symbol", Value: 1}}},
-		{Keys: bson.D{{Key: "status", Value: 1}}},
-	})
-	if err != nil {
-		return err
-	}
-
-	return nil
+// Remaining returns the quantity still to be filled
+func (o *Order) Remaining() int {
+	return o.Quantity - o.FilledQuantity
 }
 
-// initializeStocks creates default stocks if they don't exist
-func (s *Storage) initializeStocks(ctx context.Context) error {
-	stocks := []StockPrice{
-		{
-			Symbol:       "AAPL",
-			Price:        150.00,
-			Change:       0.0,
-			PriceHistory: []float64{150.00},
-			Logo:         "https://logo.clearbit.com/apple.com",
-			Name:         "Apple Inc.",
-			DayHigh:      151.50,
-			DayLow:       148.20,
-			DayOpen:      149.00,
-			Volume:       45000000,
-		},
-		{
-			Symbol:       "TSLA",
-			Price:        250.00,
-			Change:       0.0,
-			PriceHistory: []float64{250.00},
-			Logo:         "https://logo.clearbit.com/tesla.com",
-			Name:         "Tesla, Inc.",
-			DayHigh:      255.80,
-			DayLow:       247.10,
-			DayOpen:      248.50,
-			Volume:       82000000,
-		},
-		{
-			Symbol:       "AMZN",
-			Price:        135.00,
-			Change:       0.0,
-			PriceHistory: []float64{135.00},
-			Logo:         "https://logo.clearbit.com/amazon.com",
-			Name:         "Amazon.com, Inc.",
-			DayHigh:      137.20,
-			DayLow:       133.80,
-			DayOpen:      134.50,
-			Volume:       52000000,
-		},
-		{
-			Symbol:       "GOOGL",
-			Price:        140.00,
-			Change:       0.0,
-			PriceHistory: []float64{140.00},
-			Logo:         "https://logo.clearbit.com/google.com",
-			Name:         "Alphabet Inc.",
-			DayHigh:      142.50,
-			DayLow:       138.90,
-			DayOpen:      139.50,
-			Volume:       28000000,
-		},
-		{
-			Symbol:       "MSFT",
-			Price:        380.00,
-			Change:       0.0,
-			PriceHistory: []float64{380.00},
-			Logo:         "https://logo.clearbit.com/microsoft.com",
-			Name:         "Microsoft Corporation",
-			DayHigh:      385.60,
-			DayLow:       377.30,
-			DayOpen:      379.00,
-			Volume:       35000000,
-		},
-		{
-			Symbol:       "NVDA",
-			Price:        495.00,
-			Change:       0.0,
-			PriceHistory: []float64{495.00},
-			Logo:         "https://logo.clearbit.com/nvidia.com",
-			Name:         "NVIDIA Corporation",
-			DayHigh:      502.80,
-			DayLow:       490.20,
-			DayOpen:      492.00,
-			Volume:       68000000,
-		},
-		{
-			Symbol:       "META",
-			Price:        330.00,
-			Change:       0.0,
-			PriceHistory: []float64{330.00},
-			Logo:         "https://logo.clearbit.com/meta.com",
-			Name:         "Meta Platforms, Inc.",
-			DayHigh:      335.90,
-			DayLow:       327.40,
-			DayOpen:      328.50,
-			Volume:       42000000,
-		},
-		{
-			Symbol:       "NFLX",
-			Price:        445.00,
-			Change:       0.0,
-			PriceHistory: []float64{445.00},
-			Logo:         "https://logo.clearbit.com/netflix.com",
-			Name:         "Netflix, Inc.",
-			DayHigh:      450.30,
-			DayLow:       441.80,
-			DayOpen:      443.00,
-			Volume:       25000000,
-		},
-		{
-			Symbol:       "AMD",
-			Price:        120.00,
-			Change:       0.0,
-			PriceHistory: []float64{120.00},
-			Logo:         "https://logo.clearbit.com/amd.com",
-			Name:         "Advanced Micro Devices",
-			DayHigh:      122.80,
-			DayLow:       118.40,
-			DayOpen:      119.20,
-			Volume:       58000000,
-		},
-		{
-			Symbol:       "DIS",
-			Price:        95.00,
-			Change:       0.0,
-			PriceHistory: []float64{95.00},
-			Logo:         "https://logo.clearbit.com/disney.com",
-			Name:         "The Walt Disney Company",
-			DayHigh:      96.50,
-			DayLow:       93.80,
-			DayOpen:      94.20,
-			Volume:       32000000,
-		},
-		{
-			Symbol:       "INTC",
-			Price:        45.00,
-			Change:       0.0,
-			PriceHistory: []float64{45.00},
-			Logo:         "https://logo.clearbit.com/intel.com",
-			Name:         "Intel Corporation",
-			DayHigh:      45.90,
-			DayLow:       44.20,
-			DayOpen:      44.80,
-			Volume:       48000000,
-		},
-		{
-			Symbol:       "BABA",
-			Price:        85.00,
-			Change:       0.0,
-			PriceHistory: []float64{85.00},
-			Logo:         "https://logo.clearbit.com/alibaba.com",
-			Name:         "Alibaba Group",
-			DayHigh:      86.80,
-			DayLow:       83.90,
-			DayOpen:      84.50,
-			Volume:       38000000,
-		},
-	}
-
-	for _, stock := range stocks {
-		filter := bson.M{"_id": stock.Symbol}
-		update := bson.M{"$setOnInsert": stock}
-		opts := options.Update().SetUpsert(true)
-		_, err := s.pricesCol.UpdateOne(ctx, filter, update, opts)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+// Trade records a single execution of an order
+type Trade struct {
+	ID          string       `json:"id" bson:"_id"`
+	OrderID     string       `json:"orderId" bson:"orderId"`
+	Username    string       `json:"username" bson:"username"`
+	Symbol      string       `json:"symbol" bson:"symbol"`
+	Side        string       `json:"side" bson:"side"`
+	Quantity    int          `json:"quantity" bson:"quantity"`
+	Price       money.Amount `json:"price" bson:"price"`
+	RealizedPnL money.Amount `json:"realizedPnl,omitempty" bson:"realizedPnl,omitempty"` // sells only
+	ExecutedAt  time.Time    `json:"executedAt" bson:"executedAt"`
 }
 
-// getAccountMutex returns a mutex for a specific account (thread-safe)
-func (s *Storage) getAccountMutex(username string) *sync.RWMutex {
-	s.mutexLock.Lock()
-	defer s.mutexLock.Unlock()
-
-	if _, exists := s.accountMutexes[username]; !exists {
-		s.accountMutexes[username] = &sync.RWMutex{}
-	}
-	return s.accountMutexes[username]
+// StockPrice represents the current price of a stock
+type StockPrice struct {
+	Symbol       string         `json:"symbol" bson:"_id"`
+	Price        money.Amount   `json:"price" bson:"price"`
+	Change       float64        `json:"change" bson:"change"` // percentage change
+	PriceHistory []money.Amount `json:"priceHistory" bson:"priceHistory"`
+	Logo         string         `json:"logo" bson:"logo"`
+	Name         string         `json:"name" bson:"name"`
+	DayHigh      money.Amount   `json:"dayHigh" bson:"dayHigh"`
+	DayLow       money.Amount   `json:"dayLow" bson:"dayLow"`
+	DayOpen      money.Amount   `json:"dayOpen" bson:"dayOpen"`
+	Volume       int64          `json:"volume" bson:"volume"`
+	TradingDay   string         `json:"tradingDay" bson:"tradingDay"` // "YYYY-MM-DD" the day stats are for
+	Halted       bool           `json:"halted" bson:"halted"`         // trading suspended by an admin
 }
 
-// hashPassword creates a SHA-256 hash of the password
-func hashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
-	return hex.EncodeToString(hash[:])
+// Bar is one period of a symbol's trading, replayed from history
+type Bar struct {
+	Time   time.Time
+	Open   money.Amount
+	High   money.Amount
+	Low    money.Amount
+	Close  money.Amount
+	Volume int64
 }
 
-// CreateAccount creates a new user account with initial credits
-func (s *Storage) CreateAccount(username, password string) *UserAccount {
-	ctx := context.Background()
-
-	// Check if account already exists
-	var existing UserAccount
-	err := s.usersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&existing)
-	if err == nil {
-		return nil // Account already exists
+// foldBar adds a bar to the day's open, high, low and volume, starting a
+// new day, the bar's date, with it if newDay
+func (p *StockPrice) foldBar(bar Bar, newDay bool) {
+	if newDay {
+		p.DayOpen, p.DayHigh, p.DayLow, p.Volume = bar.Open, bar.High, bar.Low, bar.Volume
+		p.TradingDay = bar.Time.Format("2006-01-02")
+		return
 	}
-
-	account := &UserAccount{
-		Username:     username,
-		PasswordHash: hashPassword(password),
-		Credits:      2000.0,
-		Portfolio:    make(map[string]int),
+	if bar.High > p.DayHigh {
+		p.DayHigh = bar.High
 	}
-
-	_, err = s.usersCol.InsertOne(ctx, account)
-	if err != nil {
-		return nil
+	if bar.Low < p.DayLow || p.DayLow == 0 {
+		p.DayLow = bar.Low
 	}
-
-	return account
+	p.Volume += bar.Volume
 }
 
-// ValidatePassword checks if the provided password matches the stored hash
-func (s *Storage) ValidatePassword(username, password string) bool {
-	ctx := context.Background()
-
-	var account UserAccount
-	err := s.usersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&account)
-	if err != nil {
+// startDay resets a stock's day stats to its current price for day, unless
+// they are already for day
+func (p *StockPrice) startDay(day string) bool {
+	if p.TradingDay == day {
 		return false
 	}
-
-	return account.PasswordHash == hashPassword(password)
+	p.DayOpen, p.DayHigh, p.DayLow, p.Volume = p.Price, p.Price, p.Price, 0
+	p.TradingDay = day
+	return true
 }
 
-// GetAccount returns a user's account
-func (s *Storage) GetAccount(username string) *UserAccount {
-	ctx := context.Background()
-
-	var account UserAccount
-	err := s.usersCol.FindOne(ctx, bson.M{"_id": username}).Decode(&account)
-	if err != nil {
-		return nil
-	}
-
-	return &account
+// UserAccount represents a user's trading account
+type UserAccount struct {
+	Username     string              `json:"username" bson:"_id"`
+	PasswordHash string              `json:"-" bson:"passwordHash"`          // Don't expose in JSON
+	Credits      money.Amount        `json:"credits" bson:"credits"`         // available cash
+	Portfolio    map[string]int      `json:"portfolio" bson:"portfolio"`     // symbol -> available quantity
+	HeldCredits  money.Amount        `json:"heldCredits" bson:"heldCredits"` // cash reserved by pending buy orders
+	HeldShares   map[string]int      `json:"heldShares" bson:"heldShares"`   // symbol -> quantity reserved by pending sell orders
+	Positions    map[string]Position `json:"positions" bson:"positions"`     // symbol -> cost basis and P&L, see positions.go
 }
 
-// AddOrder adds a new order to storage
-func (s *Storage) AddOrder(order Order) {
-	ctx := context.Background()
-
-	// Generate ID if not present
-	if order.ID == "" {
-		order.ID = primitive.NewObjectID().Hex()
-	}
-
-	s.ordersCol.InsertOne(ctx, order)
+// Store is the persistence interface used by the API handlers and the
+// price simulator. MongoStorage and MemoryStorage both implement it.
+type Store interface {
+	CreateAccount(username, password string) *UserAccount
+	ValidatePassword(username, password string) bool
+	GetAccount(username string) *UserAccount
+	PlaceOrder(order *Order) error
+	PlaceBracket(entry *Order, exits []*Order) error
+	GetOrders(username string) []Order
+	CancelOrder(username, orderID string) (*Order, error)
+	AmendOrder(username, orderID string, price money.Amount, quantity int) (*Order, error)
+	ExpireOrders(now time.Time) ([]Order, error)
+	UpdatePrice(symbol string, newPrice money.Amount, change float64) error
+	ApplyBar(symbol string, bar Bar, change float64, newDay bool) error
+	StartDay(day string) error
+	SetHalted(symbol string, halted bool) error
+	ReleaseQueued(symbol string, marketOrders bool) error
+	GetOrderBook(symbol string, depth int) orderbook.Depth
+	ReloadBooks() error
+	GetPrice(symbol string) (*StockPrice, bool)
+	GetAllPrices() []StockPrice
+	GetInstruments() []Instrument
+	GetInstrument(symbol string) (*Instrument, bool)
+	CreateInstrument(instrument *Instrument) error
+	UpdateInstrument(instrument *Instrument) error
+	SetTradable(symbol string, tradable bool) error
+	AdjustAccount(adjustment Adjustment) (*LedgerEntry, error)
+	GetLedger(username string) []LedgerEntry
+	Reconcile() (*Reconciliation, error)
+	SetListener(listener Listener)
 }
 
-// GetOrders returns all orders for a user
-func (s *Storage) GetOrders(username string) []Order {
-	ctx := context.Background()
-
-	filter := bson.M{"username": username}
-	cursor, err := s.ordersCol.Find(ctx, filter)
-	if err != nil {
-		return []Order{}
-	}
-	defer cursor.Close(ctx)
-
-	var orders []Order
-	if err := cursor.All(ctx, &orders); err != nil {
-		return []Order{}
-	}
+// Compile-time checks that both backends satisfy Store
+var (
+	_ Store = (*MongoStorage)(nil)
+	_ Store = (*MemoryStorage)(nil)
+)
 
-	return orders
+// hashPassword creates a SHA-256 hash of the password
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
 }
 
-// UpdatePrice updates a stock price
-func (s *Storage) UpdatePrice(symbol string, newPrice, change float64) {
-	ctx := context.Background()
-
-	// First, get current stock to check day high/low
-	var currentStock StockPrice
-	err := s.pricesCol.FindOne(ctx, bson.M{"_id": symbol}).Decode(&currentStock)
-	if err != nil {
-		return
-	}
-
-	// Update day high/low
-	dayHigh := currentStock.DayHigh
-	dayLow := currentStock.DayLow
-	if newPrice > dayHigh {
-		dayHigh = newPrice
-	}
-	if newPrice < dayLow || dayLow == 0 {
-		dayLow = newPrice
-	}
-
-	// Update price and add to history (keep last 20)
-	update := bson.M{
-		"$set": bson.M{
-			"price":   newPrice,
-			"change":  change,
-			"dayHigh": dayHigh,
-			"dayLow":  dayLow,
-		},
-		"$push": bson.M{
-			"priceHistory": bson.M{
-				"$each":  []float64{newPrice},
-				"$slice": -20, // Keep only last 20 items
-			},
-		},
-	}
+// OrderError represents an order validation error: a reason code, see
+// reasons.go, and a message
+type OrderError struct {
+	Code    string
+	Message string
+}
 
-	s.pricesCol.UpdateOne(ctx, bson.M{"_id": symbol}, update)
+func (e *OrderError) Error() string {
+	return e.Message
+}
 
-	// Check and update order statuses
-	s.updateOrderStatuses(symbol, newPrice)
+// FollowUpError wraps an error that happened after an order was stored,
+// while filling it or resolving its bracket. The order was placed, and the
+// order passed to PlaceOrder or PlaceBracket holds its stored state.
+type FollowUpError struct {
+	Err error
 }
 
-// ExecuteBuyOrder executes a buy order with proper validation
-func (s *Storage) ExecuteBuyOrder(username, symbol string, quantity int, price float64, orderType string) error {
-	ctx := context.Background()
+func (e *FollowUpError) Error() string {
+	return "order placed, but: " + e.Err.Error()
+}
 
-	account := s.GetAccount(username)
-	if account == nil {
-		return &OrderError{"Account not found"}
-	}
+func (e *FollowUpError) Unwrap() error {
+	return e.Err
+}
 
-	// For market orders, use current market price
-	actualPrice := price
-	if orderType == "market" {
-		stockPrice, exists := s.GetPrice(symbol)
-		if !exists {
-			return &OrderError{"Stock not found"}
-		}
-		actualPrice = stockPrice.Price
+// followUp wraps a non-nil error from after an order was stored
+func followUp(err error) error {
+	if err == nil {
+		return nil
 	}
+	return &FollowUpError{Err: err}
+}
 
-	totalCost := float64(quantity) * actualPrice
+// Errors returned when placing, cancelling or amending an order
+var (
+	ErrOrderNotFound  = &OrderError{ReasonOrderNotFound, "Order not found"}
+	ErrOrderNotOpen   = &OrderError{ReasonOrderNotOpen, "Only open orders can be changed"}
+	ErrStockNotFound  = &OrderError{ReasonUnknownSymbol, "Stock not found"}
+	ErrAmendBelowFill = &OrderError{ReasonAmendBelowFill, "Quantity must be greater than the filled quantity"}
+	ErrAmendStop      = &OrderError{ReasonAmendStop, "Stop orders can't be amended before they trigger"}
+	ErrAmendExit      = &OrderError{ReasonAmendExit, "The quantity of a bracket exit follows its entry order"}
+	ErrAmendHalted    = &OrderError{ReasonAmendHalted, "Orders in the book can't be amended while trading is halted"}
+)
 
-	// Use account-specific mutex for thread safety
-	mutex := s.getAccountMutex(username)
-	mutex.Lock()
-	defer mutex.Unlock()
+// Reasons an OCO exit is cancelled by its sibling
+var (
+	errSiblingFilled    = &OrderError{ReasonSiblingFilled, "OCO sibling filled"}
+	errSiblingTriggered = &OrderError{ReasonSiblingTriggered, "OCO sibling triggered"}
+)
 
-	// Re-fetch account to get latest data
-	account = s.GetAccount(username)
-	if account == nil {
-		return &OrderError{"Account not found"}
+// prepareOrder fills in the ID and creation time of a new order if missing
+func prepareOrder(order *Order) {
+	if order.ID == "" {
+		order.ID = primitive.NewObjectID().Hex()
 	}
-
-	if account.Credits < totalCost {
-		return &OrderError{"Insufficient credits"}
+	if order.CreatedAt.IsZero() {
+		order.CreatedAt = time.Now()
 	}
-
-	// For market orders, execute immediately
-	if orderType == "market" {
-		account.Credits -= totalCost
-		if account.Portfolio == nil {
-			account.Portfolio = make(map[string]int)
-		}
-		account.Portfolio[symbol] += quantity
-
-		// Update in database
-		update := bson.M{
-			"$set": bson.M{
-				"credits":   account.Credits,
-				"portfolio": account.Portfolio,
-			},
-		}
-		s.usersCol.UpdateOne(ctx, bson.M{"_id": username}, update)
-		return nil
+	if order.TimeInForce == "" {
+		order.TimeInForce = TimeInForceGTC
 	}
-
-	// For limit orders, just validate credits (execution happens when price condition is met)
-	return nil
 }
 
-// ExecuteSellOrder executes a sell order with proper validation
-func (s *Storage) ExecuteSellOrder(username, symbol string, quantity int, price float64, orderType string) error {
-	ctx := context.Background()
-
-	account := s.GetAccount(username)
-	if account == nil {
-		return &OrderError{"Account not found"}
+// recordFill adds an execution to the order, updating its average fill
+// price and status. The average is taken over the exact notional of every
+// fill, so its rounding doesn't accumulate.
+func recordFill(order *Order, fill Fill) {
+	order.FilledQuantity += fill.Quantity
+	order.Fills = append(order.Fills, fill)
+	var notional money.Amount
+	for _, fill := range order.Fills {
+		notional += fill.Price.Mul(fill.Quantity)
 	}
+	order.AvgFillPrice = notional.Div(order.FilledQuantity)
 
-	// Use account-specific mutex for thread safety
-	mutex := s.getAccountMutex(username)
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	// Re-fetch account to get latest data
-	account = s.GetAccount(username)
-	if account == nil {
-		return &OrderError{"Account not found"}
+	if order.Remaining() == 0 {
+		order.Status = StatusFilled
+	} else {
+		order.Status = StatusPartiallyFilled
 	}
+}
 
-	// Check if user has enough stocks
-	if account.Portfolio[symbol] < quantity {
-		return &OrderError{"Insufficient stocks to sell"}
+// closeUnfilled gives a submitted order that must not rest in the book its
+// final status if it did not fill completely. An order executing at market
+// only falls short when the account could not pay for all of it, so it is
+// cancelled if part of it filled and rejected otherwise. IOC and FOK orders
+// the book and market could not fill are cancelled. It reports whether the
+// order changed.
+func closeUnfilled(order *Order) bool {
+	if !order.IsOpen() || order.Remaining() == 0 {
+		return false
 	}
-
-	// For market orders, execute immediately
-	if orderType == "market" {
-		stockPrice, exists := s.GetPrice(symbol)
-		if !exists {
-			return &OrderError{"Stock not found"}
-		}
-
-		totalRevenue := float64(quantity) * stockPrice.Price
-		account.Credits += totalRevenue
-		account.Portfolio[symbol] -= quantity
-
-		// Remove from portfolio if quantity becomes 0
-		if account.Portfolio[symbol] == 0 {
-			delete(account.Portfolio, symbol)
+	switch {
+	case order.executesAsMarket():
+		setRejection(order, holdChange(order).shortfallError())
+		if order.FilledQuantity > 0 {
+			order.Status = StatusCancelled
+		} else {
+			order.Status = StatusRejected
 		}
-
-		// Update in database
-		update := bson.M{
-			"$set": bson.M{
-				"credits":   account.Credits,
-				"portfolio": account.Portfolio,
-			},
-		}
-		s.usersCol.UpdateOne(ctx, bson.M{"_id": username}, update)
-		return nil
+	case order.TimeInForce == TimeInForceIOC:
+		order.Status = StatusCancelled
+		order.RejectReason = "Immediate-or-cancel remainder was not filled"
+		order.RejectCode = ReasonIOCUnfilled
+	case order.TimeInForce == TimeInForceFOK:
+		order.Status = StatusCancelled
+		order.RejectReason = "Fill-or-kill order could not be filled in full"
+		order.RejectCode = ReasonFOKUnfilled
+	default:
+		return false
 	}
-
-	// For limit orders, just remove stocks from available inventory
-	// (they'll be added back if order is cancelled or fails)
-	return nil
+	return true
 }
 
-// OrderError represents an order validation error
-type OrderError struct {
-	Message string
+// rejectOrder marks a new order rejected with the reason it failed
+func rejectOrder(order *Order, err error) {
+	order.Status = StatusRejected
+	setRejection(order, err)
 }
 
-func (e *OrderError) Error() string {
-	return e.Message
-}
-
-// GetPrice returns the price for a specific symbol
-func (s *Storage) GetPrice(symbol string) (*StockPrice, bool) {
-	ctx := context.Background()
-
-	var price StockPrice
-	err := s.pricesCol.FindOne(ctx, bson.M{"_id": symbol}).Decode(&price)
-	if err != nil {
-		return nil, false
+// setRejection records why an order was refused, with the reason code of
+// an OrderError
+func setRejection(order *Order, err error) {
+	order.RejectReason = err.Error()
+	order.RejectCode = ""
+	var orderErr *OrderError
+	if errors.As(err, &orderErr) {
+		order.RejectCode = orderErr.Code
 	}
-
-	return &price, true
 }
 
-// GetAllPrices returns all stock prices
-func (s *Storage) GetAllPrices() []StockPrice {
-	ctx := context.Background()
-
-	cursor, err := s.pricesCol.Find(ctx, bson.M{})
-	if err != nil {
-		return []StockPrice{}
-	}
-	defer cursor.Close(ctx)
-
-	var prices []StockPrice
-	if err := cursor.All(ctx, &prices); err != nil {
-		return []StockPrice{}
+// setReason records why the system closed an order, clearing the reason if
+// reason is nil
+func setReason(order *Order, reason *OrderError) {
+	order.RejectReason, order.RejectCode = "", ""
+	if reason != nil {
+		order.RejectReason, order.RejectCode = reason.Message, reason.Code
 	}
-
-	return prices
 }
 
-// updateOrderStatuses checks and updates order statuses based on current price
-func (s *Storage) updateOrderStatuses(symbol string, currentPrice float64) {
-	ctx := context.Background()
+// bookOrder converts an open order into its order book entry
+func bookOrder(order *Order) orderbook.Order {
+	return orderbook.Order{
+		ID:       order.ID,
+		Username: order.Username,
+		Side:     order.Side,
+		Price:    order.Price,
+		Quantity: order.Remaining(),
+		Market:   order.executesAsMarket(),
 
-	// Find all pending limit orders for this symbol
-	filter := bson.M{
-		"symbol":    symbol,
-		"status":    "pending",
-		"orderType": "limit",
+		ImmediateOnly: order.isImmediate(),
+		AllOrNone:     order.TimeInForce == TimeInForceFOK,
 	}
+}
 
-	cursor, err := s.ordersCol.Find(ctx, filter)
-	if err != nil {
-		return
-	}
-	defer cursor.Close(ctx)
-
-	var orders []Order
-	if err := cursor.All(ctx, &orders); err != nil {
-		return
+// restingBookOrder returns the book entry an order's stored state calls
+// for: what it has left, or a zero quantity if it should not rest
+func restingBookOrder(order *Order) orderbook.Order {
+	entry := bookOrder(order)
+	if !order.IsOpen() || entry.Market || entry.ImmediateOnly || order.awaitingTrigger() || order.awaitingRelease() {
+		entry.Quantity = 0
 	}
+	return entry
+}
 
-	for _, order := range orders {
-		shouldExecute := false
-
-		// Buy limit order: execute if current price <= order price
-		if order.Side == "buy" && currentPrice <= order.Price {
-			shouldExecute = true
-		}
-		// Sell limit order: execute if current price >= order price
-		if order.Side == "sell" && currentPrice >= order.Price {
-			shouldExecute = true
-		}
-
-		if shouldExecute {
-			account := s.GetAccount(order.Username)
-			if account == nil {
-				continue
-			}
-
-			// Use account-specific mutex
-			mutex := s.getAccountMutex(order.Username)
-			mutex.Lock()
-
-			// Re-fetch account to get latest data
-			account = s.GetAccount(order.Username)
-			if account == nil {
-				mutex.Unlock()
-				continue
-			}
-
-			executed := false
-
-			if order.Side == "buy" {
-				totalCost := float64(order.Quantity) * currentPrice
-				if account.Credits >= totalCost {
-					account.Credits -= totalCost
-					if account.Portfolio == nil {
-						account.Portfolio = make(map[string]int)
-					}
-					account.Portfolio[symbol] += order.Quantity
-					executed = true
-				}
-			} else if order.Side == "sell" {
-				if account.Portfolio[symbol] >= order.Quantity {
-					totalRevenue := float64(order.Quantity) * currentPrice
-					account.Credits += totalRevenue
-					account.Portfolio[symbol] -= order.Quantity
-					if account.Portfolio[symbol] == 0 {
-						delete(account.Portfolio, symbol)
-					}
-					executed = true
-				}
-			}
-
-			if executed {
-				// Update account in database
-				update := bson.M{
-					"$set": bson.M{
-						"credits":   account.Credits,
-						"portfolio": account.Portfolio,
-					},
-				}
-				s.usersCol.UpdateOne(ctx, bson.M{"_id": order.Username}, update)
-
-				// Update order status
-				s.ordersCol.UpdateOne(
-					ctx,
-					bson.M{"_id": order.ID},
-					bson.M{"$set": bson.M{"status": "done"}},
-				)
+// fillOrderIDs returns the IDs of the orders on either side of fills
+func fillOrderIDs(fills []orderbook.Fill) []string {
+	var ids []string
+	for _, fill := range fills {
+		for _, orderID := range []string{fill.BuyOrderID, fill.SellOrderID} {
+			if orderID != orderbook.MarketOrderID {
+				ids = append(ids, orderID)
 			}
-
-			mutex.Unlock()
 		}
 	}
+	return ids
+}
+
+// newTrade builds the trade record for an order filled at price
+func newTrade(order *Order, fill Fill) Trade {
+	return Trade{
+		ID:          primitive.NewObjectID().Hex(),
+		OrderID:     order.ID,
+		Username:    order.Username,
+		Symbol:      order.Symbol,
+		Side:        order.Side,
+		Quantity:    fill.Quantity,
+		Price:       fill.Price,
+		RealizedPnL: fill.RealizedPnL,
+		ExecutedAt:  fill.Timestamp,
+	}
 }
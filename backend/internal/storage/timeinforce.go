@@ -0,0 +1,27 @@
+package storage
+
+import "time"
+
+// Time in force controls how long an order stays open. GTC orders stay open
+// until they fill or are cancelled. IOC orders fill what they can when they
+// are submitted and cancel the rest; FOK orders fill in full when submitted
+// or not at all. DAY and GTD orders expire at ExpiresAt: the session close
+// for DAY orders, a time chosen by the user for GTD orders.
+const (
+	TimeInForceGTC = "GTC"
+	TimeInForceIOC = "IOC"
+	TimeInForceFOK = "FOK"
+	TimeInForceDAY = "DAY"
+	TimeInForceGTD = "GTD"
+)
+
+// isImmediate reports whether the order must be resolved when it is
+// submitted instead of resting in the book
+func (o *Order) isImmediate() bool {
+	return o.TimeInForce == TimeInForceIOC || o.TimeInForce == TimeInForceFOK
+}
+
+// expiredAt reports whether an order with an expiry has reached it by now
+func (o *Order) expiredAt(now time.Time) bool {
+	return o.ExpiresAt != nil && !now.Before(*o.ExpiresAt)
+}
@@ -0,0 +1,226 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait is how long a write to the peer may take
+	writeWait = 10 * time.Second
+
+	// pongWait is how long the peer may stay silent, pongs included
+	pongWait = 60 * time.Second
+
+	// pingPeriod is how often the peer is pinged; less than pongWait so a
+	// live peer always answers in time
+	pingPeriod = pongWait * 9 / 10
+
+	// maxMessageSize is the largest message accepted from the peer
+	maxMessageSize = 4096
+)
+
+// Client represents a WebSocket client connection. Username is set once the
+// client has authenticated; anonymous clients only receive broadcasts and
+// the prices they subscribe to.
+type Client struct {
+	Hub      *Hub
+	Conn     *websocket.Conn
+	Send     chan []byte // JSON messages, re-encoded by WritePump if Binary
+	Username string
+	Binary   bool            // negotiated the msgpack subprotocol
+	symbols  map[string]bool // subscribed symbols, guarded by Hub.mutex
+
+	// Set by the hub before it closes Send
+	closeCode   int
+	closeReason string
+
+	// Price deltas held back while Send is full, see Hub.queueDeltas
+	mutex          sync.Mutex
+	conflated      map[string]json.RawMessage // latest delta per symbol
+	conflatedOrder []string                   // symbols in the order first held back
+	wake           chan struct{}              // tells WritePump deltas are held back
+}
+
+// NewClient creates a client for conn with the hub's send buffer size.
+// username is set if the connection authenticated when it was opened, and
+// binary if it negotiated the msgpack subprotocol.
+func (h *Hub) NewClient(conn *websocket.Conn, username string, binary bool) *Client {
+	return &Client{
+		Hub:      h,
+		Conn:     conn,
+		Send:     make(chan []byte, h.sendBuffer),
+		Username: username,
+		Binary:   binary,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// conflating reports whether the client has deltas held back
+func (c *Client) conflating() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.conflated) > 0
+}
+
+// conflate holds deltas back, replacing older ones for the same symbols, and
+// wakes WritePump to send them once Send has drained
+func (c *Client) conflate(symbols []string, deltas []json.RawMessage) {
+	c.mutex.Lock()
+	if c.conflated == nil {
+		c.conflated = make(map[string]json.RawMessage)
+	}
+	for i, symbol := range symbols {
+		if _, held := c.conflated[symbol]; !held {
+			c.conflatedOrder = append(c.conflatedOrder, symbol)
+		}
+		c.conflated[symbol] = deltas[i]
+	}
+	c.mutex.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dropConflated discards the deltas held back for symbols, which a snapshot
+// queued after them supersedes
+func (c *Client) dropConflated(symbols []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.conflated) == 0 {
+		return
+	}
+
+	for _, symbol := range symbols {
+		delete(c.conflated, symbol)
+	}
+	order := c.conflatedOrder[:0]
+	for _, symbol := range c.conflatedOrder {
+		if _, held := c.conflated[symbol]; held {
+			order = append(order, symbol)
+		}
+	}
+	c.conflatedOrder = order
+}
+
+// takeConflated returns the held back deltas as one message, or nil if
+// there are none
+func (c *Client) takeConflated() ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.conflated) == 0 {
+		return nil, nil
+	}
+
+	deltas := make([]json.RawMessage, len(c.conflatedOrder))
+	for i, symbol := range c.conflatedOrder {
+		deltas[i] = c.conflated[symbol]
+	}
+	c.conflated, c.conflatedOrder = nil, nil
+	return deltaMessage(deltas)
+}
+
+// ReadPump reads messages from the WebSocket connection. A peer that sends
+// nothing, not even a pong, for pongWait is disconnected.
+func (c *Client) ReadPump() {
+	defer func() {
+		c.Hub.Unregister <- c
+		c.Conn.Close()
+	}()
+
+	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, message, err := c.Conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("WebSocket error: %v", err)
+			}
+			break
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.handleMessage(message)
+	}
+}
+
+// WritePump writes queued messages to the WebSocket connection, followed by
+// any deltas held back once the queue has drained, and pings the peer every
+// pingPeriod. Each write must finish within writeWait.
+func (c *Client) WritePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel
+				c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+				return
+			}
+			if err := c.write(message); err != nil {
+				return
+			}
+			if len(c.Send) == 0 {
+				if err := c.flushConflated(); err != nil {
+					return
+				}
+			}
+
+		case <-c.wake:
+			if len(c.Send) == 0 {
+				if err := c.flushConflated(); err != nil {
+					return
+				}
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// flushConflated writes the deltas held back, if any
+func (c *Client) flushConflated() error {
+	message, err := c.takeConflated()
+	if err != nil {
+		log.Printf("Error encoding delta: %v", err)
+		return nil
+	}
+	if message == nil {
+		return nil
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.write(message)
+}
+
+// write sends a JSON message, as MessagePack if the client negotiated it
+func (c *Client) write(message []byte) error {
+	messageType := websocket.TextMessage
+	if c.Binary {
+		encoded, err := jsonToMsgpack(message)
+		if err != nil {
+			log.Printf("Error encoding msgpack message: %v", err)
+			return nil
+		}
+		message, messageType = encoded, websocket.BinaryMessage
+	}
+	return c.Conn.WriteMessage(messageType, message)
+}
@@ -8,32 +8,51 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// Client represents a WebSocket client connection
-type Client struct {
-	Hub  *Hub
-	Conn *websocket.Conn
-	Send chan []byte
-}
-
-// Hub maintains the set of active clients and broadcasts messages
+// Hub maintains the set of active clients, indexed by username for the ones
+// that have authenticated, and sends them messages. Every change to the
+// client set, and every send that can drop a client, happens under mutex.
 type Hub struct {
 	clients    map[*Client]bool
+	users      map[string]map[*Client]bool
+	prices     map[string]*priceState // latest price of each symbol
+	symbols    []string               // symbols in the order first seen
+	sendBuffer int                    // messages buffered per client
 	broadcast  chan []byte
+	replies    chan reply
 	Register   chan *Client
 	Unregister chan *Client
 	mutex      sync.RWMutex
 }
 
-// NewHub creates a new Hub instance
-func NewHub() *Hub {
+// NewHub creates a new Hub instance that buffers up to sendBuffer messages
+// per client
+func NewHub(sendBuffer int) *Hub {
 	return &Hub{
 		clients:    make(map[*Client]bool),
+		users:      make(map[string]map[*Client]bool),
+		prices:     make(map[string]*priceState),
+		sendBuffer: sendBuffer,
 		broadcast:  make(chan []byte, 256),
+		replies:    make(chan reply),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
 	}
 }
 
+// reply is a message for one client. Replies are queued from the hub's
+// loop, after the client's registration, so none is lost to a client that
+// hasn't been registered yet. If bind is set the client has just
+// authenticated and is added to its user's index first. If snapshot is set
+// a snapshot of symbols follows the message; it is taken in the loop so no
+// delta can slip in between.
+type reply struct {
+	client   *Client
+	message  []byte
+	bind     bool
+	snapshot bool
+	symbols  []string
+}
+
 // Run starts the hub's main loop
 func (h *Hub) Run() {
 	for {
@@ -41,81 +60,123 @@ func (h *Hub) Run() {
 		case client := <-h.Register:
 			h.mutex.Lock()
 			h.clients[client] = true
-			h.mutex.Unlock()
+			if client.Username != "" {
+				h.addUser(client, client.Username)
+			}
 			log.Printf("Client connected. Total clients: %d", len(h.clients))
+			h.mutex.Unlock()
 
 		case client := <-h.Unregister:
 			h.mutex.Lock()
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.Send)
+				h.removeClient(client, websocket.CloseNormalClosure, "")
 			}
-			h.mutex.Unlock()
 			log.Printf("Client disconnected. Total clients: %d", len(h.clients))
+			h.mutex.Unlock()
+
+		case r := <-h.replies:
+			h.mutex.Lock()
+			if _, ok := h.clients[r.client]; ok {
+				if r.bind {
+					h.addUser(r.client, r.client.Username)
+				}
+				if r.message != nil {
+					h.queue(r.client, r.message)
+				}
+				if r.snapshot {
+					h.sendSnapshot(r.client, r.symbols)
+				}
+			}
+			h.mutex.Unlock()
 
 		case message := <-h.broadcast:
-			h.mutex.RLock()
+			h.mutex.Lock()
 			for client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					// If we can't send, close the client
-					close(client.Send)
-					delete(h.clients, client)
-				}
+				h.queue(client, message)
 			}
-			h.mutex.RUnlock()
+			h.mutex.Unlock()
 		}
 	}
 }
 
-// Broadcast sends a message to all connected clients
-func (h *Hub) Broadcast(data interface{}) error {
-	message, err := json.Marshal(data)
-	if err != nil {
-		return err
+// addUser adds a client to its user's index. The caller must hold h.mutex.
+func (h *Hub) addUser(client *Client, username string) {
+	if h.users[username] == nil {
+		h.users[username] = make(map[*Client]bool)
 	}
-	h.broadcast <- message
-	return nil
+	h.users[username][client] = true
 }
 
-// ReadPump reads messages from the WebSocket connection
-func (c *Client) ReadPump() {
-	defer func() {
-		c.Hub.Unregister <- c
-		c.Conn.Close()
-	}()
-
-	for {
-		_, _, err := c.Conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
-			}
-			break
+// removeClient drops a client from the hub and closes its send channel;
+// WritePump then closes the connection with the given code and reason. The
+// caller must hold h.mutex for writing.
+func (h *Hub) removeClient(client *Client, code int, reason string) {
+	delete(h.clients, client)
+	if userClients := h.users[client.Username]; userClients != nil {
+		delete(userClients, client)
+		if len(userClients) == 0 {
+			delete(h.users, client.Username)
 		}
-		// We don't expect messages from clients in this implementation
-		// If needed, handle incoming messages here
 	}
+	client.closeCode, client.closeReason = code, reason
+	close(client.Send)
 }
 
-// WritePump writes messages to the WebSocket connection
-func (c *Client) WritePump() {
-	defer func() {
-		c.Conn.Close()
-	}()
+// queue adds a message to a client's send buffer. A client whose buffer is
+// full is disconnected, and told why. The caller must hold h.mutex for
+// writing.
+func (h *Hub) queue(client *Client, message []byte) {
+	select {
+	case client.Send <- message:
+	default:
+		log.Printf("Disconnecting slow WebSocket client (user=%q)", client.Username)
+		h.removeClient(client, websocket.CloseTryAgainLater, "Client could not keep up")
+	}
+}
 
-	for {
-		message, ok := <-c.Send
-		if !ok {
-			// The hub closed the channel
-			c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+// queueDeltas queues a delta message for a client. Price deltas are never
+// a reason to disconnect: if the client's buffer is full, or it already has
+// deltas held back, the deltas are conflated instead, keeping only the
+// latest per symbol until WritePump catches up. The caller must hold
+// h.mutex for writing.
+func (h *Hub) queueDeltas(client *Client, symbols []string, deltas []json.RawMessage) {
+	if !client.conflating() {
+		message, err := deltaMessage(deltas)
+		if err != nil {
+			log.Printf("Error encoding delta: %v", err)
 			return
 		}
-
-		err := c.Conn.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
+		select {
+		case client.Send <- message:
 			return
+		default:
 		}
 	}
+	client.conflate(symbols, deltas)
+}
+
+// Broadcast sends a message to all connected clients
+func (h *Hub) Broadcast(data interface{}) error {
+	message, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	h.broadcast <- message
+	return nil
+}
+
+// SendToUser sends a message to every connection authenticated as username.
+// Clients that can't keep up are disconnected.
+func (h *Hub) SendToUser(username string, data interface{}) error {
+	message, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for client := range h.users[username] {
+		h.queue(client, message)
+	}
+	return nil
 }
@@ -0,0 +1,155 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"stocks-backend/internal/money"
+)
+
+// Prices are streamed as a snapshot of each symbol when a client subscribes
+// to it, followed by one delta per tick. Every symbol has its own sequence
+// number, incremented on each tick; the snapshot carries the sequence it was
+// taken at and each delta its own, so a client that sees a delta that isn't
+// the next in sequence has missed one and should send a resync message.
+//
+//	{"type": "snapshot", "prices": [<full price>...], "seq": {"AAPL": 12}}
+//	{"type": "delta", "prices": [{"symbol": "AAPL", "seq": 13, "price": ..., "change": ..., "volume": ...}]}
+
+// PriceDelta is what changes in a symbol's price on each tick
+type PriceDelta struct {
+	Symbol string       `json:"symbol"`
+	Seq    uint64       `json:"seq"`
+	Price  money.Amount `json:"price"`
+	Change float64      `json:"change"` // percentage change
+	Volume int64        `json:"volume"`
+}
+
+// PriceUpdate is a symbol's new price: the full record sent in snapshots
+// and the delta sent to subscribers. The hub sets the delta's Seq.
+type PriceUpdate struct {
+	Snapshot interface{}
+	Delta    PriceDelta
+}
+
+// priceState is the latest price of a symbol and its sequence number
+type priceState struct {
+	seq      uint64
+	snapshot json.RawMessage
+}
+
+// SeedPrices records the current prices so clients that subscribe before the
+// first tick get a snapshot. Nothing is sent.
+func (h *Hub) SeedPrices(updates []PriceUpdate) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, update := range updates {
+		if err := h.storePrice(update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublishPrices advances each updated symbol's sequence number and sends
+// every client a delta message for the symbols it has subscribed to, in the
+// order given. Clients that can't keep up get the latest delta per symbol
+// once they do, skipping sequence numbers.
+func (h *Hub) PublishPrices(updates []PriceUpdate) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	encoded := make([]json.RawMessage, len(updates))
+	for i, update := range updates {
+		if err := h.storePrice(update); err != nil {
+			return err
+		}
+		state := h.prices[update.Delta.Symbol]
+		state.seq++
+		update.Delta.Seq = state.seq
+		delta, err := json.Marshal(update.Delta)
+		if err != nil {
+			return err
+		}
+		encoded[i] = delta
+	}
+
+	for client := range h.clients {
+		var symbols []string
+		var deltas []json.RawMessage
+		for i, update := range updates {
+			if client.subscribedTo(update.Delta.Symbol) {
+				symbols = append(symbols, update.Delta.Symbol)
+				deltas = append(deltas, encoded[i])
+			}
+		}
+		if len(deltas) > 0 {
+			h.queueDeltas(client, symbols, deltas)
+		}
+	}
+	return nil
+}
+
+// deltaMessage builds a delta message from encoded deltas
+func deltaMessage(deltas []json.RawMessage) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"type":   "delta",
+		"prices": deltas,
+	})
+}
+
+// storePrice keeps an update as its symbol's latest snapshot. The caller
+// must hold h.mutex for writing.
+func (h *Hub) storePrice(update PriceUpdate) error {
+	snapshot, err := json.Marshal(update.Snapshot)
+	if err != nil {
+		return err
+	}
+	symbol := update.Delta.Symbol
+	state, exists := h.prices[symbol]
+	if !exists {
+		state = &priceState{}
+		h.prices[symbol] = state
+		h.symbols = append(h.symbols, symbol)
+	}
+	state.snapshot = snapshot
+	return nil
+}
+
+// sendSnapshot queues a snapshot of the given symbols that the client is
+// subscribed to, or of all its subscriptions if symbols is empty. Deltas
+// held back for those symbols are older than the snapshot, so they are
+// dropped rather than sent after it. The caller must hold h.mutex for
+// writing.
+func (h *Hub) sendSnapshot(client *Client, symbols []string) {
+	requested := make(map[string]bool, len(symbols))
+	for _, symbol := range symbols {
+		requested[symbol] = true
+	}
+
+	prices := []json.RawMessage{}
+	seqs := map[string]uint64{}
+	var included []string
+	for _, symbol := range h.symbols {
+		wanted := len(symbols) == 0 || requested[symbol] || requested[AllSymbols]
+		if !wanted || !client.subscribedTo(symbol) {
+			continue
+		}
+		state := h.prices[symbol]
+		prices = append(prices, state.snapshot)
+		seqs[symbol] = state.seq
+		included = append(included, symbol)
+	}
+
+	message, err := json.Marshal(map[string]interface{}{
+		"type":   "snapshot",
+		"prices": prices,
+		"seq":    seqs,
+	})
+	if err != nil {
+		log.Printf("Error encoding snapshot: %v", err)
+		return
+	}
+	client.dropConflated(included)
+	h.queue(client, message)
+}
@@ -0,0 +1,163 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"stocks-backend/internal/auth"
+	"strings"
+)
+
+// Messages a client can send:
+//
+//	{"type": "auth", "token": "<jwt>"}            authenticate the connection
+//	{"type": "subscribe", "symbols": ["AAPL"]}    receive prices for symbols
+//	{"type": "unsubscribe", "symbols": ["AAPL"]}  stop receiving them
+//	{"type": "resync", "symbols": ["AAPL"]}       resend a snapshot
+//	{"type": "ping"}                              answered with a pong
+//
+// The symbol "*" subscribes to every symbol. Subscribe and unsubscribe are
+// answered with the client's full subscription list, and a subscribe is
+// followed by a snapshot of the symbols it added, see prices.go. Only
+// symbols with a price can be subscribed, up to maxSubscriptions of them. A
+// resync without symbols resends every subscribed symbol. Errors are
+// answered with an error message.
+
+// AllSymbols subscribes a client to the prices of every symbol
+const AllSymbols = "*"
+
+// maxSubscriptions is the most symbols a client can subscribe to; "*"
+// counts as one
+const maxSubscriptions = 50
+
+// clientMessage is a message sent by a client
+type clientMessage struct {
+	Type    string   `json:"type"`
+	Token   string   `json:"token"`
+	Symbols []string `json:"symbols"`
+}
+
+// handleMessage answers one message from the client
+func (c *Client) handleMessage(message []byte) {
+	var msg clientMessage
+	if err := json.Unmarshal(message, &msg); err != nil {
+		c.replyError("Invalid message")
+		return
+	}
+
+	switch msg.Type {
+	case "auth":
+		c.authenticate(msg.Token)
+	case "subscribe", "unsubscribe":
+		if len(msg.Symbols) == 0 {
+			c.replyError("symbols is required")
+			return
+		}
+		symbols := normalizeSymbols(msg.Symbols)
+		add := msg.Type == "subscribe"
+		subscribed, err := c.Hub.subscribe(c, symbols, add)
+		if err != nil {
+			c.replyError(err.Error())
+			return
+		}
+		message, _ := json.Marshal(map[string]interface{}{"type": "subscribed", "symbols": subscribed})
+		c.Hub.replies <- reply{client: c, message: message, snapshot: add, symbols: symbols}
+	case "resync":
+		c.Hub.replies <- reply{client: c, snapshot: true, symbols: normalizeSymbols(msg.Symbols)}
+	case "ping":
+		c.reply(map[string]string{"type": "pong"}, false)
+	default:
+		c.replyError("Unknown message type")
+	}
+}
+
+// authenticate binds the client to the token's user, so it receives that
+// user's order and account updates
+func (c *Client) authenticate(token string) {
+	if c.Username != "" {
+		c.replyError("Already authenticated")
+		return
+	}
+	claims, err := auth.ValidateToken(token)
+	if err != nil {
+		c.replyError("Invalid or expired token")
+		return
+	}
+
+	c.Hub.mutex.Lock()
+	c.Username = claims.Username
+	c.Hub.mutex.Unlock()
+	log.Printf("WebSocket client authenticated as user=%s", claims.Username)
+	c.reply(map[string]string{"type": "authenticated", "username": claims.Username}, true)
+}
+
+// normalizeSymbols upper-cases symbols and trims their whitespace
+func normalizeSymbols(symbols []string) []string {
+	normalized := make([]string, len(symbols))
+	for i, symbol := range symbols {
+		normalized[i] = strings.ToUpper(strings.TrimSpace(symbol))
+	}
+	return normalized
+}
+
+// subscribe adds symbols to a client's subscriptions, or removes them, and
+// returns the resulting subscriptions in order. Nothing is added if a symbol
+// has no price or the client would have more than maxSubscriptions.
+func (h *Hub) subscribe(client *Client, symbols []string, add bool) ([]string, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if client.symbols == nil {
+		client.symbols = make(map[string]bool)
+	}
+	if add {
+		added := 0
+		for _, symbol := range symbols {
+			if _, exists := h.prices[symbol]; !exists && symbol != AllSymbols {
+				return nil, fmt.Errorf("Unknown symbol %q", symbol)
+			}
+			if !client.symbols[symbol] {
+				added++
+			}
+		}
+		if len(client.symbols)+added > maxSubscriptions {
+			return nil, fmt.Errorf("At most %d symbols can be subscribed", maxSubscriptions)
+		}
+	}
+	for _, symbol := range symbols {
+		if add {
+			client.symbols[symbol] = true
+		} else {
+			delete(client.symbols, symbol)
+		}
+	}
+
+	subscribed := make([]string, 0, len(client.symbols))
+	for symbol := range client.symbols {
+		subscribed = append(subscribed, symbol)
+	}
+	sort.Strings(subscribed)
+	return subscribed, nil
+}
+
+// subscribedTo reports whether the client wants symbol's prices. The caller
+// must hold Hub.mutex.
+func (c *Client) subscribedTo(symbol string) bool {
+	return c.symbols[symbol] || c.symbols[AllSymbols]
+}
+
+// reply sends a message to this client only, through the hub's loop
+func (c *Client) reply(data interface{}, bind bool) {
+	message, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error encoding WebSocket reply: %v", err)
+		return
+	}
+	c.Hub.replies <- reply{client: c, message: message, bind: bind}
+}
+
+// replyError sends the client an error message
+func (c *Client) replyError(message string) {
+	c.reply(map[string]string{"type": "error", "error": message}, false)
+}
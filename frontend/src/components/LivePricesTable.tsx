@@ -1,12 +1,7 @@
 import React, { useState, useEffect, useRef } from 'react';
 import { StockPrice } from '../types';
 import PriceChart from './PriceChart';
-import { createWebSocket } from '../utils/websocket';
-
-interface PriceUpdate {
-    type: string;
-    prices: StockPrice[];
-}
+import { applyPriceMessage, createWebSocket } from '../utils/websocket';
 
 interface LivePricesTableProps {
     onStockClick: (symbol: string) => void;
@@ -18,6 +13,8 @@ const LivePricesTable: React.FC<LivePricesTableProps> = ({ onStockClick }) => {
     const ws = useRef<WebSocket | null>(null);
     const stockOrderRef = useRef<string[]>([]);
     const previousPrices = useRef<Record<string, number>>({});
+    const pricesRef = useRef<Record<string, StockPrice>>({});
+    const seqsRef = useRef<Record<string, number>>({});
 
     useEffect(() => {
         // Connect to WebSocket using the utility function
@@ -25,27 +22,30 @@ const LivePricesTable: React.FC<LivePricesTableProps> = ({ onStockClick }) => {
 
         ws.current.onopen = () => {
             console.log('WebSocket connected');
+            ws.current?.send(JSON.stringify({ type: 'subscribe', symbols: ['*'] }));
         };
 
         ws.current.onmessage = (event) => {
-            const data: PriceUpdate = JSON.parse(event.data);
-            if (data.type === 'priceUpdate' && data.prices) {
-                // Save initial order if not set
-                if (stockOrderRef.current.length === 0) {
-                    stockOrderRef.current = data.prices.map(p => p.symbol);
+            const data = JSON.parse(event.data);
+            const next = applyPriceMessage(data, pricesRef.current, seqsRef.current, (symbols) => {
+                ws.current?.send(JSON.stringify({ type: 'resync', symbols }));
+            });
+            if (!next) return;
+            pricesRef.current = next;
+
+            // Keep the order of the first snapshot, adding new symbols at the end
+            Object.keys(next).forEach((symbol) => {
+                if (!stockOrderRef.current.includes(symbol)) {
+                    stockOrderRef.current.push(symbol);
                 }
+            });
+            const orderedPrices = stockOrderRef.current.map(symbol => next[symbol]);
 
-                // Maintain the original order
-                const orderedPrices = stockOrderRef.current
-                    .map(symbol => data.prices.find(p => p.symbol === symbol))
-                    .filter(Boolean) as StockPrice[];
+            orderedPrices.forEach((price) => {
+                previousPrices.current[price.symbol] = price.price;
+            });
 
-                data.prices.forEach((price) => {
-                    previousPrices.current[price.symbol] = price.price;
-                });
-
-                setPrices(orderedPrices);
-            }
+            setPrices(orderedPrices);
         };
 
         ws.current.onerror = (error) => {
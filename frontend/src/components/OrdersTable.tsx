@@ -2,6 +2,7 @@ import React, { useState, useEffect } from 'react';
 import { useNavigate } from 'react-router-dom';
 import axios from '../api/axios';
 import { Order, StockPrice } from '../types';
+import { createReconnectingWebSocket } from '../utils/websocket';
 
 interface OrdersTableProps {
     refreshTrigger?: number;
@@ -47,6 +48,22 @@ const OrdersTable: React.FC<OrdersTableProps> = ({ refreshTrigger }) => {
         fetchOrders();
     }, [refreshTrigger]);
 
+    // Apply fills, cancellations and expiries pushed by the server
+    useEffect(() => {
+        const socket = createReconnectingWebSocket('/ws', (event) => {
+            const data = JSON.parse(event.data);
+            if (data.type !== 'orderUpdate') return;
+            const updated: Order = data.order;
+            setOrders(prev => {
+                const exists = prev.some(order => order.id === updated.id);
+                return exists
+                    ? prev.map(order => (order.id === updated.id ? updated : order))
+                    : [...prev, updated];
+            });
+        });
+        return () => socket.close();
+    }, []);
+
     const getSideBadgeColor = (side: string): string => {
         return side === 'buy'
             ? 'bg-green-100 text-green-800 border border-green-300'
@@ -54,11 +71,24 @@ const OrdersTable: React.FC<OrdersTableProps> = ({ refreshTrigger }) => {
     };
 
     const getStatusBadgeColor = (status: string): string => {
-        return status === 'done'
-            ? 'bg-blue-100 text-blue-800 border border-blue-300'
-            : 'bg-yellow-100 text-yellow-800 border border-yellow-300';
+        switch (status) {
+            case 'filled':
+                return 'bg-blue-100 text-blue-800 border border-blue-300';
+            case 'new':
+            case 'partially_filled':
+                return 'bg-yellow-100 text-yellow-800 border border-yellow-300';
+            default:
+                return 'bg-gray-100 text-gray-800 border border-gray-300';
+        }
     };
 
+    const formatStatus = (status: string): string => status.replace('_', ' ');
+
+    const formatQuantity = (order: Order): string =>
+        order.filledQuantity > 0 && order.filledQuantity < order.quantity
+            ? `${order.filledQuantity}/${order.quantity}`
+            : `${order.quantity}`;
+
     const formatDate = (dateString: string): string => {
         const date = new Date(dateString);
         return date.toLocaleDateString();
@@ -115,8 +145,13 @@ const OrdersTable: React.FC<OrdersTableProps> = ({ refreshTrigger }) => {
                         className="select-custom"
                     >
                         <option value="all">All Status</option>
-                        <option value="pending">Pending</option>
-                        <option value="done">Done</option>
+                        <option value="inactive">Inactive</option>
+                        <option value="new">New</option>
+                        <option value="partially_filled">Partially Filled</option>
+                        <option value="filled">Filled</option>
+                        <option value="cancelled">Cancelled</option>
+                        <option value="rejected">Rejected</option>
+                        <option value="expired">Expired</option>
                     </select>
                 </div>
             </div>
@@ -187,7 +222,7 @@ const OrdersTable: React.FC<OrdersTableProps> = ({ refreshTrigger }) => {
                                                 {order.side}
                                             </span>
                                             <span className={`px-2 py-1 rounded-full text-xs font-semibold uppercase ${getStatusBadgeColor(order.status)}`}>
-                                                {order.status}
+                                                {formatStatus(order.status)}
                                             </span>
                                         </div>
                                     </div>
@@ -199,7 +234,7 @@ const OrdersTable: React.FC<OrdersTableProps> = ({ refreshTrigger }) => {
                                         </div>
                                         <div>
                                             <div className="text-gray-500 dark:text-gray-400 text-xs">Quantity</div>
-                                            <div className="font-semibold text-gray-900 dark:text-gray-100">{order.quantity}</div>
+                                            <div className="font-semibold text-gray-900 dark:text-gray-100">{formatQuantity(order)}</div>
                                         </div>
                                         <div>
                                             <div className="text-gray-500 dark:text-gray-400 text-xs">Price</div>
@@ -282,14 +317,14 @@ const OrdersTable: React.FC<OrdersTableProps> = ({ refreshTrigger }) => {
                                             </span>
                                         </td>
                                         <td className="px-6 py-4 whitespace-nowrap text-gray-800 dark:text-gray-100">
-                                            {order.quantity}
+                                            {formatQuantity(order)}
                                         </td>
                                         <td className="px-6 py-4 whitespace-nowrap text-gray-800 dark:text-gray-100">
                                             ${order.price.toFixed(2)}
                                         </td>
                                         <td className="px-6 py-4 whitespace-nowrap">
                                             <span className={`px-3 py-1 rounded-full text-xs font-semibold uppercase ${getStatusBadgeColor(order.status)}`}>
-                                                {order.status}
+                                                {formatStatus(order.status)}
                                             </span>
                                         </td>
                                         <td className="px-6 py-4 whitespace-nowrap text-sm text-gray-600 dark:text-gray-300">
@@ -3,6 +3,7 @@ import axios from '../api/axios';
 import { StockPrice } from '../types';
 import PriceChart from './PriceChart';
 import { useAuth } from '../context/AuthContext';
+import { applyPriceMessage, createReconnectingWebSocket } from '../utils/websocket';
 import { useToast } from '../context/ToastContext';
 
 interface StockDetailProps {
@@ -36,6 +37,22 @@ const StockDetail: React.FC<StockDetailProps> = ({ symbol, onClose, onOrderCreat
         };
     }, [symbol]);
 
+    // Stream this symbol's price while the modal is open
+    useEffect(() => {
+        let streamed: Record<string, StockPrice> = {};
+        const seqs: Record<string, number> = {};
+        const socket = createReconnectingWebSocket('/ws', (event) => {
+            const next = applyPriceMessage(JSON.parse(event.data), streamed, seqs, (symbols) => {
+                socket.send(JSON.stringify({ type: 'resync', symbols }));
+            });
+            if (next) {
+                streamed = next;
+                if (next[symbol]) setStock(next[symbol]);
+            }
+        }, undefined, 3000, [symbol]);
+        return () => socket.close();
+    }, [symbol]);
+
     const fetchStockDetail = async () => {
         try {
             const response = await axios.get(`/stocks/${symbol}`);
@@ -2,7 +2,7 @@ import React, { useState, useEffect } from 'react';
 import { useNavigate } from 'react-router-dom';
 import axios from '../api/axios';
 import { useAuth } from '../context/AuthContext';
-import { StockPrice } from '../types';
+import { Position, StockPrice } from '../types';
 import StockDetail from '../components/StockDetail';
 import { useTheme } from '../context/ThemeContext';
 import NavButton from '../components/NavButton';
@@ -35,9 +35,9 @@ const Portfolio: React.FC = () => {
 
     const fetchPortfolio = async () => {
         try {
-            // Fetch account to get portfolio
+            // Fetch account to get positions, valued by the server
             const accountResponse = await axios.get('/account');
-            const portfolioData = accountResponse.data.portfolio || {};
+            const positions = (accountResponse.data.positions || []) as Position[];
             // Keep AuthContext credits in sync with server
             if (typeof accountResponse.data?.credits === 'number') {
                 updateCredits(accountResponse.data.credits);
@@ -47,43 +47,26 @@ const Portfolio: React.FC = () => {
             const stocksResponse = await axios.get('/prices');
             const stocks: StockPrice[] = stocksResponse.data;
 
-            // Fetch orders to compute average buy price per symbol (done orders only)
-            const ordersResponse = await axios.get('/orders');
-            const orders = (ordersResponse.data || []) as Array<{ symbol: string; side: string; status: string; price: number; quantity: number }>;
-
-            // Build portfolio items
+            // Build portfolio items from the open positions
             const items: PortfolioItem[] = [];
             let total = 0;
             let invested = 0;
 
-            for (const symbol in portfolioData) {
-                const quantity = portfolioData[symbol];
-                if (quantity > 0) {
-                    const stock = stocks.find(s => s.symbol === symbol);
-                    if (stock) {
-                        const value = stock.price * quantity;
-                        total += value;
-
-                        // Weighted average of completed buy orders
-                        let buyQty = 0;
-                        let buyCost = 0;
-                        orders.filter(o => o.symbol === symbol && o.status === 'done' && o.side === 'buy')
-                            .forEach(o => { buyQty += o.quantity; buyCost += o.quantity * o.price; });
-                        const avgPrice = buyQty > 0 ? buyCost / buyQty : undefined;
-                        if (avgPrice !== undefined) {
-                            invested += avgPrice * quantity;
-                        }
-                        items.push({
-                            symbol: stock.symbol,
-                            quantity,
-                            currentPrice: stock.price,
-                            totalValue: value,
-                            name: stock.name,
-                            logo: stock.logo,
-                            change: stock.change,
-                            avgPrice: avgPrice,
-                        });
-                    }
+            for (const position of positions) {
+                const stock = stocks.find(s => s.symbol === position.symbol);
+                if (position.quantity > 0 && stock) {
+                    total += position.marketValue;
+                    invested += position.costBasis;
+                    items.push({
+                        symbol: stock.symbol,
+                        quantity: position.quantity,
+                        currentPrice: position.price,
+                        totalValue: position.marketValue,
+                        name: stock.name,
+                        logo: stock.logo,
+                        change: stock.change,
+                        avgPrice: position.averageCost,
+                    });
                 }
             }
 
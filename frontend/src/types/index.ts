@@ -11,13 +11,57 @@ export interface StockPrice {
     volume: number;
 }
 
+export interface PriceDelta {
+    symbol: string;
+    seq: number;
+    price: number;
+    change: number;
+    volume: number;
+}
+
 export interface Order {
     id: string;
     symbol: string;
     side: 'buy' | 'sell';
-    orderType: 'market' | 'limit';
+    orderType: 'market' | 'limit' | 'stop' | 'stop_limit' | 'trailing_stop';
     quantity: number;
     price: number;
-    status: 'pending' | 'done';
+    stopPrice?: number;
+    trailAmount?: number;
+    trailPercent?: number;
+    waterMark?: number;
+    triggered?: boolean;
+    timeInForce: 'GTC' | 'IOC' | 'FOK' | 'DAY' | 'GTD';
+    expiresAt?: string;
+    parentId?: string;
+    childIds?: string[];
+    ocoWith?: string;
+    heldBySibling?: boolean;
+    status: 'inactive' | 'new' | 'partially_filled' | 'filled' | 'cancelled' | 'rejected' | 'expired';
     createdAt: string;
+    filledQuantity: number;
+    avgFillPrice: number;
+    fills: OrderFill[] | null;
+    rejectReason?: string;
+}
+
+export interface OrderFill {
+    timestamp: string;
+    quantity: number;
+    price: number;
+    realizedPnl?: number;
+}
+
+export interface Position {
+    symbol: string;
+    quantity: number;
+    averageCost: number;
+    costBasis: number;
+    price: number;
+    marketValue: number;
+    unrealizedPnl: number;
+    unrealizedPnlPercent: number;
+    dayChange: number;
+    dayChangePercent: number;
+    realizedPnl: number;
 }
@@ -2,9 +2,12 @@
  * WebSocket utility for connecting to the backend
  * Automatically uses ws:// or wss:// based on the page protocol
  */
+import { PriceDelta, StockPrice } from '../types';
 
 /**
- * Creates a WebSocket connection to the specified path
+ * Creates a WebSocket connection to the specified path. When the user is
+ * logged in the JWT is passed along so the server also sends their own
+ * orderUpdate and accountUpdate messages.
  * @param path - The WebSocket path (e.g., '/ws')
  * @returns WebSocket instance
  */
@@ -20,6 +23,10 @@ export function createWebSocket(path: string): WebSocket {
 
     console.log('Creating WebSocket connection to:', wsUrl);
 
+    const token = localStorage.getItem('token');
+    if (token) {
+        return new WebSocket(`${wsUrl}?token=${encodeURIComponent(token)}`);
+    }
     return new WebSocket(wsUrl);
 }
 
@@ -29,13 +36,15 @@ export function createWebSocket(path: string): WebSocket {
  * @param onMessage - Message handler
  * @param onError - Error handler (optional)
  * @param reconnectDelay - Delay before reconnecting in ms (default: 3000)
+ * @param symbols - Symbols to subscribe to on every (re)connect (optional)
  */
 export function createReconnectingWebSocket(
     path: string,
     onMessage: (event: MessageEvent) => void,
     onError?: (event: Event) => void,
-    reconnectDelay: number = 3000
-): { ws: WebSocket | null; close: () => void } {
+    reconnectDelay: number = 3000,
+    symbols: string[] = []
+): { ws: WebSocket | null; send: (data: string) => void; close: () => void } {
     let ws: WebSocket | null = null;
     let shouldReconnect = true;
     let reconnectTimeout: number | null = null;
@@ -45,6 +54,9 @@ export function createReconnectingWebSocket(
 
         ws.onopen = () => {
             console.log('WebSocket connected');
+            if (symbols.length > 0) {
+                ws?.send(JSON.stringify({ type: 'subscribe', symbols }));
+            }
         };
 
         ws.onmessage = onMessage;
@@ -67,6 +79,10 @@ export function createReconnectingWebSocket(
 
     return {
         ws,
+        // Sends on the current connection, which changes on reconnect
+        send: (data: string) => {
+            if (ws && ws.readyState === WebSocket.OPEN) ws.send(data);
+        },
         close: () => {
             shouldReconnect = false;
             if (reconnectTimeout) window.clearTimeout(reconnectTimeout);
@@ -74,3 +90,53 @@ export function createReconnectingWebSocket(
         },
     };
 }
+
+/**
+ * Applies a snapshot or delta price message to the known prices
+ * @param data - Parsed WebSocket message
+ * @param prices - Known prices by symbol
+ * @param seqs - Last sequence number seen per symbol, updated in place
+ * @param resync - Called with the symbols that missed a delta
+ * @returns The new prices, or null if the message wasn't a price message
+ */
+export function applyPriceMessage(
+    data: any,
+    prices: Record<string, StockPrice>,
+    seqs: Record<string, number>,
+    resync: (symbols: string[]) => void
+): Record<string, StockPrice> | null {
+    if (data.type === 'snapshot') {
+        const next = { ...prices };
+        (data.prices as StockPrice[]).forEach((price) => {
+            next[price.symbol] = price;
+        });
+        Object.assign(seqs, data.seq);
+        return next;
+    }
+    if (data.type !== 'delta') return null;
+
+    const next = { ...prices };
+    const missed: string[] = [];
+    (data.prices as PriceDelta[]).forEach((delta) => {
+        const stock = next[delta.symbol];
+        if (!stock || seqs[delta.symbol] === undefined) {
+            missed.push(delta.symbol);
+            return;
+        }
+        // A slow connection may get a delta the last snapshot already has
+        if (delta.seq <= seqs[delta.symbol]) return;
+        if (delta.seq !== seqs[delta.symbol] + 1) missed.push(delta.symbol);
+        seqs[delta.symbol] = delta.seq;
+        next[delta.symbol] = {
+            ...stock,
+            price: delta.price,
+            change: delta.change,
+            volume: delta.volume,
+            priceHistory: [...stock.priceHistory, delta.price].slice(-20),
+            dayHigh: Math.max(stock.dayHigh, delta.price),
+            dayLow: Math.min(stock.dayLow, delta.price),
+        };
+    });
+    if (missed.length > 0) resync(missed);
+    return next;
+}